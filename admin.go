@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminToken guards operational endpoints. When empty they are disabled.
+var adminToken string
+
+// authorizeAdmin checks for "Authorization: Bearer <MAILER_ADMIN_TOKEN>",
+// writing the error response itself when the request is not allowed.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		writeError(w, r, http.StatusNotFound, "")
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// alignFromTemplate renders the display name of the aligned From header.
+// When nil, the submitter's address is used as the header From unchanged.
+var alignFromTemplate *template.Template
+
+const defaultAlignFromTemplate = "{{.Name}} via Form"
+
+// fromTemplate, when set, renders the whole From header, such as
+// "Website Contact" <noreply@example.com>, from the same data as the
+// subject template. It takes the place of alignFromTemplate: the submitter
+// moves to Reply-To and to the first line of the text body.
+var fromTemplate *template.Template
+
+type alignFromData struct {
+	Name    string
+	Address string
+}
+
+// alignedFrom returns a DMARC-aligned From header that uses outboundSender
+// as the address and names the submitter, along with the Reply-To that
+// routes replies back to them.
+func alignedFrom(submitter string) (string, string) {
+	data := alignFromData{Name: submitter}
+	replyTo := ""
+	if address, err := mail.ParseAddress(submitter); err == nil {
+		data.Address = address.Address
+		data.Name = address.Name
+		if data.Name == "" {
+			data.Name = address.Address
+		}
+		replyTo = address.String()
+	}
+
+	var name bytes.Buffer
+	if err := alignFromTemplate.Execute(&name, data); err != nil {
+		name.Reset()
+		name.WriteString(data.Name)
+	}
+	from := mail.Address{Name: stripLineBreaks(name.String()), Address: outboundSender}
+	return from.String(), replyTo
+}
+
+// templatedFrom renders fromTemplate as a single address with no control
+// characters, falling back to outboundSender if it renders to anything
+// else.
+func (m *Email) templatedFrom() string {
+	from, err := renderFrom(fromTemplate, m.templateData())
+	if err != nil {
+		log.Printf("Unable to render MAILER_FROM_TEMPLATE, using %s: %s\n", outboundSender, err.Error())
+		return outboundSender
+	}
+	return from
+}
+
+func renderFrom(from *template.Template, data map[string]string) (string, error) {
+	var rendered strings.Builder
+	if err := from.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	text := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, rendered.String())
+	addresses, err := mail.ParseAddressList(text)
+	if err != nil {
+		return "", err
+	}
+	if len(addresses) != 1 {
+		return "", fmt.Errorf("%q is not a single address", text)
+	}
+	return addresses[0].String(), nil
+}
+
+func stripLineBreaks(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
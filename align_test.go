@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// refusingTransport refuses every recipient with a temporary reply the
+// first time and records the From each attempt would be sent with.
+type refusingTransport struct {
+	mu    sync.Mutex
+	froms []string
+}
+
+func (f *refusingTransport) Deliver(ctx context.Context, message *Email, msg []byte) (*deliveryResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.froms = append(f.froms, message.templatedFrom())
+	if len(f.froms) == 1 {
+		result := &deliveryResult{}
+		result.reject(message.recipient(), errors.New("try again later"))
+		return result, errAllRejected
+	}
+	return &deliveryResult{Accepted: []string{message.recipient()}}, nil
+}
+
+func TestTemplatedFromSurvivesRetry(t *testing.T) {
+	setupSendHandler(t)
+	fake := &refusingTransport{}
+	transport = fake
+	fromTemplate = template.Must(template.New("from").Parse(`{{.Company}} via Forms <forms@example.com>`))
+	retryRejectedAfter = time.Minute
+	defer func() { fromTemplate, retryRejectedAfter = nil, 0 }()
+
+	message := &Email{From: "visitor@example.org", Body: "hello", Fields: map[string]string{"company": "Acme"}}
+	if outcome := deliver(message); outcome != outcomeDeferred {
+		t.Fatalf("first attempt = %v, want the message deferred", outcome)
+	}
+	due, err := messageScheduler.backend.Claim(time.Now().Add(2*time.Minute), time.Minute, 1)
+	if err != nil || len(due) != 1 {
+		t.Fatalf("claimed %v, %v", due, err)
+	}
+	if outcome := deliver(due[0].email()); outcome != outcomeDelivered {
+		t.Fatalf("retry = %v, want the message delivered", outcome)
+	}
+
+	want := `"Acme via Forms" <forms@example.com>`
+	if len(fake.froms) != 2 || fake.froms[0] != want || fake.froms[1] != want {
+		t.Errorf("attempts were sent from %q, want %q both times", fake.froms, want)
+	}
+}
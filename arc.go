@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// arcSigner adds a first-instance ARC set (RFC 8617) to outbound messages.
+type arcSigner struct {
+	domain     string
+	selector   string
+	authservID string
+	algorithm  string
+	key        crypto.Signer
+}
+
+var arcSealer *arcSigner
+
+// arcSignedHeaders lists the fields covered by ARC-Message-Signature when
+// present in the message.
+var arcSignedHeaders = []string{
+	"from", "to", "cc", "reply-to", "subject", "date", "message-id",
+	"mime-version", "content-type",
+}
+
+// loadARCSigner reads a PEM encoded RSA or Ed25519 private key.
+func loadARCSigner(domain string, selector string, keyFile string, authservID string) (*arcSigner, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found in key file")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer := &arcSigner{domain: domain, selector: selector, authservID: authservID}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signer.algorithm = "rsa-sha256"
+		signer.key = key
+	case ed25519.PrivateKey:
+		signer.algorithm = "ed25519-sha256"
+		signer.key = key
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// Seal prepends ARC-Seal, ARC-Message-Signature and
+// ARC-Authentication-Results headers to msg.
+func (s *arcSigner) Seal(msg []byte, now time.Time) ([]byte, error) {
+	header, body := splitMessage(msg)
+	fields := splitHeaderFields(header)
+
+	bodyHash := sha256.Sum256(canonicalBodyRelaxed(body))
+	aar := fmt.Sprintf("ARC-Authentication-Results: i=1; %s; none", s.authservID)
+
+	var signed []string
+	var input bytes.Buffer
+	used := make(map[int]bool)
+	for _, name := range arcSignedHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			signed = append(signed, name)
+			input.WriteString(canonicalHeaderRelaxed(fields[i]))
+			input.WriteString("\r\n")
+			break
+		}
+	}
+
+	timestamp := now.Unix()
+	ams := fmt.Sprintf(
+		"ARC-Message-Signature: i=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.algorithm, s.domain, s.selector, timestamp, strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]),
+	)
+	input.WriteString(canonicalHeaderRelaxed(ams))
+	signature, err := s.sign(input.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	ams += signature
+
+	seal := fmt.Sprintf("ARC-Seal: i=1; a=%s; t=%d; cv=none; d=%s; s=%s; b=", s.algorithm, timestamp, s.domain, s.selector)
+	input.Reset()
+	input.WriteString(canonicalHeaderRelaxed(aar) + "\r\n")
+	input.WriteString(canonicalHeaderRelaxed(ams) + "\r\n")
+	input.WriteString(canonicalHeaderRelaxed(seal))
+	signature, err = s.sign(input.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	seal += signature
+
+	var sealed bytes.Buffer
+	for _, field := range []string{seal, ams, aar} {
+		sealed.WriteString(foldHeader(field))
+		sealed.WriteString("\r\n")
+	}
+	sealed.Write(msg)
+	return sealed.Bytes(), nil
+}
+
+func (s *arcSigner) sign(data []byte) (string, error) {
+	digest := sha256.Sum256(data)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if s.algorithm == "ed25519-sha256" {
+		opts = crypto.Hash(0)
+	}
+	signature, err := s.key.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// splitMessage separates the header block from the body.
+func splitMessage(msg []byte) ([]byte, []byte) {
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		return msg[:i+2], msg[i+4:]
+	}
+	if i := bytes.Index(msg, []byte("\n\n")); i >= 0 {
+		return msg[:i+1], msg[i+2:]
+	}
+	return msg, nil
+}
+
+// splitHeaderFields returns each (possibly folded) header field without its
+// trailing line break.
+func splitHeaderFields(header []byte) []string {
+	var fields []string
+	lines := strings.Split(strings.ReplaceAll(string(header), "\r\n", "\n"), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return strings.TrimSpace(field[:i])
+	}
+	return field
+}
+
+// canonicalHeaderRelaxed implements the "relaxed" header canonicalization
+// of RFC 6376 section 3.4.2, without the trailing CRLF.
+func canonicalHeaderRelaxed(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(field)) + ":"
+	}
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(field[i+1:])
+	value = strings.Join(strings.Fields(value), " ")
+	return name + ":" + value
+}
+
+// canonicalBodyRelaxed implements the "relaxed" body canonicalization of
+// RFC 6376 section 3.4.4.
+func canonicalBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		line = strings.Join(strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t'
+		}), " ")
+		if strings.HasPrefix(lines[i], " ") || strings.HasPrefix(lines[i], "\t") {
+			if line != "" {
+				line = " " + line
+			}
+		}
+		lines[i] = line
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// foldHeader wraps a structured header onto continuation lines after each
+// tag separator. Relaxed canonicalization makes this transparent.
+func foldHeader(field string) string {
+	return strings.ReplaceAll(field, "; ", ";\r\n\t")
+}
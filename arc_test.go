@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const arcTestMessage = "From: Visitor <visitor@example.org>\r\n" +
+	"To: inbox@example.com\r\n" +
+	"Subject:   Hello\r\n" +
+	"  there\r\n" +
+	"Date: Wed, 14 Oct 2026 12:00:00 +0000\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"X-Unsigned: left alone\r\n" +
+	"\r\n" +
+	"Hello  world \t\r\n" +
+	"\r\n" +
+	" indented line\r\n" +
+	"\r\n" +
+	"\r\n"
+
+// The helpers below verify an ARC set straight from RFC 6376 and RFC 8617,
+// sharing nothing with arc.go, so that a canonicalization mistake in the
+// signer cannot be mirrored by the check.
+
+var (
+	wspRun    = regexp.MustCompile(`[ \t]+`)
+	foldBreak = regexp.MustCompile(`\r\n([ \t])`)
+	emptyB    = regexp.MustCompile(`(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+)
+
+func verifyRelaxedHeader(field string) string {
+	name, value, _ := strings.Cut(foldBreak.ReplaceAllString(field, "$1"), ":")
+	value = strings.TrimSpace(wspRun.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+func verifyRelaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(wspRun.ReplaceAllString(lines[i], " "), " ")
+	}
+	canonical := strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n")
+	if canonical == "" {
+		return ""
+	}
+	return canonical + "\r\n"
+}
+
+func verifyTags(field string) map[string]string {
+	_, value, _ := strings.Cut(field, ":")
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+func verifySignature(t *testing.T, public crypto.PublicKey, data string, signature string) bool {
+	t.Helper()
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		t.Fatalf("signature is not base64: %v", err)
+	}
+	digest := sha256.Sum256([]byte(data))
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		// RFC 8463: ed25519-sha256 signs the SHA-256 hash of the input.
+		return ed25519.Verify(public, digest[:], sig)
+	}
+	t.Fatalf("unexpected key type %T", public)
+	return false
+}
+
+// verifyARC checks the first-instance ARC set at the top of msg and returns
+// a description of the first problem found.
+func verifyARC(t *testing.T, public crypto.PublicKey, msg []byte) string {
+	t.Helper()
+	header, body, ok := strings.Cut(string(msg), "\r\n\r\n")
+	if !ok {
+		return "no header/body separator"
+	}
+	var fields []string
+	for _, line := range strings.SplitAfter(header+"\r\n", "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSuffix(fields[i], "\r\n")
+	}
+	named := func(name string) string {
+		for _, field := range fields {
+			if strings.EqualFold(strings.TrimSpace(strings.SplitN(field, ":", 2)[0]), name) {
+				return field
+			}
+		}
+		return ""
+	}
+	seal, ams, aar := named("ARC-Seal"), named("ARC-Message-Signature"), named("ARC-Authentication-Results")
+	if seal == "" || ams == "" || aar == "" {
+		return "incomplete ARC set"
+	}
+	for _, field := range []string{seal, ams, aar} {
+		if verifyTags(field)["i"] != "1" {
+			return "instance is not i=1: " + field
+		}
+	}
+	sealTags, amsTags := verifyTags(seal), verifyTags(ams)
+	if sealTags["cv"] != "none" {
+		return "first ARC-Seal must carry cv=none"
+	}
+	if amsTags["c"] != "relaxed/relaxed" {
+		return "unexpected canonicalization " + amsTags["c"]
+	}
+
+	bodyHash := sha256.Sum256([]byte(verifyRelaxedBody(body)))
+	if amsTags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		return "body hash mismatch"
+	}
+
+	// Header fields are taken bottom-up, one instance per h= entry.
+	var input strings.Builder
+	used := make(map[int]bool)
+	for _, name := range strings.Split(amsTags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(strings.TrimSpace(strings.SplitN(fields[i], ":", 2)[0]), name) {
+				continue
+			}
+			used[i] = true
+			input.WriteString(verifyRelaxedHeader(fields[i]) + "\r\n")
+			break
+		}
+	}
+	input.WriteString(verifyRelaxedHeader(emptyB.ReplaceAllString(ams, "$1$2")))
+	if !verifySignature(t, public, input.String(), amsTags["b"]) {
+		return "ARC-Message-Signature does not verify"
+	}
+
+	input.Reset()
+	input.WriteString(verifyRelaxedHeader(aar) + "\r\n")
+	input.WriteString(verifyRelaxedHeader(ams) + "\r\n")
+	input.WriteString(verifyRelaxedHeader(emptyB.ReplaceAllString(seal, "$1$2")))
+	if !verifySignature(t, public, input.String(), sealTags["b"]) {
+		return "ARC-Seal does not verify"
+	}
+	return ""
+}
+
+func testARCKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"rsa-sha256": rsaKey, "ed25519-sha256": edKey}
+}
+
+func TestARCSealVerifies(t *testing.T) {
+	for algorithm, key := range testARCKeys(t) {
+		t.Run(algorithm, func(t *testing.T) {
+			signer := &arcSigner{domain: "example.com", selector: "arc", authservID: "mx.example.com", algorithm: algorithm, key: key}
+			sealed, err := signer.Seal([]byte(arcTestMessage), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if problem := verifyARC(t, key.Public(), sealed); problem != "" {
+				t.Fatalf("%s\n%s", problem, sealed)
+			}
+			if !strings.HasPrefix(string(sealed), "ARC-Seal:") {
+				t.Error("ARC-Seal is not the topmost header")
+			}
+		})
+	}
+}
+
+func TestARCSealDetectsTampering(t *testing.T) {
+	key := testARCKeys(t)["ed25519-sha256"]
+	signer := &arcSigner{domain: "example.com", selector: "arc", authservID: "mx.example.com", algorithm: "ed25519-sha256", key: key}
+	sealed, err := signer.Seal([]byte(arcTestMessage), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := map[string]string{
+		"body hash mismatch":                    strings.Replace(string(sealed), "Hello  world", "Hello world!", 1),
+		"ARC-Message-Signature does not verify": strings.Replace(string(sealed), "Subject:   Hello", "Subject: Goodbye", 1),
+	}
+	for want, msg := range tampered {
+		if got := verifyARC(t, key.Public(), []byte(msg)); got != want {
+			t.Errorf("tampered message: got %q, want %q", got, want)
+		}
+	}
+	// Whitespace changes are absorbed by relaxed canonicalization.
+	reflowed := strings.Replace(string(sealed), "Hello  world \t", "Hello world", 1)
+	if got := verifyARC(t, key.Public(), []byte(reflowed)); got != "" {
+		t.Errorf("whitespace-only change broke the seal: %s", got)
+	}
+}
+
+func TestLoadARCSigner(t *testing.T) {
+	keys := testARCKeys(t)
+	rsaDER := x509.MarshalPKCS1PrivateKey(keys["rsa-sha256"].(*rsa.PrivateKey))
+	edDER, err := x509.MarshalPKCS8PrivateKey(keys["ed25519-sha256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"rsa-sha256":     {Type: "RSA PRIVATE KEY", Bytes: rsaDER},
+		"ed25519-sha256": {Type: "PRIVATE KEY", Bytes: edDER},
+	}
+	for algorithm, block := range files {
+		path := filepath.Join(t.TempDir(), "arc.pem")
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := loadARCSigner("example.com", "arc", path, "mx.example.com")
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if signer.algorithm != algorithm {
+			t.Errorf("loaded %s key as %s", algorithm, signer.algorithm)
+		}
+		sealed, err := signer.Seal([]byte(arcTestMessage), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problem := verifyARC(t, keys[algorithm].Public(), sealed); problem != "" {
+			t.Errorf("%s: %s", algorithm, problem)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "bad.pem")
+	os.WriteFile(path, []byte("not a key"), 0600)
+	if _, err := loadARCSigner("example.com", "arc", path, "mx.example.com"); err == nil {
+		t.Error("loaded a key file without a PEM block")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// submissionLog, when set, records every submission /send accepts in a
+// database for auditing.
+var submissionLog *auditLog
+
+// auditSchemas creates the submissions table for each supported driver.
+var auditSchemas = map[string]string{
+	"postgres": `CREATE TABLE IF NOT EXISTS submissions (
+	id BIGSERIAL PRIMARY KEY,
+	message_id TEXT NOT NULL,
+	status TEXT NOT NULL,
+	from_address TEXT NOT NULL,
+	name TEXT NOT NULL,
+	recipient TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	body TEXT NOT NULL,
+	client_ip TEXT NOT NULL,
+	submitted_at TIMESTAMPTZ NOT NULL
+)`,
+	"mysql": `CREATE TABLE IF NOT EXISTS submissions (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	message_id VARCHAR(255) NOT NULL,
+	status VARCHAR(32) NOT NULL,
+	from_address VARCHAR(320) NOT NULL,
+	name TEXT NOT NULL,
+	recipient VARCHAR(320) NOT NULL,
+	subject TEXT NOT NULL,
+	body MEDIUMTEXT NOT NULL,
+	client_ip VARCHAR(64) NOT NULL,
+	submitted_at DATETIME(3) NOT NULL
+)`,
+}
+
+var auditInserts = map[string]string{
+	"postgres": `INSERT INTO submissions (message_id, status, from_address, name, recipient, subject, body, client_ip, submitted_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+	"mysql": `INSERT INTO submissions (message_id, status, from_address, name, recipient, subject, body, client_ip, submitted_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+}
+
+type submissionRecord struct {
+	MessageID   string
+	Status      string
+	From        string
+	Name        string
+	To          string
+	Subject     string
+	Body        string
+	ClientIP    string
+	SubmittedAt time.Time
+}
+
+// auditLog writes records from a bounded buffer in the background, so a
+// slow database never holds up a submission. Records arriving while the
+// buffer is full are dropped.
+type auditLog struct {
+	db      *sql.DB
+	insert  string
+	records chan submissionRecord
+}
+
+// newAuditLog connects to the database and creates the submissions table
+// if it does not exist yet.
+func newAuditLog(driver string, dsn string, buffer int) (*auditLog, error) {
+	schema, ok := auditSchemas[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported driver %q", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	l := &auditLog{db: db, insert: auditInserts[driver], records: make(chan submissionRecord, buffer)}
+	go l.run()
+	return l, nil
+}
+
+// Record queues a record of message with status, e.g. "accepted".
+func (l *auditLog) Record(r *http.Request, message *Email, status string) {
+	record := submissionRecord{
+		MessageID:   message.MessageID,
+		Status:      status,
+		From:        message.From,
+		Name:        message.Name,
+		To:          message.recipient(),
+		Subject:     message.Subject,
+		Body:        message.Body,
+		ClientIP:    clientIP(r),
+		SubmittedAt: time.Now().UTC(),
+	}
+	select {
+	case l.records <- record:
+	default:
+		log.Printf("Audit buffer full, not recording submission from %s\n", message.From)
+	}
+}
+
+func (l *auditLog) run() {
+	for record := range l.records {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := l.db.ExecContext(ctx, l.insert, record.MessageID, record.Status, record.From, record.Name,
+			record.To, record.Subject, record.Body, record.ClientIP, record.SubmittedAt)
+		cancel()
+		if err != nil {
+			log.Printf("Unable to record submission from %s: %s\n", record.From, err.Error())
+		}
+	}
+}
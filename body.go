@@ -0,0 +1,74 @@
+package main
+
+import (
+	"html"
+	"strings"
+)
+
+// bodyHeader and bodyFooter are wrapped around every outbound body, joined
+// to it by bodySeparator.
+var bodyHeader string
+var bodyFooter string
+var bodySeparator string
+
+// htmlBodyHeader and htmlBodyFooter are their counterparts for the HTML
+// part. When unset, the text ones are used, escaped.
+var htmlBodyHeader string
+var htmlBodyFooter string
+
+// decorateBody applies the configured header and footer to body. It runs
+// last in ConstructMessage so it wraps the final rendered text.
+func decorateBody(body string) string {
+	if bodyHeader != "" {
+		body = bodyHeader + bodySeparator + body
+	}
+	if bodyFooter != "" {
+		body = body + bodySeparator + bodyFooter
+	}
+	return body
+}
+
+// decorateHTML applies the HTML header and footer to body, inside its
+// <body> element when it has one.
+func decorateHTML(body string) string {
+	header, footer := htmlBodyHeader, htmlBodyFooter
+	if header == "" && bodyHeader != "" {
+		header = escapedBlock(bodyHeader)
+	}
+	if footer == "" && bodyFooter != "" {
+		footer = escapedBlock(bodyFooter)
+	}
+	lower := strings.ToLower(body)
+	if header != "" {
+		at := 0
+		if open := strings.Index(lower, "<body"); open >= 0 {
+			if end := strings.IndexByte(lower[open:], '>'); end >= 0 {
+				at = open + end + 1
+			}
+		}
+		body = body[:at] + header + body[at:]
+		lower = strings.ToLower(body)
+	}
+	if footer != "" {
+		at := strings.LastIndex(lower, "</body>")
+		if at < 0 {
+			at = len(body)
+		}
+		body = body[:at] + footer + body[at:]
+	}
+	return body
+}
+
+// escapedBlock renders plain text as an HTML block that keeps its line
+// breaks.
+func escapedBlock(text string) string {
+	return `<div style="white-space: pre-wrap">` + html.EscapeString(text) + "</div>"
+}
+
+// normalizeNewlines turns CRLF and bare CR line endings into LF. Parts are
+// normalized before encoding so the quoted-printable writer sees one kind
+// of line break, which it emits as CRLF, instead of encoding stray CRs as
+// =0D.
+func normalizeNewlines(text string) string {
+	return strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(text)
+}
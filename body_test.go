@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestNormalizeNewlines(t *testing.T) {
+	tests := map[string]string{
+		"one\r\ntwo\r\n":   "one\ntwo\n",
+		"one\rtwo\r":       "one\ntwo\n",
+		"one\ntwo":         "one\ntwo",
+		"mixed\r\n\r\rend": "mixed\n\n\nend",
+		"":                 "",
+	}
+	for input, want := range tests {
+		if got := normalizeNewlines(input); got != want {
+			t.Errorf("normalizeNewlines(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestDecorateHTML(t *testing.T) {
+	defer func() { bodyHeader, bodyFooter, htmlBodyHeader, htmlBodyFooter = "", "", "", "" }()
+	bodyHeader, bodyFooter = "Sent via <Contact> form", "Reply & win\nsoon"
+
+	got := decorateHTML("<html><BODY class=\"x\"><p>hi</p></body></html>")
+	want := `<html><BODY class="x"><div style="white-space: pre-wrap">Sent via &lt;Contact&gt; form</div><p>hi</p>` +
+		`<div style="white-space: pre-wrap">Reply &amp; win` + "\n" + `soon</div></body></html>`
+	if got != want {
+		t.Errorf("escaped text header and footer:\n got %q\nwant %q", got, want)
+	}
+
+	htmlBodyHeader, htmlBodyFooter = "<h1>Contact</h1>", "<hr>"
+	if got := decorateHTML("<p>hi</p>"); got != "<h1>Contact</h1><p>hi</p><hr>" {
+		t.Errorf("html header and footer on a fragment = %q", got)
+	}
+}
+
+func TestPartsDecorateTextAndHTML(t *testing.T) {
+	defer func() {
+		bodyHeader, bodyFooter, bodySeparator, htmlBodyHeader, htmlBodyFooter = "", "", "", "", ""
+	}()
+	bodyHeader, bodyFooter, bodySeparator = "HEAD", "FOOT", "\n--\n"
+	htmlBodyFooter = "<p>FOOT</p>"
+
+	text, html := (&Email{Body: "hello\r\nthere", HTML: "<p>hello</p>"}).parts()
+	if want := "HEAD\n--\nhello\nthere\n--\nFOOT"; text != want {
+		t.Errorf("text part = %q, want %q", text, want)
+	}
+	if want := `<div style="white-space: pre-wrap">HEAD</div><p>hello</p><p>FOOT</p>`; html != want {
+		t.Errorf("html part = %q, want %q", html, want)
+	}
+	if _, html := (&Email{Body: "hello"}).parts(); html != "" {
+		t.Errorf("a message without HTML got an html part %q", html)
+	}
+}
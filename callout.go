@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// verifySender checks that a submitter's From address accepts mail, by
+// connecting to its domain's first MX and issuing RCPT TO for it from the
+// null sender, before the submission is accepted.
+//
+// Callouts are a blunt tool. Many servers accept every RCPT TO and reject
+// later, so a pass proves little; some treat callouts as abuse and may
+// start rejecting the mailer's connections; outbound port 25 is blocked on
+// many networks. Only a definite 5xx to RCPT TO, or a domain that does not
+// exist, rejects a submission. Anything else, such as greylisting, a
+// timeout or a refused null sender, lets it through.
+var verifySender bool
+var verifySenderTimeout = 5 * time.Second
+
+// senderCallouts caches callout results by address so repeat submitters do
+// not trigger repeat connections.
+var senderCallouts = newExpiringMap[calloutResult](10000)
+
+const (
+	calloutTTL           = time.Hour
+	calloutRetryInterval = 5 * time.Minute
+)
+
+type calloutResult struct {
+	rejected bool
+	reason   string
+}
+
+// senderRejected reports whether a callout shows address does not accept
+// mail, with the reason. Inconclusive callouts are cached for a shorter
+// time than definite ones.
+func senderRejected(ctx context.Context, address string) (bool, string) {
+	address = strings.ToLower(address)
+	if result, ok := senderCallouts.Get(address, time.Now()); ok {
+		return result.rejected, result.reason
+	}
+	ctx, cancel := context.WithTimeout(ctx, verifySenderTimeout)
+	defer cancel()
+	rejected, reason, err := callout(ctx, address)
+	ttl := calloutTTL
+	if err != nil {
+		log.Printf("Sender callout for %s was inconclusive: %s\n", address, err.Error())
+		ttl = calloutRetryInterval
+	}
+	senderCallouts.Set(address, calloutResult{rejected: rejected, reason: reason}, ttl, time.Now())
+	return rejected, reason
+}
+
+// callout runs the SMTP conversation. err is set when the result is
+// inconclusive.
+func callout(ctx context.Context, address string) (bool, string, error) {
+	domain := addressDomain(address)
+	host, err := calloutHost(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return true, fmt.Sprintf("domain %s does not exist", domain), nil
+	} else if err != nil {
+		return false, "", err
+	}
+
+	conn, err := dialSMTP(ctx, net.JoinHostPort(host, "25"))
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return false, "", err
+	}
+	defer c.Close()
+	if err := c.Mail(""); err != nil {
+		return false, "", err
+	}
+	err = c.Rcpt(address)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code >= 500 {
+		return true, fmt.Sprintf("%s refused %s: %d %s", host, address, protoErr.Code, protoErr.Msg), nil
+	} else if err != nil {
+		return false, "", err
+	}
+	c.Reset()
+	c.Quit()
+	return false, "", nil
+}
+
+// calloutHost picks the most preferred MX of domain, or the domain itself
+// when it has no MX records but does have an address.
+func calloutHost(ctx context.Context, domain string) (string, error) {
+	mxServers, err := net.DefaultResolver.LookupMX(ctx, domain)
+	if err == nil && len(mxServers) > 0 {
+		return strings.TrimRight(mxServers[0].Host, "."), nil
+	}
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return "", err
+	}
+	if _, err := net.DefaultResolver.LookupHost(ctx, domain); err != nil {
+		return "", err
+	}
+	return domain, nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSenderRejectedUsesCachedResult(t *testing.T) {
+	defer senderCallouts.Delete("visitor@example.org")
+	senderCallouts.Set("visitor@example.org", calloutResult{rejected: true, reason: "550 no such user"}, time.Minute, time.Now())
+
+	// The cached result is returned without a callout, which would fail
+	// to resolve example.org in a sandbox and be inconclusive.
+	rejected, reason := senderRejected(context.Background(), "Visitor@Example.org")
+	if !rejected || reason != "550 no such user" {
+		t.Errorf("senderRejected = %v, %q; want the cached rejection", rejected, reason)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPHeader names the header a trusted reverse proxy uses to pass the
+// submitter's address, e.g. CF-Connecting-IP or X-Real-IP. When empty, the
+// connection's RemoteAddr is used, since any header is spoofable unless a
+// proxy in front of the mailer overwrites it.
+var clientIPHeader string
+
+// trustedProxyHops is the number of proxies in front of the mailer that
+// append to X-Forwarded-For. The client is the entry that many places from
+// the right; anything further left was supplied by the client itself.
+var trustedProxyHops int
+
+// clientIP returns the submitter's IP address according to the configured
+// extraction strategy, falling back to RemoteAddr when the header is absent
+// or malformed.
+func clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if clientIPHeader == "" {
+		return remote
+	}
+
+	var candidate string
+	if http.CanonicalHeaderKey(clientIPHeader) == "X-Forwarded-For" {
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if i := len(hops) - trustedProxyHops; i >= 0 && i < len(hops) {
+			candidate = hops[i]
+		}
+	} else {
+		candidate = r.Header.Get(clientIPHeader)
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(candidate)); ip != nil {
+		return ip.String()
+	}
+	return remote
+}
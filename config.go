@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is where main reads its MAILER_* settings from. A setting is
+// taken from, in order of precedence, a flag, the environment, and the
+// file named by -config or MAILER_CONFIG. Settings found in none of them
+// fall back to the defaults in Config.
+var config = &configSources{flags: settingFlags{}}
+
+type configSources struct {
+	flags settingFlags
+	file  map[string]string
+	// read records every setting main asked for, so settings given in a
+	// flag or file that nothing reads can be reported as mistakes.
+	read map[string]bool
+}
+
+// Lookup returns a setting and whether any source provides it.
+func (c *configSources) Lookup(name string) (string, bool) {
+	if c.read == nil {
+		c.read = make(map[string]bool)
+	}
+	c.read[name] = true
+	if value, ok := c.flags[name]; ok {
+		return value, true
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	value, ok := c.file[name]
+	return value, ok
+}
+
+// Get returns a setting, or an empty string when it is unset.
+func (c *configSources) Get(name string) string {
+	value, _ := c.Lookup(name)
+	return value
+}
+
+// unknown lists the settings given in a flag or the file that were never
+// read, which are most likely misspelt.
+func (c *configSources) unknown() []string {
+	var names []string
+	for _, source := range []map[string]string{c.flags, c.file} {
+		for name := range source {
+			if !c.read[name] {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// settingSource is what loadConfig reads settings from.
+type settingSource interface {
+	Lookup(name string) (string, bool)
+}
+
+// loadConfig builds a Config from source and validates it. Every setting
+// is looked up, so none given in a flag or the file goes unnoticed, and an
+// empty value counts as unset except for the two pointer fields, where it
+// is meaningful.
+func loadConfig(source settingSource) (*Config, error) {
+	c := &Config{}
+	fields := reflect.ValueOf(c).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Type().Field(i)
+		name := field.Tag.Get("setting")
+		if name == "" {
+			continue
+		}
+		value, ok := source.Lookup(name)
+		if field.Type.Kind() == reflect.Pointer {
+			if ok {
+				fields.Field(i).Set(reflect.ValueOf(&value))
+			}
+			continue
+		}
+		if value == "" {
+			if value = field.Tag.Get("default"); value == "" {
+				continue
+			}
+		}
+		if err := setSetting(fields.Field(i), value); err != nil {
+			return nil, fmt.Errorf("%s must be %s", name, err.Error())
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setSetting parses value into field according to its type. Lists are
+// comma-separated. The error describes the expected form.
+func setSetting(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("a duration, e.g. 30s")
+		}
+		field.SetInt(int64(duration))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("true or false")
+		}
+		field.SetBool(enabled)
+	case field.Kind() == reflect.Int || field.Kind() == reflect.Int64:
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || field.OverflowInt(number) {
+			return errors.New("an integer")
+		}
+		field.SetInt(number)
+	case field.Kind() == reflect.Float64:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("a number")
+		}
+		field.SetFloat(number)
+	case field.Kind() == reflect.Slice:
+		list := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			element := reflect.New(field.Type().Elem()).Elem()
+			if err := setSetting(element, item); err != nil {
+				return fmt.Errorf("a comma-separated list, each %s", err.Error())
+			}
+			list = reflect.Append(list, element)
+		}
+		field.Set(list)
+	default:
+		panic("unsupported setting type " + field.Type().String())
+	}
+	return nil
+}
+
+// registerSettingFlags adds a flag for every setting in Config, named
+// after it in lower case without the MAILER_ prefix, so that
+// MAILER_SEND_DEADLINE can be given as -send-deadline. Values are
+// collected in into, to be parsed with the other sources.
+func registerSettingFlags(flags *flag.FlagSet, into settingFlags) {
+	fields := reflect.TypeOf(Config{})
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Field(i).Tag.Get("setting")
+		if name == "" {
+			continue
+		}
+		flagName := strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(name, "MAILER_")), "_", "-")
+		value := &settingFlag{name: name, into: into, isBool: fields.Field(i).Type.Kind() == reflect.Bool}
+		flags.Var(value, flagName, "sets "+name)
+	}
+}
+
+// settingFlag is the flag for one setting.
+type settingFlag struct {
+	name   string
+	into   settingFlags
+	isBool bool
+}
+
+func (f *settingFlag) String() string { return "" }
+
+func (f *settingFlag) Set(value string) error {
+	f.into[f.name] = value
+	return nil
+}
+
+// IsBoolFlag lets a boolean setting be given as a bare -flag.
+func (f *settingFlag) IsBoolFlag() bool { return f.isBool }
+
+// settingFlags collects repeated -set NAME=VALUE flags.
+type settingFlags map[string]string
+
+func (f settingFlags) String() string { return "" }
+
+func (f settingFlags) Set(value string) error {
+	name, setting, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("%q must look like NAME=VALUE", value)
+	}
+	f[name] = setting
+	return nil
+}
+
+// loadConfigFile reads NAME=VALUE lines in the style of an env file. Blank
+// lines and lines starting with # are skipped, and a value may be quoted.
+func loadConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected NAME=VALUE", path, number)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, number, err)
+			}
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		settings[name] = value
+	}
+	return settings, scanner.Err()
+}
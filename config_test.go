@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSettings returns the settings loadConfig requires plus extra.
+func testSettings(extra map[string]string) *configSources {
+	file := map[string]string{
+		"MAILER_INBOX":              "inbox@example.com",
+		"MAILER_SENDER":             "mailer@example.com",
+		"MAILER_WHITELISTED_DOMAIN": "example.com",
+	}
+	for name, value := range extra {
+		file[name] = value
+	}
+	return &configSources{flags: settingFlags{}, file: file}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := loadConfig(testSettings(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != "8080" || c.SendDeadline != 5*time.Minute || c.MaxCc != 5 || !c.CORSVary {
+		t.Errorf("defaults not applied: port %q, deadline %s, max cc %d, vary %v", c.Port, c.SendDeadline, c.MaxCc, c.CORSVary)
+	}
+	if c.QueueBackend != "memory" || c.QueueVisibility != 10*time.Minute {
+		t.Errorf("queue = %s with visibility %s, want memory and twice the send deadline", c.QueueBackend, c.QueueVisibility)
+	}
+	if want := []string{"application/pdf", "image/png", "image/jpeg", "image/gif", "text/plain"}; !reflect.DeepEqual(c.AttachmentTypes, want) {
+		t.Errorf("attachment types = %v, want %v", c.AttachmentTypes, want)
+	}
+	if c.tlsMinVersion != tls.VersionTLS12 {
+		t.Errorf("TLS minimum version = %x, want TLS 1.2", c.tlsMinVersion)
+	}
+	if c.UserAgent != nil || c.BodySeparator != nil {
+		t.Error("unset pointer settings were filled in")
+	}
+}
+
+func TestLoadConfigParsesTypes(t *testing.T) {
+	c, err := loadConfig(testSettings(map[string]string{
+		"MAILER_SEND_DEADLINE":        "90s",
+		"MAILER_MAX_BODY_BYTES":       "2048",
+		"MAILER_LINK_RATIO_THRESHOLD": "0.5",
+		"MAILER_ALLOW_CC":             "true",
+		"MAILER_LISTEN":               "127.0.0.1:8080, [::1]:8080,",
+		"MAILER_RETRY_SCHEDULE":       "1m,5m",
+		"MAILER_BODY_SEPARATOR":       "",
+		"MAILER_INBOX":                "inbox@bücher.example",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SendDeadline != 90*time.Second || c.MaxBodyBytes != 2048 || c.LinkRatioThreshold != 0.5 || !c.AllowCc {
+		t.Errorf("parsed %s, %d, %v, %v", c.SendDeadline, c.MaxBodyBytes, c.LinkRatioThreshold, c.AllowCc)
+	}
+	if want := []string{"127.0.0.1:8080", "[::1]:8080"}; !reflect.DeepEqual(c.Listen, want) {
+		t.Errorf("listen = %v, want %v", c.Listen, want)
+	}
+	if want := []time.Duration{time.Minute, 5 * time.Minute}; !reflect.DeepEqual(c.RetrySchedule, want) {
+		t.Errorf("retry schedule = %v, want %v", c.RetrySchedule, want)
+	}
+	if c.BodySeparator == nil || *c.BodySeparator != "" {
+		t.Error("an empty MAILER_BODY_SEPARATOR was not kept as set")
+	}
+	if c.Inbox != "inbox@xn--bcher-kva.example" {
+		t.Errorf("inbox = %q, want the domain in ASCII", c.Inbox)
+	}
+}
+
+func TestLoadConfigLayering(t *testing.T) {
+	sources := testSettings(map[string]string{"MAILER_MAX_CC": "1", "MAILER_SUBJECT_PREFIX": "[file]"})
+	t.Setenv("MAILER_MAX_CC", "2")
+	t.Setenv("MAILER_SUBJECT_PREFIX", "[env]")
+	sources.flags["MAILER_MAX_CC"] = "3"
+
+	c, err := loadConfig(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxCc != 3 || c.SubjectPrefix != "[env]" {
+		t.Errorf("max cc %d, prefix %q; want the flag over the environment over the file", c.MaxCc, c.SubjectPrefix)
+	}
+	sources.file["MAILER_TYPO"] = "x"
+	if unknown := sources.unknown(); !reflect.DeepEqual(unknown, []string{"MAILER_TYPO"}) {
+		t.Errorf("unknown = %v, want the unread setting", unknown)
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	tests := []struct {
+		settings map[string]string
+		want     string
+	}{
+		{map[string]string{"MAILER_INBOX": ""}, "must be set"},
+		{map[string]string{"MAILER_SEND_DEADLINE": "soon"}, "MAILER_SEND_DEADLINE must be a duration"},
+		{map[string]string{"MAILER_SEND_DEADLINE": "-1s"}, "MAILER_SEND_DEADLINE must be a positive duration"},
+		{map[string]string{"MAILER_ALLOW_CC": "yes please"}, "MAILER_ALLOW_CC must be true or false"},
+		{map[string]string{"MAILER_MAX_CC": "-1"}, "MAILER_MAX_CC must be a non-negative integer"},
+		{map[string]string{"MAILER_RETRY_SCHEDULE": "1m,later"}, "MAILER_RETRY_SCHEDULE must be a comma-separated list, each a duration"},
+		{map[string]string{"MAILER_RETRY_SCHEDULE": "1m", "MAILER_RETRY_REJECTED_AFTER": "5m"}, "cannot be combined"},
+		{map[string]string{"MAILER_PORT": "99999"}, "MAILER_PORT"},
+		{map[string]string{"MAILER_QUEUE_BACKEND": "disk"}, "requires MAILER_SPOOL_DIR"},
+		{map[string]string{"MAILER_QUEUE_VISIBILITY_TIMEOUT": "1m"}, "longer than MAILER_SEND_DEADLINE"},
+		{map[string]string{"MAILER_SUBJECT_MODE": "shout"}, "MAILER_SUBJECT_MODE"},
+		{map[string]string{"MAILER_FROM_TEMPLATE": "{{.Name}}"}, "must render a single address"},
+		{map[string]string{"MAILER_SMARTHOST": "smtp.example.com"}, "MAILER_SMARTHOST must be a host:port"},
+		{map[string]string{"MAILER_SMTP_USERNAME": "form"}, "requires MAILER_SMARTHOST"},
+		{map[string]string{"MAILER_TRANSPORT": "mailgun"}, "requires MAILER_MAILGUN_DOMAIN"},
+		{map[string]string{"MAILER_ALLOWED_CONTENT_TYPES": "text/xml"}, "MAILER_ALLOWED_CONTENT_TYPES may only list"},
+		{map[string]string{"MAILER_DIGEST_MAX": "5"}, "requires MAILER_DIGEST_INTERVAL"},
+		{map[string]string{"MAILER_SOURCE_IP": "mail.example.com"}, "MAILER_SOURCE_IP must be an IP address"},
+	}
+	for _, test := range tests {
+		_, err := loadConfig(testSettings(test.settings))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: err = %v, want one mentioning %q", test.settings, err, test.want)
+		}
+	}
+}
+
+func TestSettingFlags(t *testing.T) {
+	sources := testSettings(nil)
+	flags := flag.NewFlagSet("mailer", flag.ContinueOnError)
+	registerSettingFlags(flags, sources.flags)
+	if err := flags.Parse([]string{"-send-deadline", "90s", "-verify-sender", "-subject-prefix=[Site]"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SendDeadline != 90*time.Second || !c.VerifySender || c.SubjectPrefix != "[Site]" {
+		t.Errorf("flags gave deadline %s, verify %v, prefix %q", c.SendDeadline, c.VerifySender, c.SubjectPrefix)
+	}
+}
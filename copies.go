@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Client-set Cc and Reply-To are off unless enabled, since Cc lets a
+// submitter send mail to arbitrary third parties through the form.
+var allowCc bool
+var allowReplyTo bool
+var ccAllowedDomains domainSet
+var maxCc int
+
+// replyToAlias is a shared address, such as a team alias, added to every
+// message. It becomes the Reply-To, or with copyReplyToAlias is copied on
+// the message instead so the submitter stays in Reply-To.
+var replyToAlias string
+var copyReplyToAlias bool
+
+// validateCc enforces the Cc constraints, normalizing the addresses it
+// accepts. The error names the constraint that failed.
+func (m *Email) validateCc() error {
+	if len(m.Cc) > 0 {
+		if !allowCc {
+			return errors.New("cc is not allowed")
+		}
+		if maxCc > 0 && len(m.Cc) > maxCc {
+			return fmt.Errorf("cc may list at most %d addresses", maxCc)
+		}
+		for i, address := range m.Cc {
+			address = strings.TrimSpace(address)
+			parsed, err := mail.ParseAddress(address)
+			if err != nil || parsed.Address != address {
+				return fmt.Errorf("cc address %q must be a bare email address", address)
+			}
+			if ccAllowedDomains != nil && !ccAllowedDomains.Contains(addressDomain(address)) {
+				return fmt.Errorf("cc domain %q is not allowed", addressDomain(address))
+			}
+			normalized, needsUTF8, err := normalizeAddress(address)
+			if err != nil {
+				return err
+			}
+			if needsUTF8 && !smtpUTF8Enabled {
+				return fmt.Errorf("cc address %q has a non-ASCII local part", address)
+			}
+			m.Cc[i] = normalized
+		}
+	}
+	return nil
+}
+
+// validateReplyTo checks a client-set Reply-To and reduces it to a single
+// header-safe address.
+func (m *Email) validateReplyTo() error {
+	if m.ReplyTo != "" {
+		if !allowReplyTo {
+			return errors.New("reply-to is not allowed")
+		}
+		addresses, err := mail.ParseAddressList(m.ReplyTo)
+		if err != nil || len(addresses) != 1 {
+			return errors.New("reply-to must be a single email address")
+		}
+		m.ReplyTo = stripLineBreaks(addresses[0].String())
+	}
+	return nil
+}
+
+// envelopeRecipients lists every RCPT TO address for the message, grouped by
+// domain in first-seen order so each group can go to that domain's MX. An
+// address listed more than once, ignoring case, is only sent to once; the
+// headers still show it as the client gave it.
+func (m *Email) envelopeRecipients() ([]string, map[string][]string) {
+	var domains []string
+	groups := make(map[string][]string)
+	seen := make(map[string]bool)
+	addresses := append([]string{m.recipient()}, m.copies()...)
+	if len(m.RetryRecipients) > 0 {
+		addresses = m.RetryRecipients
+	}
+	for _, address := range addresses {
+		key := strings.ToLower(address)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		domain := addressDomain(address)
+		if _, ok := groups[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		groups[domain] = append(groups[domain], address)
+	}
+	return domains, groups
+}
+
+// copies lists the Cc addresses of the message: the client's own plus the
+// shared alias when it is copied.
+func (m *Email) copies() []string {
+	if replyToAlias == "" || !copyReplyToAlias {
+		return m.Cc
+	}
+	for _, address := range m.Cc {
+		if strings.EqualFold(address, replyToAlias) {
+			return m.Cc
+		}
+	}
+	return append(append([]string(nil), m.Cc...), replyToAlias)
+}
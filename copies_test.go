@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOverlappingRecipientsGetOneRcptEach(t *testing.T) {
+	setupSendHandler(t)
+	transport = smtpTransport{}
+	server := startFakeSMTP(t)
+	smarthostAddress = server.Addr()
+	defer func() { smarthostAddress = "" }()
+
+	message := &Email{
+		From: "visitor@example.org",
+		Body: "hello",
+		Cc:   []string{"INBOX@Example.com", "colleague@example.net", "Colleague@EXAMPLE.NET"},
+	}
+	if outcome := deliver(message); outcome != outcomeDelivered {
+		t.Fatalf("deliver = %v, want the message delivered", outcome)
+	}
+	var rcpts []string
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "RCPT TO:") {
+			rcpts = append(rcpts, command)
+		}
+	}
+	want := []string{"RCPT TO:<inbox@example.com>", "RCPT TO:<colleague@example.net>"}
+	if strings.Join(rcpts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("issued %q, want %q", rcpts, want)
+	}
+	if len(message.Cc) != 3 {
+		t.Errorf("Cc = %q, want the client's list left as it was", message.Cc)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// dedupCache holds recent submission fingerprints, up to capacity, used
+// to suppress accidental double-submits.
+type dedupCache struct {
+	window  time.Duration
+	entries *expiringMap[struct{}]
+}
+
+func newDedupCache(window time.Duration, capacity int) *dedupCache {
+	return &dedupCache{window: window, entries: newExpiringMap[struct{}](capacity)}
+}
+
+// Check reports whether key was recorded within the window. If not, it
+// holds key for the caller, so a concurrent double-submit is caught too;
+// the caller follows with Record once the submission is accepted, or
+// Forget if it is not. A repeat does not extend the window of the original
+// submission.
+func (c *dedupCache) Check(key string, now time.Time) bool {
+	_, seen := c.entries.LoadOrStore(key, struct{}{}, c.window, now)
+	return seen
+}
+
+// Record starts the window for a held key at now, when its submission was
+// accepted.
+func (c *dedupCache) Record(key string, now time.Time) {
+	c.entries.Update(key, c.window, now, func(held struct{}, ok bool) (struct{}, bool) {
+		return held, ok
+	})
+}
+
+// Forget releases a held key whose submission failed, so the client's
+// retry is not taken for a duplicate.
+func (c *dedupCache) Forget(key string) {
+	c.entries.Delete(key)
+}
+
+// fingerprint hashes the normalized sender, subject and body of a submission.
+func (m *Email) fingerprint() string {
+	hash := sha256.New()
+	hash.Write([]byte(strings.ToLower(strings.TrimSpace(m.From))))
+	hash.Write([]byte{0})
+	hash.Write([]byte(strings.TrimSpace(m.Subject)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(strings.Join(strings.Fields(m.Body), " ")))
+	return hex.EncodeToString(hash.Sum(nil))
+}
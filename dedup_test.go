@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDedupCacheCheckRecordForget(t *testing.T) {
+	cache := newDedupCache(time.Minute, 16)
+	now := time.Now()
+
+	if cache.Check("a", now) {
+		t.Fatal("first Check reported a duplicate")
+	}
+	if !cache.Check("a", now) {
+		t.Error("a held key was not reported as a duplicate")
+	}
+	cache.Forget("a")
+	if cache.Check("a", now) {
+		t.Error("a forgotten key was reported as a duplicate")
+	}
+	cache.Record("a", now.Add(30*time.Second))
+	if !cache.Check("a", now.Add(80*time.Second)) {
+		t.Error("the window did not start at Record")
+	}
+	if cache.Check("a", now.Add(2*time.Minute)) {
+		t.Error("the key outlived its window")
+	}
+}
+
+func TestDedupCacheConcurrentCheck(t *testing.T) {
+	cache := newDedupCache(time.Minute, 16)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	fresh := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !cache.Check("double-click", now) {
+				mu.Lock()
+				fresh++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if fresh != 1 {
+		t.Errorf("%d concurrent submissions got through, want 1", fresh)
+	}
+}
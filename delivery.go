@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// retryRejectedAfter, when set, reschedules a message once for just the
+// recipients that were refused with a temporary (4xx) reply.
+var retryRejectedAfter time.Duration
+
+// retrySchedule, when set, lists the delay before each successive retry.
+// A message still failing after the last one is given up on and kept
+// with the recent failures.
+var retrySchedule []time.Duration
+
+var errAllRejected = errors.New("all recipients rejected")
+
+// deliveryOutcome is how a delivery attempt ended for the message as a
+// whole.
+type deliveryOutcome int
+
+const (
+	outcomeDelivered deliveryOutcome = iota
+	// outcomeDeferred means some recipients were queued for a retry.
+	outcomeDeferred
+	outcomeFailed
+)
+
+// recipientStatus is the outcome of RCPT TO for one recipient. Code is
+// zero when the server never answered, e.g. because it was unreachable.
+type recipientStatus struct {
+	Address string
+	Code    int
+	Message string
+}
+
+// deliveryResult lists which recipients a message was accepted for.
+type deliveryResult struct {
+	Accepted []string
+	Rejected []recipientStatus
+	// acceptedBy maps each accepted recipient to the server that took it.
+	acceptedBy map[string]string
+}
+
+// acceptedVia records host as the server that accepted every recipient
+// not yet attributed to one.
+func (r *deliveryResult) acceptedVia(host string) {
+	if r.acceptedBy == nil {
+		r.acceptedBy = make(map[string]string)
+	}
+	for _, address := range r.Accepted {
+		if _, ok := r.acceptedBy[address]; !ok {
+			r.acceptedBy[address] = host
+		}
+	}
+}
+
+// retryDelay reports how long to wait before retrying a message that has
+// already been retried attempts times and just failed with err. While DNS
+// is unavailable a message is retried every dnsRetryAfter until
+// dnsRetryWindow has passed, whatever the other settings. Otherwise,
+// without a retrySchedule, a message is retried at most once, after
+// retryRejectedAfter.
+func retryDelay(attempts int, err error) (time.Duration, bool) {
+	if dnsUnavailable(err) {
+		if time.Duration(attempts)*dnsRetryAfter < dnsRetryWindow {
+			return dnsRetryAfter, true
+		}
+		return 0, false
+	}
+	if len(retrySchedule) > 0 {
+		if attempts < len(retrySchedule) {
+			return retrySchedule[attempts], true
+		}
+		return 0, false
+	}
+	if attempts > 0 {
+		return 0, false
+	}
+	if retryRejectedAfter > 0 {
+		return retryRejectedAfter, true
+	}
+	return 0, false
+}
+
+func (r *deliveryResult) reject(address string, err error) {
+	status := recipientStatus{Address: address, Message: err.Error()}
+	var protoErr *textproto.Error
+	var dnsErr *net.DNSError
+	var sizeErr *sizeLimitError
+	if errors.As(err, &protoErr) {
+		status.Code = protoErr.Code
+		status.Message = protoErr.Msg
+	} else if errors.As(err, &dnsErr) && !dnsUnavailable(err) {
+		// A domain that does not exist will not start existing on retry.
+		status.Code = 550
+	} else if errors.As(err, &sizeErr) {
+		// Nor will the message shrink.
+		status.Code = 552
+	}
+	r.Rejected = append(r.Rejected, status)
+}
+
+// rejectAccepted moves every accepted recipient to Rejected with err, for
+// a transaction that failed after RCPT TO.
+func (r *deliveryResult) rejectAccepted(err error) {
+	for _, address := range r.Accepted {
+		r.reject(address, err)
+	}
+	r.Accepted = nil
+}
+
+func (r *deliveryResult) merge(other *deliveryResult) {
+	r.Accepted = append(r.Accepted, other.Accepted...)
+	r.Rejected = append(r.Rejected, other.Rejected...)
+	for address, host := range other.acceptedBy {
+		if r.acceptedBy == nil {
+			r.acceptedBy = make(map[string]string)
+		}
+		r.acceptedBy[address] = host
+	}
+}
+
+// temporaryFailures lists the rejected recipients worth retrying: those
+// refused with a 4xx reply or never reached at all, which includes
+// domains that could not be resolved while DNS was unavailable.
+func (r *deliveryResult) temporaryFailures() []string {
+	var addresses []string
+	for _, status := range r.Rejected {
+		if status.Code == 0 || (status.Code >= 400 && status.Code < 500) {
+			addresses = append(addresses, status.Address)
+		}
+	}
+	return addresses
+}
+
+func (r *deliveryResult) String() string {
+	parts := make([]string, 0, len(r.Rejected))
+	for _, status := range r.Rejected {
+		if status.Code != 0 {
+			parts = append(parts, fmt.Sprintf("%s (%d %s)", status.Address, status.Code, status.Message))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s (%s)", status.Address, status.Message))
+		}
+	}
+	return fmt.Sprintf("accepted: [%s], rejected: [%s]", strings.Join(r.Accepted, ", "), strings.Join(parts, ", "))
+}
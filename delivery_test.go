@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryDelayKeepsRetryingWhileDNSIsDown(t *testing.T) {
+	retryRejectedAfter = time.Minute
+	defer func() { retryRejectedAfter = 0 }()
+
+	err := &dnsUnavailableError{domain: "example.com", err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}
+	for _, attempts := range []int{0, 1, 10, int(dnsRetryWindow/dnsRetryAfter) - 1} {
+		if delay, ok := retryDelay(attempts, err); !ok || delay != dnsRetryAfter {
+			t.Errorf("attempt %d: retryDelay = %s, %v, want %s", attempts, delay, ok, dnsRetryAfter)
+		}
+	}
+	if _, ok := retryDelay(int(dnsRetryWindow/dnsRetryAfter), err); ok {
+		t.Error("still retrying after the DNS retry window")
+	}
+
+	// Other failures get the single retryRejectedAfter retry.
+	other := errors.New("451 try later")
+	if delay, ok := retryDelay(0, other); !ok || delay != time.Minute {
+		t.Errorf("retryDelay = %s, %v, want 1m", delay, ok)
+	}
+	if _, ok := retryDelay(1, other); ok {
+		t.Error("retried a non-DNS failure twice")
+	}
+}
+
+func TestDNSUnavailable(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, true},
+		{&net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true, IsTemporary: true}, true},
+		{errors.New("connection refused"), false},
+	} {
+		if got := dnsUnavailable(test.err); got != test.want {
+			t.Errorf("dnsUnavailable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestDeliverSpoolsWhenResolverFails(t *testing.T) {
+	saved := net.DefaultResolver
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("network is unreachable")
+		},
+	}
+	defer func() { net.DefaultResolver = saved }()
+	setupSendHandler(t)
+	transport = smtpTransport{}
+
+	message := &Email{From: "visitor@example.org", Body: "hello", RetryRecipients: []string{"inbox@example.com"}}
+	if outcome := deliver(message); outcome != outcomeDeferred {
+		t.Fatalf("deliver = %v, want the message deferred", outcome)
+	}
+	if _, ok, _ := messageScheduler.backend.NextDue(); !ok {
+		t.Error("the message was not spooled")
+	}
+}
+
+// failoverTransport tries servers in order, the way an MX list is tried.
+type failoverTransport struct {
+	servers []string
+}
+
+func (f failoverTransport) Deliver(ctx context.Context, e *Email, msg []byte) (*deliveryResult, error) {
+	domains, groups := e.envelopeRecipients()
+	return e.sendVia(ctx, newDeliveryLog(), f.servers, nil, groups[domains[0]], msg)
+}
+
+func TestSendCarriesTheSameBytesToEveryMX(t *testing.T) {
+	setupSendHandler(t)
+	first, second := startFakeSMTP(t), startFakeSMTP(t)
+	first.setReply(".", "451 4.3.0 try again later")
+	transport = failoverTransport{servers: []string{first.Addr(), second.Addr()}}
+
+	message := &Email{From: "visitor@example.org", Subject: "Hello", Body: "hello"}
+	if _, err := message.Send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tried, delivered := first.Messages(), second.Messages()
+	if len(tried) != 1 || len(delivered) != 1 {
+		t.Fatalf("the servers received %d and %d messages, want one each", len(tried), len(delivered))
+	}
+	if string(tried[0]) != string(delivered[0]) {
+		t.Errorf("the second MX received a rebuilt message:\n%s\nwant\n%s", delivered[0], tried[0])
+	}
+}
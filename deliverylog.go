@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// logDeliveryAttempts logs each connection attempt as it is made, on top
+// of the single summary logged per message.
+var logDeliveryAttempts bool
+
+// deliveryLog gathers what happened while delivering one message: the MX
+// records found, each server tried and how it answered. It is logged as a
+// single line once delivery is over.
+type deliveryLog struct {
+	started time.Time
+	entries []string
+}
+
+func newDeliveryLog() *deliveryLog {
+	return &deliveryLog{started: time.Now()}
+}
+
+// mx records the MX records of domain in the order they will be tried.
+func (l *deliveryLog) mx(domain string, records []*net.MX) {
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		hosts = append(hosts, fmt.Sprintf("%s (%d)", strings.TrimRight(record.Host, "."), record.Pref))
+	}
+	l.entries = append(l.entries, fmt.Sprintf("mx %s: [%s]", domain, strings.Join(hosts, ", ")))
+}
+
+// attempt records the outcome of trying server, with the SMTP reply code
+// when the server gave one.
+func (l *deliveryLog) attempt(server string, err error) {
+	outcome := "accepted"
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		outcome = fmt.Sprintf("%d %s", protoErr.Code, protoErr.Msg)
+	} else if err != nil {
+		outcome = err.Error()
+	}
+	l.entries = append(l.entries, fmt.Sprintf("tried %s: %s", server, outcome))
+}
+
+func (l *deliveryLog) String() string {
+	return fmt.Sprintf("%s in %s", strings.Join(l.entries, "; "), time.Since(l.started).Round(time.Millisecond))
+}
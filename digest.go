@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digests, when set, collects submissions and sends them as one message
+// per destination every MAILER_DIGEST_INTERVAL, or sooner once a
+// destination has MAILER_DIGEST_MAX of them. Submissions with attachments
+// and those for high-priority routes are still sent on their own.
+var digests *digestBuffer
+
+// digestEntry is the part of a submission a digest shows.
+type digestEntry struct {
+	To         string    `json:"to"`
+	From       string    `json:"from"`
+	Name       string    `json:"name"`
+	Subject    string    `json:"subject"`
+	Body       string    `json:"body"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// digestBuffer holds the submissions waiting for the next digest. When path
+// is set each one is appended to it as a JSON line, so a restart does not
+// lose them. The file is cleared when the digests are handed to delivery,
+// from which point they are in flight like any other message.
+type digestBuffer struct {
+	mu       sync.Mutex
+	path     string
+	interval time.Duration
+	max      int
+	entries  []digestEntry
+	flush    chan struct{}
+
+	assignID func(*Email) error
+	deliver  func(*Email) deliveryOutcome
+}
+
+func newDigestBuffer(path string, interval time.Duration, max int) (*digestBuffer, error) {
+	b := &digestBuffer{
+		path:     path,
+		interval: interval,
+		max:      max,
+		flush:    make(chan struct{}, 1),
+		assignID: (*Email).assignMessageID,
+		deliver:  deliver,
+	}
+	if path == "" {
+		return b, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 4*int(maxBodyBytes))
+	for scanner.Scan() {
+		var entry digestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Skipping unreadable digest entry in %s: %s\n", path, err.Error())
+			continue
+		}
+		b.entries = append(b.entries, entry)
+	}
+	if len(b.entries) > 0 {
+		log.Printf("Restored %d digest submissions from %s\n", len(b.entries), path)
+	}
+	return b, scanner.Err()
+}
+
+// digestible reports whether the message can go into a digest.
+func (m *Email) digestible() bool {
+	return len(m.Attachments) == 0 && m.Priority != priorityHigh
+}
+
+// Add buffers the message for the next digest.
+func (b *digestBuffer) Add(m *Email) error {
+	entry := digestEntry{To: m.To, From: m.From, Name: m.Name, Subject: m.Subject, Body: m.Body, ReceivedAt: time.Now()}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path != "" {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(append(line, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	b.entries = append(b.entries, entry)
+	if b.max > 0 && b.countFor(entry.To) >= b.max {
+		select {
+		case b.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *digestBuffer) countFor(to string) int {
+	count := 0
+	for _, entry := range b.entries {
+		if entry.To == to {
+			count++
+		}
+	}
+	return count
+}
+
+func (b *digestBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// Run sends the digests every interval, or early when a destination fills
+// up.
+func (b *digestBuffer) Run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.flush:
+		}
+		b.send()
+	}
+}
+
+// send takes the buffered submissions and delivers one digest for each
+// destination, in the order destinations were first seen. A digest that
+// cannot be given a Message-ID keeps its submissions buffered for the next
+// round.
+func (b *digestBuffer) send() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) == 0 {
+		return
+	}
+	entries := b.entries
+	b.entries = nil
+
+	held := make(map[string]bool)
+	var messages []*Email
+	for _, message := range composeDigests(entries) {
+		if err := b.assignID(message); err != nil {
+			log.Printf("Holding the digest for %s: unable to assign a message id: %s\n", message.To, err.Error())
+			held[message.To] = true
+			continue
+		}
+		messages = append(messages, message)
+	}
+	for _, entry := range entries {
+		if held[entry.To] {
+			b.entries = append(b.entries, entry)
+		}
+	}
+
+	for _, message := range messages {
+		log.Printf("Sending digest of %s\n", message.Subject)
+		go b.deliver(message)
+	}
+	// The file keeps everything until the digests are handed off, so a
+	// crash before this point sends them again rather than losing them.
+	if b.path != "" {
+		if err := b.rewrite(); err != nil {
+			log.Printf("Unable to clear %s: %s\n", b.path, err.Error())
+		}
+	}
+}
+
+// rewrite replaces the file with the entries still buffered. The caller
+// holds mu.
+func (b *digestBuffer) rewrite() error {
+	var data []byte
+	for _, entry := range b.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	temp := b.path + ".tmp"
+	if err := os.WriteFile(temp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temp, b.path)
+}
+
+// composeDigests groups entries by destination into messages whose body
+// has a section per submission.
+func composeDigests(entries []digestEntry) []*Email {
+	var order []string
+	groups := make(map[string][]digestEntry)
+	for _, entry := range entries {
+		if _, ok := groups[entry.To]; !ok {
+			order = append(order, entry.To)
+		}
+		groups[entry.To] = append(groups[entry.To], entry)
+	}
+
+	var messages []*Email
+	for _, to := range order {
+		group := groups[to]
+		var body strings.Builder
+		for i, entry := range group {
+			if i > 0 {
+				body.WriteString("\n----------------------------------------\n\n")
+			}
+			sender := entry.From
+			if entry.Name != "" {
+				sender = fmt.Sprintf("%s <%s>", entry.Name, entry.From)
+			}
+			fmt.Fprintf(&body, "From: %s\nSubject: %s\nReceived: %s\n\n%s\n",
+				sender, entry.Subject, entry.ReceivedAt.UTC().Format(time.RFC1123Z), entry.Body)
+		}
+		noun := "submissions"
+		if len(group) == 1 {
+			noun = "submission"
+		}
+		base := defaultSubject
+		if selected, ok := routes[to]; ok && selected.Subject != "" {
+			base = selected.Subject
+		}
+		messages = append(messages, &Email{
+			From:    outboundSender,
+			Name:    "Form digest",
+			To:      to,
+			Subject: fmt.Sprintf("%s: digest of %d %s", base, len(group), noun),
+			Body:    body.String(),
+		})
+	}
+	return messages
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// digestRecorder collects the digests a buffer hands to delivery.
+type digestRecorder struct {
+	mu       sync.Mutex
+	messages []*Email
+}
+
+func (r *digestRecorder) deliver(message *Email) deliveryOutcome {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, message)
+	return outcomeDelivered
+}
+
+func (r *digestRecorder) delivered() []*Email {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Email(nil), r.messages...)
+}
+
+func newTestDigestBuffer(t *testing.T, path string) (*digestBuffer, *digestRecorder) {
+	t.Helper()
+	maxBodyBytes = 1 << 20
+	outboundSender = "mailer@example.com"
+	t.Cleanup(func() { maxBodyBytes, outboundSender = 0, "" })
+	buffer, err := newDigestBuffer(path, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &digestRecorder{}
+	buffer.deliver = recorder.deliver
+	return buffer, recorder
+}
+
+func TestDigestSendClearsFileAfterHandoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "digest.jsonl")
+	buffer, recorder := newTestDigestBuffer(t, path)
+	buffer.Add(&Email{To: "sales", From: "a@example.org", Body: "one"})
+	buffer.Add(&Email{To: "support", From: "b@example.org", Body: "two"})
+
+	buffer.send()
+	waitFor(t, func() bool { return len(recorder.delivered()) == 2 })
+	for _, message := range recorder.delivered() {
+		if message.MessageID == "" {
+			t.Errorf("digest for %s was sent without a Message-ID", message.To)
+		}
+	}
+	restored, _ := newTestDigestBuffer(t, path)
+	if n := restored.Len(); n != 0 {
+		t.Errorf("%d sent submissions were left in the file", n)
+	}
+}
+
+func TestDigestSendHoldsDigestWithoutMessageID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "digest.jsonl")
+	buffer, recorder := newTestDigestBuffer(t, path)
+	buffer.assignID = func(message *Email) error {
+		if message.To == "support" {
+			return errors.New("no entropy")
+		}
+		return message.assignMessageID()
+	}
+	buffer.Add(&Email{To: "sales", From: "a@example.org", Body: "one"})
+	buffer.Add(&Email{To: "support", From: "b@example.org", Body: "two"})
+	buffer.Add(&Email{To: "support", From: "c@example.org", Body: "three"})
+
+	buffer.send()
+	waitFor(t, func() bool { return len(recorder.delivered()) == 1 })
+	if to := recorder.delivered()[0].To; to != "sales" {
+		t.Errorf("delivered the digest for %s, want sales", to)
+	}
+	if n := buffer.Len(); n != 2 {
+		t.Errorf("%d submissions still buffered, want the 2 held for support", n)
+	}
+	restored, _ := newTestDigestBuffer(t, path)
+	if n := restored.Len(); n != 2 {
+		t.Errorf("file holds %d submissions, want the 2 held for support", n)
+	}
+
+	buffer.assignID = (*Email).assignMessageID
+	buffer.send()
+	waitFor(t, func() bool { return len(recorder.delivered()) == 2 })
+	if held := recorder.delivered()[1]; held.To != "support" || held.MessageID == "" {
+		t.Errorf("held digest was sent as %+v", held)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	_ "embed"
+	"strings"
+)
+
+//go:embed disposable_domains.txt
+var bundledDisposableDomains string
+
+// disposableDomains, when set, rejects submitters using throwaway address
+// providers.
+var disposableDomains domainSet
+
+// loadDisposableDomains reads the list at path, or the bundled list when
+// path is empty.
+func loadDisposableDomains(path string) (domainSet, error) {
+	domains := make(domainSet)
+	if path != "" {
+		return domains, domains.loadFile(path)
+	}
+	return domains, domains.load(strings.NewReader(bundledDisposableDomains))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendRejectsDisposableDomains(t *testing.T) {
+	fake := setupSendHandler(t)
+	domains, err := loadDisposableDomains("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disposableDomains = domains
+	defer func() { disposableDomains = nil }()
+
+	w := postSend("application/json", `{"from": "visitor@mailinator.com", "body": "hello"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("a bundled disposable domain answered %d, want 403", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "disposable email addresses are not allowed") {
+		t.Errorf("response %q does not name the problem", w.Body.String())
+	}
+	if w := postSend("application/json", `{"from": "visitor@example.org", "body": "hello"}`); w.Code != http.StatusAccepted {
+		t.Errorf("an ordinary domain answered %d, want 202", w.Code)
+	}
+	waitFor(t, func() bool { return fake.count() == 1 })
+}
+
+func TestLoadDisposableDomainsFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disposable.txt")
+	os.WriteFile(path, []byte("# local list\nthrowaway.example\n"), 0600)
+	domains, err := loadDisposableDomains(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !domains.Contains("inbox.throwaway.example") {
+		t.Error("a subdomain of a listed domain was not matched")
+	}
+	if domains.Contains("mailinator.com") {
+		t.Error("a custom list was merged with the bundled one")
+	}
+}
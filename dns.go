@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// fallbackSmarthost, when set, carries messages whose recipient domain
+// could not be resolved because DNS itself is unavailable. It shares
+// smarthostCredentials.
+var fallbackSmarthost string
+
+// dnsRetryAfter is how long a message waits in the queue when DNS is
+// unavailable and there is no fallbackSmarthost. It is retried at that
+// interval for up to dnsRetryWindow before being given up on.
+var dnsRetryAfter = 5 * time.Minute
+var dnsRetryWindow = 24 * time.Hour
+
+// dnsUnavailableError reports an MX lookup that failed for reasons other
+// than the domain not existing. Retrying later may succeed.
+type dnsUnavailableError struct {
+	domain string
+	err    error
+}
+
+func (e *dnsUnavailableError) Error() string {
+	return fmt.Sprintf("DNS unavailable resolving %s: %s", e.domain, e.err)
+}
+
+func (e *dnsUnavailableError) Unwrap() error { return e.err }
+
+// dnsUnavailable reports whether err is a lookup failure of the resolver,
+// such as a timeout or SERVFAIL, rather than an answer that the domain has
+// no records. Some resolvers report a failure as not found but temporary.
+func dnsUnavailable(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && (!dnsErr.IsNotFound || dnsErr.IsTemporary || dnsErr.IsTimeout)
+}
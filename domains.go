@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// domainSet is a set of domains that also matches their subdomains.
+type domainSet map[string]bool
+
+func (s domainSet) add(domain string) {
+	domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if domain != "" {
+		s[domain] = true
+	}
+}
+
+func (s domainSet) addList(list string) {
+	for _, domain := range strings.Split(list, ",") {
+		s.add(domain)
+	}
+}
+
+// loadFile adds one domain per line, ignoring blank lines and # comments.
+func (s domainSet) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.load(file)
+}
+
+func (s domainSet) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		s.add(line)
+	}
+	return scanner.Err()
+}
+
+// Contains reports whether domain or any of its parent domains is in the set.
+func (s domainSet) Contains(domain string) bool {
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	for domain != "" {
+		if s[domain] {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return false
+}
+
+// addressDomain returns the lowercased domain of an address, which may be in
+// either bare or "Name <addr>" form.
+func addressDomain(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		address = parsed.Address
+	}
+	tokens := strings.Split(address, "@")
+	return strings.ToLower(tokens[len(tokens)-1])
+}
+
+// sameAddress compares the addresses of two header values, ignoring display
+// names and case.
+func sameAddress(a string, b string) bool {
+	if parsed, err := mail.ParseAddress(a); err == nil {
+		a = parsed.Address
+	}
+	if parsed, err := mail.ParseAddress(b); err == nil {
+		b = parsed.Address
+	}
+	return strings.EqualFold(a, b)
+}
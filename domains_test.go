@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDomainSetMatchesSubdomains(t *testing.T) {
+	set := make(domainSet)
+	set.addList("spam.example, .Bad.Example.")
+	tests := map[string]bool{
+		"spam.example":        true,
+		"SPAM.example":        true,
+		"mail.spam.example":   true,
+		"a.b.spam.example":    true,
+		"notspam.example":     false,
+		"spam.example.org":    false,
+		"bad.example":         true,
+		"relay.bad.example":   true,
+		"example":             false,
+		"good.example":        false,
+		"spam.example.":       true,
+		"mail.spam.example..": true,
+	}
+	for domain, want := range tests {
+		if got := set.Contains(domain); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestSendRejectsBlockedFromDomains(t *testing.T) {
+	fake := setupSendHandler(t)
+	blockedFromDomains = make(domainSet)
+	blockedFromDomains.add("spam.example")
+	defer func() { blockedFromDomains = nil }()
+
+	for _, from := range []string{"visitor@spam.example", "visitor@mail.spam.example"} {
+		w := postSend("application/json", `{"from": "`+from+`", "body": "hello"}`)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s answered %d, want 403", from, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "sender domain is not allowed") {
+			t.Errorf("%s: response %q does not name the problem", from, w.Body.String())
+		}
+	}
+	if w := postSend("application/json", `{"from": "visitor@notspam.example", "body": "hello"}`); w.Code != http.StatusAccepted {
+		t.Errorf("a domain that only ends like a blocked one answered %d, want 202", w.Code)
+	}
+	waitFor(t, func() bool { return fake.count() == 1 })
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var debugDumpDir string
+var debugDumpMaxBytes int64
+
+var debugDumpMu sync.Mutex
+var debugDumpSequence uint64
+
+type dumpEnvelope struct {
+	MailFrom string    `json:"mail_from"`
+	RcptTo   []string  `json:"rcpt_to"`
+	Server   string    `json:"server"`
+	Time     time.Time `json:"time"`
+}
+
+// dumpMessage writes the exact bytes about to be sent to server as a .eml
+// file, with the envelope in a .json sidecar. Failures are logged rather
+// than interrupting delivery.
+func dumpMessage(server string, from string, to []string, msg []byte) {
+	now := time.Now().UTC()
+	sequence := atomic.AddUint64(&debugDumpSequence, 1)
+	base := filepath.Join(debugDumpDir, fmt.Sprintf("%s-%06d", now.Format("20060102T150405.000000000Z"), sequence))
+
+	envelope, err := json.MarshalIndent(dumpEnvelope{MailFrom: from, RcptTo: to, Server: server, Time: now}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(base+".json", envelope, 0600)
+	}
+	if err == nil {
+		err = os.WriteFile(base+".eml", msg, 0600)
+	}
+	if err != nil {
+		log.Printf("Unable to write debug dump: %s\n", err.Error())
+		return
+	}
+	pruneDebugDumps()
+}
+
+// pruneDebugDumps removes the oldest dumps until the directory is within
+// debugDumpMaxBytes. Names sort chronologically, and a .eml and its sidecar
+// share a name so they are removed together.
+func pruneDebugDumps() {
+	debugDumpMu.Lock()
+	defer debugDumpMu.Unlock()
+
+	entries, err := os.ReadDir(debugDumpDir)
+	if err != nil {
+		log.Printf("Unable to prune debug dumps: %s\n", err.Error())
+		return
+	}
+	var names []string
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".eml") && !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+		total += info.Size()
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if total <= debugDumpMaxBytes {
+			break
+		}
+		path := filepath.Join(debugDumpDir, name)
+		if info, err := os.Stat(path); err == nil && os.Remove(path) == nil {
+			total -= info.Size()
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxBodyBytes bounds the decoded size of a JSON request body.
+var maxBodyBytes int64
+
+// submissionContentTypes are the request media types /send understands.
+var submissionContentTypes = []string{"application/json", "multipart/form-data", "application/x-www-form-urlencoded"}
+
+// allowedContentTypes narrows submissionContentTypes to the ones this
+// deployment accepts. Parameters such as charset are not part of the match.
+var allowedContentTypes = submissionContentTypes
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+var errUnsupportedCharset = errors.New("unsupported charset")
+
+// gzipBody closes both the decompressor and the underlying request body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// decompressBody replaces r.Body with a decompressing reader when the client
+// sent Content-Encoding: gzip. Size limits are applied afterwards, so they
+// bound the decompressed size and defeat zip bombs.
+func decompressBody(r *http.Request) error {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = &gzipBody{Reader: reader, body: r.Body}
+		return nil
+	default:
+		return errUnsupportedEncoding
+	}
+}
+
+// transcodedBody reads the request body converted to UTF-8 and closes the
+// original.
+type transcodedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (b *transcodedBody) Close() error {
+	return b.body.Close()
+}
+
+// transcodeBody replaces r.Body with a reader converting from charset to
+// UTF-8, for legacy clients that post in another encoding. No charset
+// means UTF-8.
+func transcodeBody(r *http.Request, charset string) error {
+	if charset == "" {
+		return nil
+	}
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return errUnsupportedCharset
+	}
+	if name, _ := htmlindex.Name(encoding); name == "utf-8" {
+		return nil
+	}
+	r.Body = &transcodedBody{Reader: encoding.NewDecoder().Reader(r.Body), body: r.Body}
+	return nil
+}
+
+// isCompressionError reports whether err came from a malformed gzip stream.
+// A truncated stream surfaces as io.ErrUnexpectedEOF.
+func isCompressionError(r *http.Request, err error) bool {
+	if !strings.Contains(strings.ToLower(r.Header.Get("Content-Encoding")), "gzip") {
+		return false
+	}
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &corrupt)
+}
+
+// bodyErrorStatus maps an error from reading the request body to a status:
+// 400 when the body is empty or not JSON at all, 422 when it is JSON that
+// does not describe a valid submission or is followed by trailing data.
+func bodyErrorStatus(r *http.Request, err error) int {
+	var maxBytesErr *http.MaxBytesError
+	var malformedErr *malformedJSONError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case isCompressionError(r, err):
+		return http.StatusBadRequest
+	case errors.Is(err, errEmptyBody), errors.As(err, &malformedErr):
+		return http.StatusBadRequest
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const expiringShards = 16
+
+// expiringMap is a concurrency-safe map whose entries lapse after a time to
+// live, for caches shared by many request and delivery goroutines. Keys are
+// spread over shards that each have their own lock, so goroutines working
+// on different keys rarely wait on each other. Each shard holds at most
+// capacity/expiringShards entries; when one is full, expired entries are
+// purged and then the entry closest to expiry is evicted. An entry stored
+// with a ttl of zero or less never expires and is never evicted, so it
+// stays until it is deleted.
+type expiringMap[V any] struct {
+	shards        [expiringShards]expiringShard[V]
+	shardCapacity int
+}
+
+type expiringShard[V any] struct {
+	mu      sync.Mutex
+	entries map[string]expiringEntry[V]
+}
+
+type expiringEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func (e expiringEntry[V]) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func newExpiringEntry[V any](value V, ttl time.Duration, now time.Time) expiringEntry[V] {
+	entry := expiringEntry[V]{value: value}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+	return entry
+}
+
+func newExpiringMap[V any](capacity int) *expiringMap[V] {
+	m := &expiringMap[V]{shardCapacity: max(1, (capacity+expiringShards-1)/expiringShards)}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[string]expiringEntry[V])
+	}
+	return m
+}
+
+func (m *expiringMap[V]) shard(key string) *expiringShard[V] {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &m.shards[hash.Sum32()%expiringShards]
+}
+
+// Get returns the value for key unless it is missing or has expired.
+func (m *expiringMap[V]) Get(key string, now time.Time) (V, bool) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, ok := shard.entries[key]
+	if !ok || entry.expired(now) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Set stores value for key until ttl has passed.
+func (m *expiringMap[V]) Set(key string, value V, ttl time.Duration, now time.Time) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.store(key, newExpiringEntry(value, ttl, now), now, m.shardCapacity)
+}
+
+// LoadOrStore returns the value for key if it is there and has not
+// expired. Otherwise it stores value until ttl has passed. loaded reports
+// which happened.
+func (m *expiringMap[V]) LoadOrStore(key string, value V, ttl time.Duration, now time.Time) (actual V, loaded bool) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if entry, ok := shard.entries[key]; ok && !entry.expired(now) {
+		return entry.value, true
+	}
+	shard.store(key, newExpiringEntry(value, ttl, now), now, m.shardCapacity)
+	return value, false
+}
+
+// Update replaces the value for key with what update returns, holding the
+// shard's lock throughout. update is passed the current value and whether
+// there is one that has not expired. It returns the value to store until
+// ttl has passed, or keep false to delete the key.
+func (m *expiringMap[V]) Update(key string, ttl time.Duration, now time.Time, update func(value V, ok bool) (V, bool)) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, ok := shard.entries[key]
+	value, keep := update(entry.value, ok && !entry.expired(now))
+	if !keep {
+		delete(shard.entries, key)
+		return
+	}
+	shard.store(key, newExpiringEntry(value, ttl, now), now, m.shardCapacity)
+}
+
+// Range calls fn for every entry that has not expired, one shard at a time
+// with that shard's lock held, so fn must not use the map.
+func (m *expiringMap[V]) Range(now time.Time, fn func(key string, value V)) {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		for key, entry := range shard.entries {
+			if !entry.expired(now) {
+				fn(key, entry.value)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// store sets key, first making room if the shard is full. The caller holds
+// mu.
+func (s *expiringShard[V]) store(key string, entry expiringEntry[V], now time.Time, capacity int) {
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= capacity {
+		s.evict(now, capacity)
+	}
+	s.entries[key] = entry
+}
+
+// evict makes room for one entry. The caller holds mu.
+func (s *expiringShard[V]) evict(now time.Time, capacity int) {
+	var oldest string
+	var oldestExpires time.Time
+	found := false
+	for key, entry := range s.entries {
+		if entry.expires.IsZero() {
+			continue
+		}
+		if entry.expired(now) {
+			delete(s.entries, key)
+		} else if !found || entry.expires.Before(oldestExpires) {
+			oldest, oldestExpires, found = key, entry.expires, true
+		}
+	}
+	if found && len(s.entries) >= capacity {
+		delete(s.entries, oldest)
+	}
+}
+
+func (m *expiringMap[V]) Delete(key string) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	delete(shard.entries, key)
+}
+
+// Len counts the stored entries, including any that have expired but not
+// yet been purged.
+func (m *expiringMap[V]) Len() int {
+	total := 0
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+		total += len(m.shards[i].entries)
+		m.shards[i].mu.Unlock()
+	}
+	return total
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpiringMapExpires(t *testing.T) {
+	m := newExpiringMap[string](16)
+	now := time.Now()
+	m.Set("a", "first", time.Minute, now)
+	m.Set("pinned", "kept", 0, now)
+
+	if value, ok := m.Get("a", now.Add(30*time.Second)); !ok || value != "first" {
+		t.Errorf("Get = %q, %v; want the stored value", value, ok)
+	}
+	if _, ok := m.Get("a", now.Add(time.Minute)); ok {
+		t.Error("an expired value was returned")
+	}
+	if _, ok := m.Get("pinned", now.Add(24*time.Hour)); !ok {
+		t.Error("an entry stored without a ttl expired")
+	}
+	m.Delete("pinned")
+	if _, ok := m.Get("pinned", now); ok {
+		t.Error("a deleted entry was returned")
+	}
+}
+
+func TestExpiringMapEvictsClosestToExpiry(t *testing.T) {
+	// One entry per shard, so every key competes for its shard's slot.
+	m := newExpiringMap[int](expiringShards)
+	now := time.Now()
+	m.Set("pinned", 0, 0, now)
+	for i := 0; i < 200; i++ {
+		m.Set(fmt.Sprint(i), i, time.Duration(i+1)*time.Minute, now)
+	}
+	if n := m.Len(); n > expiringShards+1 {
+		t.Errorf("map holds %d entries, want at most %d", n, expiringShards+1)
+	}
+	if _, ok := m.Get("pinned", now); !ok {
+		t.Error("an entry without a ttl was evicted")
+	}
+	if _, ok := m.Get("199", now); !ok {
+		t.Error("the newest entry was evicted")
+	}
+}
+
+func TestExpiringMapLoadOrStore(t *testing.T) {
+	m := newExpiringMap[int](16)
+	now := time.Now()
+	if _, loaded := m.LoadOrStore("a", 1, time.Minute, now); loaded {
+		t.Error("loaded a missing key")
+	}
+	if value, loaded := m.LoadOrStore("a", 2, time.Minute, now); !loaded || value != 1 {
+		t.Errorf("LoadOrStore = %d, %v; want the stored 1", value, loaded)
+	}
+	if value, loaded := m.LoadOrStore("a", 3, time.Minute, now.Add(time.Minute)); loaded || value != 3 {
+		t.Errorf("LoadOrStore after expiry = %d, %v; want 3 stored", value, loaded)
+	}
+}
+
+func TestExpiringMapConcurrentAccess(t *testing.T) {
+	m := newExpiringMap[int](1024)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("user%d@example.org", (i*100+j)%50)
+				m.Set(key, j, time.Minute, now)
+				m.Get(key, now)
+				m.Update("counter", 0, now, func(count int, ok bool) (int, bool) {
+					return count + 1, true
+				})
+				m.Range(now, func(string, int) {})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := m.Len(); n != 51 {
+		t.Errorf("map holds %d entries, want 51", n)
+	}
+	if count, _ := m.Get("counter", now); count != 2000 {
+		t.Errorf("counter = %d after 2000 concurrent updates", count)
+	}
+}
+
+func TestExpiringMapConcurrentLoadOrStore(t *testing.T) {
+	m := newExpiringMap[int](16)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, loaded := m.LoadOrStore("key", i, time.Minute, now); !loaded {
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stored != 1 {
+		t.Errorf("%d goroutines stored the key, want 1", stored)
+	}
+}
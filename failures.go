@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// recentFailures keeps the last messages that could not be delivered.
+var recentFailures *failureBuffer
+
+// FailuresHandler lists recent delivery failures and clears them on DELETE.
+type FailuresHandler struct{}
+
+type failureRecord struct {
+	From       string    `json:"from"`
+	Subject    string    `json:"subject"`
+	Recipients []string  `json:"recipients,omitempty"`
+	Error      string    `json:"error"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+// failureBuffer is a fixed-size ring of failure records.
+type failureBuffer struct {
+	mu      sync.Mutex
+	entries []failureRecord
+	next    int
+	full    bool
+}
+
+func newFailureBuffer(size int) *failureBuffer {
+	return &failureBuffer{entries: make([]failureRecord, size)}
+}
+
+func (b *failureBuffer) Add(record failureRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[b.next] = record
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Snapshot returns the records newest first.
+func (b *failureBuffer) Snapshot() []failureRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	count := b.next
+	if b.full {
+		count = len(b.entries)
+	}
+	records := make([]failureRecord, 0, count)
+	for i := 1; i <= count; i++ {
+		records = append(records, b.entries[(b.next-i+len(b.entries))%len(b.entries)])
+	}
+	return records
+}
+
+func (b *failureBuffer) Clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range b.entries {
+		b.entries[i] = failureRecord{}
+	}
+	b.next = 0
+	b.full = false
+}
+
+func (h *FailuresHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	if r.Method == "DELETE" {
+		recentFailures.Clear()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	newJSONEncoder(w).Encode(struct {
+		Failures []failureRecord `json:"failures"`
+	}{recentFailures.Snapshot()})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fieldMap maps an Email field (lowercased) to the JSON key clients send it
+// under. When empty, the payload is decoded straight into Email.
+var fieldMap map[string]string
+
+var errMissingField = errors.New("missing required field")
+
+// parseFieldMap parses a MAILER_FIELD_MAP spec such as
+// "from:email,body:message".
+func parseFieldMap(spec string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		tokens := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(tokens) != 2 || tokens[1] == "" {
+			return nil, fmt.Errorf("invalid field mapping %q", pair)
+		}
+		field := strings.ToLower(tokens[0])
+		switch field {
+		case "from", "name", "to", "cc", "replyto", "subject", "body", "html", "sendat":
+		default:
+			return nil, fmt.Errorf("unknown field %q", tokens[0])
+		}
+		mapping[field] = tokens[1]
+	}
+	return mapping, nil
+}
+
+// decodeMapped decodes a JSON payload into a generic map and projects it
+// onto m using fieldMap. From and Body are required; the rest are optional.
+func (m *Email) decodeMapped(r io.Reader) error {
+	var payload map[string]interface{}
+	if err := decodeJSON(r, &payload, false); err != nil {
+		return err
+	}
+	if collectFields() {
+		m.Fields = stringFields(payload)
+	}
+
+	for _, field := range []string{"from", "name", "to", "replyto", "subject", "body", "html"} {
+		key, ok := fieldMap[field]
+		if !ok {
+			key = field
+		}
+		value, err := lookupField(payload, key)
+		if err != nil {
+			return err
+		}
+		if value == "" && (field == "from" || field == "body") {
+			return fmt.Errorf("%w %q", errMissingField, key)
+		}
+		switch field {
+		case "from":
+			m.From = value
+		case "name":
+			m.Name = value
+		case "to":
+			m.To = value
+		case "replyto":
+			m.ReplyTo = value
+		case "subject":
+			m.Subject = value
+		case "body":
+			m.Body = value
+		case "html":
+			m.HTML = value
+		}
+	}
+
+	key, ok := fieldMap["cc"]
+	if !ok {
+		key = "cc"
+	}
+	cc, err := lookupList(payload, key)
+	if err != nil {
+		return err
+	}
+	m.Cc = cc
+
+	key, ok = fieldMap["sendat"]
+	if !ok {
+		key = "sendat"
+	}
+	value, err := lookupField(payload, key)
+	if err != nil || value == "" {
+		return err
+	}
+	m.SendAt, err = time.Parse(time.RFC3339, value)
+	return err
+}
+
+// lookupField finds key in payload, preferring an exact match but falling
+// back to a case-insensitive one like encoding/json does for struct fields.
+func lookupField(payload map[string]interface{}, key string) (string, error) {
+	value := lookupValue(payload, key)
+	if value == nil {
+		return "", nil
+	}
+	text, ok := fieldText(value)
+	if !ok {
+		return "", fmt.Errorf("field %q must be a string, number or boolean", key)
+	}
+	return text, nil
+}
+
+// lookupList finds a list-valued key, which clients may send either as an
+// array of strings or as a single comma-separated string.
+func lookupList(payload map[string]interface{}, key string) ([]string, error) {
+	var list []string
+	switch value := lookupValue(payload, key).(type) {
+	case nil:
+	case string:
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			text, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("field %q must be a list of strings", key)
+			}
+			list = append(list, text)
+		}
+	default:
+		return nil, fmt.Errorf("field %q must be a list of strings", key)
+	}
+	return list, nil
+}
+
+func lookupValue(payload map[string]interface{}, key string) interface{} {
+	if value, ok := payload[key]; ok {
+		return value
+	}
+	for candidate, value := range payload {
+		if strings.EqualFold(candidate, key) {
+			return value
+		}
+	}
+	return nil
+}
+
+// stringFields keeps the string, numeric and boolean fields of payload, which are
+// the ones a subject template can sensibly interpolate.
+func stringFields(payload map[string]interface{}) map[string]string {
+	fields := make(map[string]string)
+	for key, value := range payload {
+		if text, ok := fieldText(value); ok {
+			fields[key] = text
+		}
+	}
+	return fields
+}
+
+// fieldText renders a scalar JSON value as text. Numbers are written
+// exactly as they were sent, so long integers keep every digit and are never
+// reformatted; booleans are true or false. It reports false for null,
+// objects and arrays.
+func fieldText(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case bool:
+		return strconv.FormatBool(value), true
+	case json.Number:
+		return value.String(), true
+	}
+	return "", false
+}
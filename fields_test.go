@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFieldTextKeepsNumbersAsSent(t *testing.T) {
+	payload, err := decodePayload(`{"phone": 12345678901234567890, "ratio": 0.1, "big": 1e20000000, "small": 2.5E-3, "ok": true, "no": false, "empty": null}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := stringFields(payload)
+	for key, want := range map[string]string{
+		"phone": "12345678901234567890",
+		"ratio": "0.1",
+		"big":   "1e20000000",
+		"small": "2.5E-3",
+		"ok":    "true",
+		"no":    "false",
+	} {
+		if fields[key] != want {
+			t.Errorf("%s = %q, want %q", key, fields[key], want)
+		}
+	}
+	if _, ok := fields["empty"]; ok {
+		t.Errorf("null field was kept as %q", fields["empty"])
+	}
+}
+
+func TestFieldTextLargeExponentIsCheap(t *testing.T) {
+	payload, err := decodePayload(`{"n": 1e2000000000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	text, ok := fieldText(payload["n"])
+	if !ok || text != "1e2000000000" {
+		t.Errorf("fieldText = %q, %v", text, ok)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fieldText took %s", elapsed)
+	}
+}
+
+func TestDecodeMappedCoercesScalars(t *testing.T) {
+	fieldMap = map[string]string{"body": "message", "name": "phone"}
+	defer func() { fieldMap = nil }()
+
+	var m Email
+	err := m.decodeMapped(strings.NewReader(`{"from": "a@example.com", "message": 42, "phone": 447700900123}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Body != "42" || m.Name != "447700900123" {
+		t.Errorf("body = %q, name = %q", m.Body, m.Name)
+	}
+
+	err = m.decodeMapped(strings.NewReader(`{"from": "a@example.com", "message": {"nested": 1}}`))
+	if err == nil {
+		t.Error("an object body was accepted")
+	}
+}
+
+func decodePayload(body string) (map[string]interface{}, error) {
+	var payload map[string]interface{}
+	err := decodeJSON(strings.NewReader(body), &payload, false)
+	return payload, err
+}
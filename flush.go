@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// FlushHandler delivers queued retries immediately rather than at their
+// scheduled time, for recovering after a downstream outage.
+type FlushHandler struct{}
+
+func (h *FlushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	summary, err := messageScheduler.Flush()
+	if err != nil {
+		log.Printf("Unable to flush the queue: %s\n", err.Error())
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	log.Printf("Flushed the queue: %d attempted, %d delivered, %d deferred, %d failed\n",
+		summary.Attempted, summary.Delivered, summary.Deferred, summary.Failed)
+	w.Header().Set("Content-Type", "application/json")
+	newJSONEncoder(w).Encode(summary)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// failWhenDegraded makes /send answer 503 instead of accepting submissions
+// that are unlikely to be delivered.
+var failWhenDegraded bool
+
+// deliveryHealth tracks whether outbound delivery is currently working.
+var deliveryHealth = &healthState{}
+
+// healthState behaves like a circuit breaker: after threshold consecutive
+// failed deliveries the mailer is degraded until cooldown has passed since
+// the last failure, at which point the next delivery acts as a probe.
+type healthState struct {
+	mu          sync.Mutex
+	threshold   int
+	cooldown    time.Duration
+	failures    int
+	lastFailure time.Time
+}
+
+func (h *healthState) recordSuccess() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = 0
+}
+
+func (h *healthState) recordFailure(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	h.lastFailure = now
+}
+
+// Degraded reports whether delivery is considered broken and, if so, how
+// long until it will be tried again.
+func (h *healthState) Degraded(now time.Time) (bool, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.threshold <= 0 || h.failures < h.threshold {
+		return false, 0
+	}
+	remaining := h.lastFailure.Add(h.cooldown).Sub(now)
+	if remaining <= 0 {
+		return false, 0
+	}
+	return true, remaining
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// maxConnsPerHost caps the deliveries in progress to any one server, so a
+// burst to one destination queues rather than tripping its connection-rate
+// limits while other destinations carry on. Zero means no cap.
+var maxConnsPerHost int
+
+var hostConns = &hostLimiter{hosts: newExpiringMap[*hostSlots](1024)}
+
+// hostLimiter is a semaphore per server address that also counts the
+// deliveries in progress for metrics. A server's entry is kept, without
+// expiring, while any delivery holds or waits for one of its slots, and
+// removed once the last one is done.
+type hostLimiter struct {
+	hosts *expiringMap[*hostSlots]
+}
+
+// hostSlots is only read and changed within hosts' lock for its address.
+type hostSlots struct {
+	slots chan struct{}
+	// users counts the deliveries holding or waiting for a slot, active
+	// those holding one.
+	users  int
+	active int
+}
+
+// acquire waits for a free slot for addr or for ctx to be done.
+func (l *hostLimiter) acquire(ctx context.Context, addr string) error {
+	var slots chan struct{}
+	l.hosts.Update(addr, 0, time.Now(), func(host *hostSlots, ok bool) (*hostSlots, bool) {
+		if !ok {
+			host = &hostSlots{}
+			if maxConnsPerHost > 0 {
+				host.slots = make(chan struct{}, maxConnsPerHost)
+			}
+		}
+		host.users++
+		slots = host.slots
+		return host, true
+	})
+
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			l.leave(addr, false)
+			return ctx.Err()
+		}
+	}
+	l.hosts.Update(addr, 0, time.Now(), func(host *hostSlots, ok bool) (*hostSlots, bool) {
+		host.active++
+		return host, true
+	})
+	return nil
+}
+
+func (l *hostLimiter) release(addr string) {
+	l.leave(addr, true)
+}
+
+// leave drops a user of addr's slots, freeing the one it holds if held.
+func (l *hostLimiter) leave(addr string, held bool) {
+	var slots chan struct{}
+	l.hosts.Update(addr, 0, time.Now(), func(host *hostSlots, ok bool) (*hostSlots, bool) {
+		if held {
+			host.active--
+			slots = host.slots
+		}
+		host.users--
+		return host, host.users > 0
+	})
+	if slots != nil {
+		<-slots
+	}
+}
+
+// counts reports the deliveries in progress by server address.
+func (l *hostLimiter) counts() map[string]float64 {
+	counts := make(map[string]float64)
+	l.hosts.Range(time.Now(), func(addr string, host *hostSlots) {
+		if host.active > 0 {
+			counts[addr] = float64(host.active)
+		}
+	})
+	return counts
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostLimiterCapsConcurrentDeliveries(t *testing.T) {
+	maxConnsPerHost = 2
+	defer func() { maxConnsPerHost = 0 }()
+	limiter := &hostLimiter{hosts: newExpiringMap[*hostSlots](16)}
+
+	var active, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := limiter.acquire(context.Background(), "mx.example.com:25"); err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt32(&active, 1)
+			for {
+				seen := atomic.LoadInt32(&peak)
+				if n <= seen || atomic.CompareAndSwapInt32(&peak, seen, n) {
+					break
+				}
+			}
+			limiter.counts()
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			limiter.release("mx.example.com:25")
+		}()
+	}
+	wg.Wait()
+	if peak > 2 {
+		t.Errorf("%d deliveries ran at once, want at most 2", peak)
+	}
+	if n := limiter.hosts.Len(); n != 0 {
+		t.Errorf("limiter kept %d entries after every delivery finished", n)
+	}
+}
+
+func TestHostLimiterAcquireGivesUpWithContext(t *testing.T) {
+	maxConnsPerHost = 1
+	defer func() { maxConnsPerHost = 0 }()
+	limiter := &hostLimiter{hosts: newExpiringMap[*hostSlots](16)}
+
+	if err := limiter.acquire(context.Background(), "mx.example.com:25"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.acquire(ctx, "mx.example.com:25"); err == nil {
+		t.Fatal("acquired a second slot with a cap of 1")
+	}
+	if counts := limiter.counts(); counts["mx.example.com:25"] != 1 {
+		t.Errorf("counts = %v, want the one delivery in progress", counts)
+	}
+	limiter.release("mx.example.com:25")
+	if n := limiter.hosts.Len(); n != 0 {
+		t.Errorf("limiter kept %d entries after the delivery finished", n)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// httpClient is shared by every outbound HTTP integration: the Mailgun
+// API, webhooks and provider notifications. Its Timeout, set by
+// MAILER_HTTP_CLIENT_TIMEOUT, bounds each request so a stalled service
+// cannot hold a goroutine indefinitely, and its transport keeps idle
+// connections for reuse across calls.
+var httpClient = &http.Client{
+	Timeout: time.Minute,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	},
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	email "gopkg.in/jordan-wright/email.v1"
+)
+
+// allowHTML accepts an HTML alternative to the text body from clients. It
+// is off by default since the HTML is delivered unfiltered.
+var allowHTML bool
+
+// cidPattern matches cid: references in src and similar attributes.
+var cidPattern = regexp.MustCompile(`(?i)["'(]cid:([^"')\s>]+)`)
+
+// validateInline checks the HTML body and that every cid: reference in it
+// names an inline attachment.
+func (m *Email) validateInline() error {
+	if m.HTML == "" {
+		for _, attachment := range m.Attachments {
+			if attachment.Inline {
+				return errors.New("inline attachments require an html body")
+			}
+		}
+		return nil
+	}
+	if !allowHTML {
+		return errors.New("html is not allowed")
+	}
+
+	inline := make(map[string]bool)
+	for _, attachment := range m.Attachments {
+		if attachment.Inline {
+			inline[attachment.ContentID] = true
+		}
+	}
+	for _, match := range cidPattern.FindAllStringSubmatch(m.HTML, -1) {
+		id, err := url.PathUnescape(match[1])
+		if err != nil {
+			id = match[1]
+		}
+		if !inline[id] {
+			return fmt.Errorf("html references unknown content id %q", id)
+		}
+	}
+	return nil
+}
+
+func (m *Email) hasInline() bool {
+	for _, attachment := range m.Attachments {
+		if attachment.Inline {
+			return true
+		}
+	}
+	return false
+}
+
+// partContentID derives a Content-ID for an inline part from its header,
+// falling back to its filename.
+func partContentID(header string, filename string) (string, error) {
+	id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(header), "<"), ">")
+	if id == "" {
+		id = filename
+	}
+	if id == "" || strings.ContainsAny(id, "<>\r\n\" ") {
+		return "", fmt.Errorf("invalid content id %q", id)
+	}
+	return id, nil
+}
+
+// relatedMessage renders message with its inline parts in a
+// multipart/related part next to the HTML, which is where clients look up
+// cid: references. The email package puts every attachment in the
+// top-level multipart/mixed part, so messages with inline parts are
+// rendered here instead:
+//
+//	multipart/mixed
+//	  multipart/alternative
+//	    text/plain
+//	    multipart/related
+//	      text/html
+//	      inline parts
+//	  attachments
+func relatedMessage(message *email.Email) ([]byte, error) {
+	var buffer bytes.Buffer
+	mixed := multipart.NewWriter(&buffer)
+
+	header := make(textproto.MIMEHeader)
+	for key, values := range message.Headers {
+		header[key] = values
+	}
+	header.Set("From", message.From)
+	header.Set("To", strings.Join(message.To, ", "))
+	if len(message.Cc) > 0 {
+		header.Set("Cc", strings.Join(message.Cc, ", "))
+	}
+	header.Set("Subject", message.Subject)
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mixed.Boundary()}))
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(&buffer, "%s: %s\r\n", key, value)
+		}
+	}
+	buffer.WriteString("\r\n")
+
+	alternative, err := nestedMultipart(mixed, "multipart/alternative")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(alternative, "text/plain; charset=UTF-8", message.Text); err != nil {
+		return nil, err
+	}
+	related, err := nestedMultipart(alternative, "multipart/related")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(related, "text/html; charset=UTF-8", message.HTML); err != nil {
+		return nil, err
+	}
+	var attachments []*email.Attachment
+	for _, attachment := range message.Attachments {
+		if attachment.Header.Get("Content-ID") == "" {
+			attachments = append(attachments, attachment)
+			continue
+		}
+		if err := writeBase64(related, attachment); err != nil {
+			return nil, err
+		}
+	}
+	if err := related.Close(); err != nil {
+		return nil, err
+	}
+	if err := alternative.Close(); err != nil {
+		return nil, err
+	}
+	for _, attachment := range attachments {
+		if err := writeBase64(mixed, attachment); err != nil {
+			return nil, err
+		}
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// nestedMultipart starts a multipart part of mediaType within parent.
+func nestedMultipart(parent *multipart.Writer, mediaType string) (*multipart.Writer, error) {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	part, err := parent.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType(mediaType, map[string]string{"boundary": boundary})},
+	})
+	if err != nil {
+		return nil, err
+	}
+	child := multipart.NewWriter(part)
+	return child, child.SetBoundary(boundary)
+}
+
+func writeQuotedPrintable(w *multipart.Writer, contentType string, content []byte) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	encoder := quotedprintable.NewWriter(part)
+	if _, err := encoder.Write(content); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// writeBase64 writes the attachment in lines of 76 characters.
+func writeBase64(w *multipart.Writer, attachment *email.Attachment) error {
+	header := make(textproto.MIMEHeader)
+	for key, values := range attachment.Header {
+		header[key] = values
+	}
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(part, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
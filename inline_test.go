@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAttachment stores content in a temporary file for an attachment.
+func writeAttachment(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readParts returns the media type and the parts of a multipart entity.
+func readParts(t *testing.T, contentType string, body io.Reader) (string, []*multipart.Part, [][]byte) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []*multipart.Part
+	var contents [][]byte
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(part)
+		parts = append(parts, part)
+		contents = append(contents, content)
+	}
+	return mediaType, parts, contents
+}
+
+func TestConstructMessageRelatesInlineParts(t *testing.T) {
+	setupSendHandler(t)
+	message := &Email{
+		From:    "visitor@example.org",
+		Subject: "Café",
+		Body:    "hello",
+		HTML:    `<p>hello <img src="cid:logo"></p>`,
+		Attachments: []*Attachment{
+			{Filename: "logo.png", ContentType: "image/png", Inline: true, ContentID: "logo", path: writeAttachment(t, "logo.png", "png")},
+			{Filename: "notes.txt", ContentType: "text/plain", path: writeAttachment(t, "notes.txt", "notes")},
+		},
+	}
+	msg, err := message.ConstructMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := parsed.Header.Get("Subject"); subject != "=?utf-8?q?Caf=C3=A9?=" {
+		t.Errorf("Subject = %q, want it RFC 2047 encoded", subject)
+	}
+
+	mediaType, mixed, contents := readParts(t, parsed.Header.Get("Content-Type"), parsed.Body)
+	if mediaType != "multipart/mixed" || len(mixed) != 2 {
+		t.Fatalf("top level is %s with %d parts, want multipart/mixed with 2", mediaType, len(mixed))
+	}
+	if got := mixed[1].Header.Get("Content-Disposition"); got != `attachment; filename=notes.txt` {
+		t.Errorf("second top-level part has disposition %q, want the regular attachment", got)
+	}
+
+	mediaType, alternative, contents := readParts(t, mixed[0].Header.Get("Content-Type"), bytes.NewReader(contents[0]))
+	if mediaType != "multipart/alternative" || len(alternative) != 2 {
+		t.Fatalf("first part is %s with %d parts, want multipart/alternative with 2", mediaType, len(alternative))
+	}
+	if got := alternative[0].Header.Get("Content-Type"); got != "text/plain; charset=UTF-8" {
+		t.Errorf("first alternative is %q, want the text body", got)
+	}
+
+	mediaType, related, _ := readParts(t, alternative[1].Header.Get("Content-Type"), bytes.NewReader(contents[1]))
+	if mediaType != "multipart/related" || len(related) != 2 {
+		t.Fatalf("second alternative is %s with %d parts, want multipart/related with 2", mediaType, len(related))
+	}
+	if got := related[0].Header.Get("Content-Type"); got != "text/html; charset=UTF-8" {
+		t.Errorf("related part starts with %q, want the html body", got)
+	}
+	if got := related[1].Header.Get("Content-ID"); got != "<logo>" {
+		t.Errorf("inline part has Content-ID %q, want <logo>", got)
+	}
+}
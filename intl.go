@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// smtpUTF8Enabled allows submitters with non-ASCII local parts. Delivery
+// then requires a destination that advertises SMTPUTF8 (RFC 6531).
+var smtpUTF8Enabled bool
+
+var errNoSMTPUTF8 = errors.New("server does not support SMTPUTF8")
+
+// normalizeAddress punycode-encodes the domain of a bare address and
+// reports whether its local part still needs SMTPUTF8.
+func normalizeAddress(address string) (string, bool, error) {
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 {
+		return address, !isASCII(address), nil
+	}
+	local, domain := address[:i], address[i+1:]
+	if !isASCII(domain) {
+		encoded, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return "", false, fmt.Errorf("invalid domain %q: %s", domain, err)
+		}
+		domain = encoded
+	}
+	return local + "@" + domain, !isASCII(local), nil
+}
+
+// normalizeSubmitter applies normalizeAddress to a From value, which may
+// carry a display name. Values that do not parse are left for the rest of
+// the pipeline to deal with.
+func normalizeSubmitter(from string) (string, bool, error) {
+	parsed, err := mail.ParseAddress(from)
+	if err != nil {
+		return from, false, nil
+	}
+	address, needsUTF8, err := normalizeAddress(parsed.Address)
+	if err != nil {
+		return "", false, err
+	}
+	if address == parsed.Address {
+		return from, needsUTF8, nil
+	}
+	parsed.Address = address
+	return parsed.String(), needsUTF8, nil
+}
+
+// needsSMTPUTF8 reports whether any of addresses has a non-ASCII local part
+// after normalization.
+func needsSMTPUTF8(addresses ...string) bool {
+	for _, address := range addresses {
+		if parsed, err := mail.ParseAddress(address); err == nil {
+			address = parsed.Address
+		}
+		if _, needsUTF8, _ := normalizeAddress(address); needsUTF8 {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		address   string
+		want      string
+		needsUTF8 bool
+	}{
+		{"visitor@example.org", "visitor@example.org", false},
+		{"visitor@bücher.example", "visitor@xn--bcher-kva.example", false},
+		{"jürgen@example.org", "jürgen@example.org", true},
+		{"jürgen@bücher.example", "jürgen@xn--bcher-kva.example", true},
+	}
+	for _, test := range tests {
+		got, needsUTF8, err := normalizeAddress(test.address)
+		if err != nil {
+			t.Errorf("normalizeAddress(%q): %v", test.address, err)
+			continue
+		}
+		if got != test.want || needsUTF8 != test.needsUTF8 {
+			t.Errorf("normalizeAddress(%q) = %q, %v; want %q, %v", test.address, got, needsUTF8, test.want, test.needsUTF8)
+		}
+	}
+	if _, _, err := normalizeAddress("visitor@bü cher.example"); err == nil {
+		t.Error("a domain IDNA rejects was accepted")
+	}
+}
+
+func TestNormalizeSubmitterKeepsDisplayName(t *testing.T) {
+	from, needsUTF8, err := normalizeSubmitter("Visitor <visitor@bücher.example>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != `"Visitor" <visitor@xn--bcher-kva.example>` || needsUTF8 {
+		t.Errorf("normalizeSubmitter = %q, %v", from, needsUTF8)
+	}
+}
+
+func TestValidateFromNeedsSMTPUTF8Enabled(t *testing.T) {
+	defer func() { smtpUTF8Enabled = false }()
+	message := &Email{From: "jürgen@example.org"}
+	if message.validateFrom() == nil {
+		t.Error("a non-ASCII local part was accepted with SMTPUTF8 disabled")
+	}
+	smtpUTF8Enabled = true
+	if err := message.validateFrom(); err != nil {
+		t.Errorf("a non-ASCII local part was refused with SMTPUTF8 enabled: %v", err)
+	}
+}
+
+func TestSendMailSMTPUTF8(t *testing.T) {
+	env := envelope{From: "jürgen@example.org", To: []string{"inbox@example.com"}, SMTPUTF8: true}
+
+	plain := startFakeSMTP(t)
+	_, err := sendMail(context.Background(), plain.Addr(), nil, env, []byte(testMessage))
+	if !errors.Is(err, errNoSMTPUTF8) {
+		t.Errorf("sendMail to a server without SMTPUTF8 = %v, want errNoSMTPUTF8", err)
+	}
+	for _, command := range plain.Commands() {
+		if strings.HasPrefix(command, "MAIL") {
+			t.Errorf("sent %q to a server without SMTPUTF8", command)
+		}
+	}
+
+	capable := startFakeSMTP(t, "SMTPUTF8", "8BITMIME")
+	if _, err := sendMail(context.Background(), capable.Addr(), nil, env, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, command := range capable.Commands() {
+		if strings.HasPrefix(command, "MAIL FROM:<jürgen@example.org>") {
+			found = strings.Contains(command, "SMTPUTF8")
+		}
+	}
+	if !found {
+		t.Errorf("MAIL FROM did not carry SMTPUTF8: %v", capable.Commands())
+	}
+}
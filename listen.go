@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listen opens a TCP listener, or a Unix socket for addresses of the form
+// unix:/path/to.sock. A stale socket left by an unclean exit is replaced.
+// TCP listeners read PROXY headers when proxyProtocolUpstreams is set.
+func listen(address string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(address, "unix:")
+	if !isUnix {
+		listener, err := net.Listen("tcp", address)
+		if err != nil || proxyProtocolUpstreams == nil {
+			return listener, err
+		}
+		return &proxyListener{Listener: listener}, nil
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// serve runs server on every address until SIGINT or SIGTERM, then shuts
+// down gracefully. Closing a Unix listener removes its socket file.
+func serve(server *http.Server, addresses []string) error {
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, err := listen(address)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
+		log.Printf("Listening on %s\n", address)
+		listeners = append(listeners, listener)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		server.Close()
+		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// mailgunTransport posts the constructed message to Mailgun's MIME
+// messages API instead of speaking SMTP.
+type mailgunTransport struct {
+	endpoint string
+	apiKey   string
+}
+
+func newMailgunTransport(apiBase string, domain string, apiKey string) *mailgunTransport {
+	return &mailgunTransport{
+		endpoint: strings.TrimRight(apiBase, "/") + "/v3/" + url.PathEscape(domain) + "/messages.mime",
+		apiKey:   apiKey,
+	}
+}
+
+func (t *mailgunTransport) Deliver(ctx context.Context, e *Email, msg []byte) (*deliveryResult, error) {
+	domains, groups := e.envelopeRecipients()
+	var recipients []string
+	for _, domain := range domains {
+		recipients = append(recipients, groups[domain]...)
+	}
+	log.Printf("Attempting send via mailgun, rcpt_to: %s, %s\n", strings.Join(recipients, ", "), e.logSummary())
+	if debugDumpDir != "" {
+		dumpMessage("mailgun", envelopeSender(), recipients, msg)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, recipient := range recipients {
+		form.WriteField("to", recipient)
+	}
+	part, err := form.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(msg)
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("api", t.apiKey)
+
+	result := &deliveryResult{}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		for _, recipient := range recipients {
+			result.reject(recipient, err)
+		}
+		return result, err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &reply) != nil || reply.Message == "" {
+		reply.Message = strings.TrimSpace(string(data))
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		result.Accepted = recipients
+		result.acceptedVia("mailgun")
+		return result, nil
+	}
+	replyErr := &textproto.Error{Code: mailgunReplyCode(resp.StatusCode), Msg: reply.Message}
+	for _, recipient := range recipients {
+		result.reject(recipient, replyErr)
+	}
+	return result, fmt.Errorf("mailgun: %s: %w", resp.Status, replyErr)
+}
+
+// mailgunReplyCode maps an HTTP status onto the SMTP reply class used to
+// decide whether a failure is worth retrying.
+func mailgunReplyCode(status int) int {
+	switch {
+	case status == http.StatusTooManyRequests || status >= 500:
+		return 451
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return 535
+	default:
+		return 554
+	}
+}
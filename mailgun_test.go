@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMailgunTransportPostsMessage(t *testing.T) {
+	var gotPath, gotUser, gotKey, gotMessage string
+	var gotTo []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotUser, gotKey, _ = r.BasicAuth()
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("request is not a multipart form: %v", err)
+			return
+		}
+		gotTo = r.MultipartForm.Value["to"]
+		if file, _, err := r.FormFile("message"); err == nil {
+			data, _ := io.ReadAll(file)
+			gotMessage = string(data)
+		}
+		w.Write([]byte(`{"id": "<1@mg.example.com>", "message": "Queued. Thank you."}`))
+	}))
+	defer api.Close()
+
+	transport := newMailgunTransport(api.URL+"/", "mg.example.com", "key-123")
+	message := &Email{From: "visitor@example.org", RetryRecipients: []string{"inbox@example.com", "sales@example.net"}}
+	result, err := transport.Deliver(context.Background(), message, []byte(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/v3/mg.example.com/messages.mime" {
+		t.Errorf("posted to %s", gotPath)
+	}
+	if gotUser != "api" || gotKey != "key-123" {
+		t.Errorf("basic auth = %q:%q, want api:key-123", gotUser, gotKey)
+	}
+	want := []string{"inbox@example.com", "sales@example.net"}
+	if !reflect.DeepEqual(gotTo, want) {
+		t.Errorf("to = %v, want %v", gotTo, want)
+	}
+	if gotMessage != testMessage {
+		t.Errorf("message part = %q, want the built message", gotMessage)
+	}
+	if !reflect.DeepEqual(result.Accepted, want) {
+		t.Errorf("accepted %v, want %v", result.Accepted, want)
+	}
+}
+
+func TestMailgunTransportFailures(t *testing.T) {
+	tests := []struct {
+		status    int
+		code      int
+		temporary bool
+	}{
+		{http.StatusTooManyRequests, 451, true},
+		{http.StatusBadGateway, 451, true},
+		{http.StatusUnauthorized, 535, false},
+		{http.StatusBadRequest, 554, false},
+	}
+	for _, test := range tests {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(`{"message": "nope"}`))
+		}))
+		transport := newMailgunTransport(api.URL, "mg.example.com", "key-123")
+		message := &Email{From: "visitor@example.org", RetryRecipients: []string{"inbox@example.com"}}
+		result, err := transport.Deliver(context.Background(), message, []byte(testMessage))
+		api.Close()
+
+		if err == nil {
+			t.Errorf("%d: Deliver succeeded", test.status)
+			continue
+		}
+		if len(result.Accepted) != 0 || len(result.Rejected) != 1 {
+			t.Errorf("%d: result = %+v", test.status, result)
+			continue
+		}
+		if status := result.Rejected[0]; status.Code != test.code {
+			t.Errorf("%d: reply code %d, want %d", test.status, status.Code, test.code)
+		}
+		if temporary := len(result.temporaryFailures()) == 1; temporary != test.temporary {
+			t.Errorf("%d: temporary = %v, want %v", test.status, temporary, test.temporary)
+		}
+	}
+}
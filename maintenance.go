@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maintenance is swapped whole on SIGHUP, so handlers always see one
+// consistent set of settings.
+var maintenance atomic.Pointer[maintenanceSettings]
+
+// maintenanceSettings makes /send refuse submissions with 503 while the
+// form is down for planned work.
+type maintenanceSettings struct {
+	enabled    bool
+	message    string
+	retryAfter time.Duration
+}
+
+// loadMaintenance reads MAILER_MAINTENANCE, MAILER_MAINTENANCE_MESSAGE and
+// MAILER_MAINTENANCE_RETRY_AFTER.
+func loadMaintenance() (*maintenanceSettings, error) {
+	settings := &maintenanceSettings{
+		enabled:    config.Get("MAILER_MAINTENANCE") == "true",
+		message:    config.Get("MAILER_MAINTENANCE_MESSAGE"),
+		retryAfter: 5 * time.Minute,
+	}
+	if settings.message == "" {
+		settings.message = "the form is down for maintenance, please try again later"
+	}
+	if value := config.Get("MAILER_MAINTENANCE_RETRY_AFTER"); value != "" {
+		retryAfter, err := time.ParseDuration(value)
+		if err != nil || retryAfter <= 0 {
+			return nil, errors.New("MAILER_MAINTENANCE_RETRY_AFTER must be a positive duration, e.g. 10m")
+		}
+		settings.retryAfter = retryAfter
+	}
+	return settings, nil
+}
+
+// reloadOnHangup re-reads the config file on SIGHUP and applies its
+// maintenance settings. Settings given as flags or in the environment
+// take precedence over the file as usual, so only maintenance configured
+// in the file can be toggled this way.
+func reloadOnHangup(configFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := reloadMaintenance(configFile); err != nil {
+			log.Printf("Unable to reload settings: %s\n", err.Error())
+			continue
+		}
+		log.Printf("Reloaded settings, maintenance mode: %t\n", maintenance.Load().enabled)
+	}
+}
+
+// reloadMaintenance re-reads configFile, when there is one, and swaps in
+// the maintenance settings it gives. Nothing changes on error.
+func reloadMaintenance(configFile string) error {
+	if configFile != "" {
+		settings, err := loadConfigFile(configFile)
+		if err != nil {
+			return err
+		}
+		config.file = settings
+	}
+	settings, err := loadMaintenance()
+	if err != nil {
+		return err
+	}
+	maintenance.Store(settings)
+	return nil
+}
+
+// HealthHandler reports that the process is up, including while /send is
+// refusing submissions for maintenance.
+type HealthHandler struct{}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	newJSONEncoder(w).Encode(struct {
+		Status      string `json:"status"`
+		Maintenance bool   `json:"maintenance"`
+	}{"ok", maintenance.Load().enabled})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceToggle(t *testing.T) {
+	fake := setupSendHandler(t)
+	saved := config.file
+	defer func() { config.file = saved }()
+	path := filepath.Join(t.TempDir(), "mailer.env")
+	body := `{"from": "visitor@example.org", "body": "hello"}`
+
+	os.WriteFile(path, []byte("MAILER_MAINTENANCE=true\nMAILER_MAINTENANCE_MESSAGE=\"back at noon\"\nMAILER_MAINTENANCE_RETRY_AFTER=90s\n"), 0600)
+	if err := reloadMaintenance(path); err != nil {
+		t.Fatal(err)
+	}
+	w := postSend("application/json", body)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("answered %d during maintenance, want 503", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "90" {
+		t.Errorf("Retry-After = %q, want 90", got)
+	}
+	if !strings.Contains(w.Body.String(), "back at noon") {
+		t.Errorf("response %q lacks the maintenance message", w.Body.String())
+	}
+	health := httptest.NewRecorder()
+	(&HealthHandler{}).ServeHTTP(health, httptest.NewRequest("GET", "/health", nil))
+	if health.Code != http.StatusOK || !strings.Contains(health.Body.String(), `"maintenance":true`) {
+		t.Errorf("/health answered %d %s during maintenance", health.Code, health.Body.String())
+	}
+
+	os.WriteFile(path, []byte("MAILER_MAINTENANCE=false\n"), 0600)
+	if err := reloadMaintenance(path); err != nil {
+		t.Fatal(err)
+	}
+	if w := postSend("application/json", body); w.Code != http.StatusAccepted {
+		t.Fatalf("answered %d after maintenance, want 202", w.Code)
+	}
+	waitFor(t, func() bool { return fake.count() == 1 })
+}
+
+func TestMaintenanceReloadKeepsSettingsOnError(t *testing.T) {
+	saved := config.file
+	defer func() { config.file = saved }()
+	maintenance.Store(&maintenanceSettings{enabled: true})
+	defer maintenance.Store(&maintenanceSettings{})
+
+	path := filepath.Join(t.TempDir(), "mailer.env")
+	os.WriteFile(path, []byte("MAILER_MAINTENANCE=false\nMAILER_MAINTENANCE_RETRY_AFTER=soon\n"), 0600)
+	if err := reloadMaintenance(path); err == nil {
+		t.Error("an invalid retry-after was accepted")
+	}
+	if !maintenance.Load().enabled {
+		t.Error("a failed reload changed the maintenance settings")
+	}
+}
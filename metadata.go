@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// includeMetadata records the submitter's IP, User-Agent and submission
+// time on each message as X- headers, for abuse investigation.
+var includeMetadata bool
+
+// addReceived adds a Received header recording the submitter's IP and the
+// submission time, naming receivedHost as the receiving host. It is off by
+// default since it discloses the host's name.
+var addReceived bool
+var receivedHost string
+
+type submissionMetadata struct {
+	ClientIP    string    `json:"client_ip"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	SubmittedAt time.Time `json:"submitted_at"`
+}
+
+func newSubmissionMetadata(r *http.Request, now time.Time) *submissionMetadata {
+	return &submissionMetadata{
+		ClientIP:    clientIP(r),
+		UserAgent:   r.UserAgent(),
+		SubmittedAt: now.UTC(),
+	}
+}
+
+func (m *submissionMetadata) setHeaders(headers textproto.MIMEHeader) {
+	headers.Set("X-Submitter-IP", stripLineBreaks(m.ClientIP))
+	if m.UserAgent != "" {
+		headers.Set("X-Submitter-User-Agent", stripLineBreaks(m.UserAgent))
+	}
+	headers.Set("X-Submitted-At", m.SubmittedAt.Format(time.RFC1123Z))
+}
+
+// receivedHeader formats a Received header value in the form RFC 5321
+// gives for a time stamp line, such as
+//
+//	from [192.0.2.1] by mailer.example.com with HTTP id 1a2b3c; Mon, 2 Jan 2006 15:04:05 +0000
+//
+// id is the local part of the message's Message-Id, and is left out when
+// the message has none.
+func (m *submissionMetadata) receivedHeader(messageID string) string {
+	from := ""
+	if ip := net.ParseIP(m.ClientIP); ip != nil && ip.To4() != nil {
+		from = fmt.Sprintf("from [%s] ", ip)
+	} else if ip != nil {
+		from = fmt.Sprintf("from [IPv6:%s] ", ip)
+	}
+	id := strings.TrimPrefix(messageID, "<")
+	if i := strings.LastIndexByte(id, '@'); i >= 0 {
+		id = id[:i]
+	}
+	if id = stripLineBreaks(id); id != "" {
+		id = " id " + id
+	}
+	return fmt.Sprintf("%sby %s with HTTP%s; %s", from, receivedHost, id, m.SubmittedAt.Format(time.RFC1123Z))
+}
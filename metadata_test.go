@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceivedHeader(t *testing.T) {
+	receivedHost = "mailer.example.com"
+	defer func() { receivedHost = "" }()
+	at := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		clientIP  string
+		messageID string
+		want      string
+	}{
+		{"192.0.2.1", "<1a2b3c@example.com>", "from [192.0.2.1] by mailer.example.com with HTTP id 1a2b3c; Fri, 02 Jan 2026 15:04:05 +0000"},
+		{"2001:db8::1", "<1a2b3c@example.com>", "from [IPv6:2001:db8::1] by mailer.example.com with HTTP id 1a2b3c; Fri, 02 Jan 2026 15:04:05 +0000"},
+		{"unknown", "<1a2b3c@example.com>", "by mailer.example.com with HTTP id 1a2b3c; Fri, 02 Jan 2026 15:04:05 +0000"},
+		{"192.0.2.1", "", "from [192.0.2.1] by mailer.example.com with HTTP; Fri, 02 Jan 2026 15:04:05 +0000"},
+	}
+	for _, test := range tests {
+		metadata := &submissionMetadata{ClientIP: test.clientIP, SubmittedAt: at}
+		if got := metadata.receivedHeader(test.messageID); got != test.want {
+			t.Errorf("receivedHeader(%q) from %s =\n  %q\nwant\n  %q", test.messageID, test.clientIP, got, test.want)
+		}
+	}
+}
+
+// stampLine is the RFC 5321 section 4.4 time stamp line, limited to the
+// clauses the mailer writes.
+var stampLine = regexp.MustCompile(`^(from \[(IPv6:)?[0-9a-fA-F.:]+\] )?by [A-Za-z0-9.-]+ with [A-Za-z0-9]+( id [A-Za-z0-9.]+)?; [A-Z][a-z]{2}, \d{2} [A-Z][a-z]{2} \d{4} \d{2}:\d{2}:\d{2} [+-]\d{4}$`)
+
+func TestReceivedHeaderFromRequest(t *testing.T) {
+	receivedHost = "mailer.example.com"
+	defer func() { receivedHost = "" }()
+	r := httptest.NewRequest("POST", "/send", nil)
+	r.RemoteAddr = "198.51.100.7:52311"
+	message := &Email{MessageID: "<0f1e2d3c4b5a@example.com>"}
+
+	header := newSubmissionMetadata(r, time.Now()).receivedHeader(message.MessageID)
+	if !stampLine.MatchString(header) {
+		t.Errorf("Received: %s does not have the RFC 5321 form", header)
+	}
+	if !strings.HasPrefix(header, "from [198.51.100.7] ") || strings.Contains(header, "\r") || strings.Contains(header, "\n") {
+		t.Errorf("Received: %s does not name the submitter on one line", header)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// MetricsHandler serves registered metrics in the Prometheus text format.
+type MetricsHandler struct{}
+
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// gaugeVecFunc is a gauge partitioned by a single label whose values are
+// all computed at scrape time.
+type gaugeVecFunc struct {
+	name   string
+	help   string
+	label  string
+	values func() map[string]float64
+}
+
+// counterVec is a counter partitioned by the values of a single label.
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var metricsMu sync.Mutex
+var gauges []gaugeFunc
+var gaugeVecs []gaugeVecFunc
+var counters []*counterVec
+
+// droppedTotal counts submissions turned away by each filter.
+var droppedTotal = registerCounterVec("mailer_dropped_total", "Submissions rejected or dropped, by the filter responsible.", "reason")
+
+// registerGaugeFunc exposes a gauge whose value is computed at scrape time.
+func registerGaugeFunc(name string, help string, value func() float64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	gauges = append(gauges, gaugeFunc{name: name, help: help, value: value})
+}
+
+func registerGaugeVecFunc(name string, help string, label string, values func() map[string]float64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	gaugeVecs = append(gaugeVecs, gaugeVecFunc{name: name, help: help, label: label, values: values})
+}
+
+func registerCounterVec(name string, help string, label string) *counterVec {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	counter := &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+	counters = append(counters, counter)
+	return counter
+}
+
+func (c *counterVec) Inc(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value]++
+}
+
+func (c *counterVec) write(w http.ResponseWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", c.name, c.label, key, c.values[key])
+	}
+}
+
+func (g gaugeVecFunc) write(w http.ResponseWriter) {
+	values := g.values()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", g.name, g.label, key, values[key])
+	}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, gauge := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n", gauge.name, gauge.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", gauge.name)
+		fmt.Fprintf(w, "%s %g\n", gauge.name, gauge.value())
+	}
+	for _, gauge := range gaugeVecs {
+		gauge.write(w)
+	}
+	for _, counter := range counters {
+		counter.write(w)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// middleware wraps a handler with behavior shared by several endpoints.
+type middleware func(http.Handler) http.Handler
+
+// chain composes middlewares so that the first listed runs first, i.e. is
+// outermost. Panic recovery always wraps the whole chain, so a panic in any
+// middleware is answered with a 500 as well.
+func chain(middlewares ...middleware) middleware {
+	return func(h http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+		return panicHandler(h)
+	}
+}
+
+// publicMiddleware is the chain for endpoints the form calls, in order:
+// panic recovery, CORS headers and preflights, then the origin check when
+// MAILER_ENFORCE_ORIGIN is set.
+func publicMiddleware() middleware {
+	middlewares := []middleware{corsHandler}
+	if enforceOrigin {
+		middlewares = append(middlewares, originHandler)
+	}
+	return chain(middlewares...)
+}
+
+// operationalMiddleware is the chain for operational endpoints: panic
+// recovery only.
+func operationalMiddleware() middleware {
+	return chain()
+}
+
+// corsHandler sets the CORS headers for the whitelisted origin and answers
+// preflight requests itself.
+func corsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if varyOrigin {
+			w.Header().Add("Vary", "Origin")
+		}
+		origin := r.Header.Get("Origin")
+		matched := origin != "" && origin == whitelistedDomain
+		if matched && requireOriginMatch {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == "OPTIONS" {
+			if matched {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", "POST")
+				w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Content-Encoding")
+			}
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// originHandler rejects requests whose Origin is not allowed.
+func originHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !originAllowed(r) {
+			droppedTotal.Inc("origin")
+			log.Printf("Rejected request from origin %q, client_ip: %s\n", r.Header.Get("Origin"), clientIP(r))
+			writeError(w, r, http.StatusForbidden, "origin is not allowed")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// panicHandler turns a panic in h into a 500 response.
+func panicHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer func() {
+			recovery := recover()
+			if recovery != nil {
+				switch val := recovery.(type) {
+				case string:
+					err = errors.New(val)
+				case error:
+					err = val
+				default:
+					err = errors.New("Unknown error")
+				}
+				log.Printf("Recovered from panic: %s\n", err.Error())
+				writeError(w, r, http.StatusInternalServerError, "")
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// originAllowed reports whether a request's Origin matches the whitelist.
+// Requests without one, such as server-to-server calls, pass only when
+// allowNoOrigin is set.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return allowNoOrigin
+	}
+	return origin == whitelistedDomain
+}
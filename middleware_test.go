@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveCORS(method string, origin string) *httptest.ResponseRecorder {
+	h := corsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	r := httptest.NewRequest(method, "/send", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func setupCORS(t *testing.T, require bool) {
+	t.Helper()
+	whitelistedDomain = "https://www.example.com"
+	requireOriginMatch = require
+	varyOrigin = true
+	t.Cleanup(func() {
+		whitelistedDomain = ""
+		requireOriginMatch, varyOrigin = false, false
+	})
+}
+
+func TestCORSRequireOriginMatch(t *testing.T) {
+	setupCORS(t, true)
+
+	for _, method := range []string{"OPTIONS", "POST"} {
+		w := serveCORS(method, "https://www.example.com")
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://www.example.com" {
+			t.Errorf("%s from the matched origin: Access-Control-Allow-Origin = %q", method, got)
+		}
+		if w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("%s from the matched origin did not allow credentials", method)
+		}
+
+		w = serveCORS(method, "https://evil.example.net")
+		for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Allow-Methods"} {
+			if got := w.Header().Get(header); got != "" {
+				t.Errorf("%s from an unmatched origin got %s: %q", method, header, got)
+			}
+		}
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s from an unmatched origin lacks Vary: Origin", method)
+		}
+	}
+}
+
+func TestCORSWithoutRequireOriginMatch(t *testing.T) {
+	setupCORS(t, false)
+
+	w := serveCORS("OPTIONS", "https://www.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://www.example.com" || w.Header().Get("Access-Control-Allow-Methods") != "POST" {
+		t.Errorf("preflight from the matched origin got %v", w.Header())
+	}
+	if got := serveCORS("POST", "https://www.example.com").Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("credentials allowed without MAILER_REQUIRE_ORIGIN_MATCH: %q", got)
+	}
+	if got := serveCORS("OPTIONS", "https://evil.example.net").Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("preflight from an unmatched origin allowed %q", got)
+	}
+
+	varyOrigin = false
+	if got := serveCORS("POST", "https://www.example.com").Header().Get("Vary"); got != "" {
+		t.Errorf("MAILER_CORS_VARY=false still sent Vary: %q", got)
+	}
+}
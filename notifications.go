@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snsTopicARNs lists the SNS topics whose notifications are accepted at
+// /notifications/sns. The endpoint is disabled while it is empty.
+var snsTopicARNs map[string]bool
+
+// mailgunWebhookKey is Mailgun's webhook signing key, which enables
+// /notifications/mailgun.
+var mailgunWebhookKey string
+
+// notificationsTotal counts the addresses suppressed by each provider's
+// notifications.
+var notificationsTotal = registerCounterVec("mailer_suppressions_total", "Addresses suppressed from bounce and complaint notifications, by provider.", "provider")
+
+// NotificationsHandler receives bounce and complaint notifications from
+// the provider named in the path and adds the addresses to suppressions.
+type NotificationsHandler struct{}
+
+func (h *NotificationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	provider := strings.TrimPrefix(r.URL.Path, "/notifications/")
+	var receive func(body []byte) ([]string, string, error)
+	switch {
+	case provider == "sns" && snsTopicARNs != nil:
+		receive = receiveSNS
+	case provider == "mailgun" && mailgunWebhookKey != "":
+		receive = receiveMailgun
+	default:
+		writeError(w, r, http.StatusNotFound, "")
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 256<<10))
+	if err != nil {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	addresses, reason, err := receive(body)
+	if errors.Is(err, errBadSignature) {
+		log.Printf("Rejected %s notification, client_ip: %s: %s\n", provider, clientIP(r), err.Error())
+		writeError(w, r, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, address := range addresses {
+		log.Printf("Suppressing %s after %s notification from %s\n", address, reason, provider)
+		if err := suppressions.Add(address, reason); err != nil {
+			log.Printf("Unable to persist suppression of %s: %s\n", address, err.Error())
+		}
+		notificationsTotal.Inc(provider)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errBadSignature = errors.New("invalid signature")
+
+// snsMessage is the envelope SNS posts to HTTP subscribers.
+type snsMessage struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+	SubscribeURL     string
+}
+
+// sesNotification is the part of an SES bounce or complaint notification
+// carried in an SNS message that names the affected addresses. Event
+// publishing sets eventType instead of notificationType.
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Bounce           struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// receiveSNS verifies an SNS message, confirms subscriptions to a listed
+// topic, and returns the addresses from SES permanent bounces and
+// complaints.
+func receiveSNS(body []byte) ([]string, string, error) {
+	var message snsMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, "", fmt.Errorf("malformed SNS message: %s", err)
+	}
+	if !snsTopicARNs[message.TopicArn] {
+		return nil, "", fmt.Errorf("%w: topic %q is not accepted", errBadSignature, message.TopicArn)
+	}
+	if err := message.verify(); err != nil {
+		return nil, "", err
+	}
+
+	switch message.Type {
+	case "SubscriptionConfirmation":
+		resp, err := httpClient.Get(message.SubscribeURL)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to confirm subscription: %s", err)
+		}
+		resp.Body.Close()
+		log.Printf("Confirmed SNS subscription to %s\n", message.TopicArn)
+		return nil, "", nil
+	case "Notification":
+	default:
+		return nil, "", nil
+	}
+
+	var notification sesNotification
+	if err := json.Unmarshal([]byte(message.Message), &notification); err != nil {
+		return nil, "", fmt.Errorf("malformed SES notification: %s", err)
+	}
+	kind := notification.NotificationType
+	if kind == "" {
+		kind = notification.EventType
+	}
+	var addresses []string
+	switch kind {
+	case "Bounce":
+		// Transient bounces, such as a full mailbox, may clear up.
+		if notification.Bounce.BounceType != "Permanent" {
+			return nil, "", nil
+		}
+		for _, recipient := range notification.Bounce.BouncedRecipients {
+			addresses = append(addresses, recipient.EmailAddress)
+		}
+		return addresses, "bounce", nil
+	case "Complaint":
+		for _, recipient := range notification.Complaint.ComplainedRecipients {
+			addresses = append(addresses, recipient.EmailAddress)
+		}
+		return addresses, "complaint", nil
+	}
+	return nil, "", nil
+}
+
+// snsCertHost matches the hosts SNS serves its signing certificates from.
+var snsCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var snsCerts sync.Map
+
+// verify checks the message's signature against the SNS certificate it
+// names, as described in the SNS developer guide.
+func (m *snsMessage) verify() error {
+	var hash crypto.Hash
+	switch m.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("%w: unsupported SignatureVersion %q", errBadSignature, m.SignatureVersion)
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBadSignature, err)
+	}
+	key, err := snsSigningKey(m.SigningCertURL)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBadSignature, err)
+	}
+
+	fields := []string{"Message", m.Message, "MessageId", m.MessageId}
+	if m.Type == "Notification" {
+		if m.Subject != "" {
+			fields = append(fields, "Subject", m.Subject)
+		}
+		fields = append(fields, "Timestamp", m.Timestamp, "TopicArn", m.TopicArn, "Type", m.Type)
+	} else {
+		fields = append(fields, "SubscribeURL", m.SubscribeURL, "Timestamp", m.Timestamp,
+			"Token", m.Token, "TopicArn", m.TopicArn, "Type", m.Type)
+	}
+	var canonical strings.Builder
+	for _, field := range fields {
+		canonical.WriteString(field)
+		canonical.WriteByte('\n')
+	}
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum([]byte(canonical.String()))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256([]byte(canonical.String()))
+		digest = sum[:]
+	}
+	if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+		return errBadSignature
+	}
+	return nil
+}
+
+// snsSigningKey fetches, and caches, the public key of an SNS signing
+// certificate after checking that the URL points at SNS.
+func snsSigningKey(certURL string) (*rsa.PublicKey, error) {
+	if key, ok := snsCerts.Load(certURL); ok {
+		return key.(*rsa.PublicKey), nil
+	}
+	parsed, err := url.Parse(certURL)
+	if err != nil || parsed.Scheme != "https" || !snsCertHost.MatchString(parsed.Hostname()) {
+		return nil, fmt.Errorf("SigningCertURL %q is not an SNS certificate", certURL)
+	}
+	resp, err := httpClient.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch signing certificate: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("signing certificate does not hold an RSA key")
+	}
+	snsCerts.Store(certURL, key)
+	return key, nil
+}
+
+// mailgunEvent is the part of a Mailgun webhook payload the mailer reads.
+type mailgunEvent struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event     string `json:"event"`
+		Severity  string `json:"severity"`
+		Recipient string `json:"recipient"`
+	} `json:"event-data"`
+}
+
+// mailgunSignatureAge bounds how old a webhook's timestamp may be, which
+// limits how long a captured payload can be replayed.
+const mailgunSignatureAge = 15 * time.Minute
+
+// receiveMailgun verifies a Mailgun webhook and returns the recipient of a
+// permanent failure or complaint.
+func receiveMailgun(body []byte) ([]string, string, error) {
+	var event mailgunEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, "", fmt.Errorf("malformed Mailgun webhook: %s", err)
+	}
+	signature := event.Signature
+	mac := hmac.New(sha256.New, []byte(mailgunWebhookKey))
+	mac.Write([]byte(signature.Timestamp + signature.Token))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature.Signature)) {
+		return nil, "", errBadSignature
+	}
+	seconds, err := strconv.ParseInt(signature.Timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(seconds, 0)).Abs() > mailgunSignatureAge {
+		return nil, "", fmt.Errorf("%w: timestamp is too old", errBadSignature)
+	}
+
+	switch {
+	case event.EventData.Event == "failed" && event.EventData.Severity == "permanent":
+		return []string{event.EventData.Recipient}, "bounce", nil
+	case event.EventData.Event == "complained":
+		return []string{event.EventData.Recipient}, "complaint", nil
+	}
+	return nil, "", nil
+}
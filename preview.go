@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// PreviewHandler renders a submission exactly as /send would and returns
+// the message instead of delivering it, for checking templates and
+// headers against real input.
+type PreviewHandler struct{}
+
+func (h *PreviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	message, ok := readSubmission(w, r)
+	if !ok {
+		return
+	}
+	defer message.cleanup()
+	if !applyRoute(w, r, message) {
+		return
+	}
+	if !message.recipientAllowed() {
+		writeError(w, r, http.StatusForbidden, "recipient is not allowed")
+		return
+	}
+
+	msg, err := message.ConstructMessage()
+	var sizeErr *messageSizeError
+	if errors.As(err, &sizeErr) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Unable to render preview: %s\n", err.Error())
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Write(msg)
+}
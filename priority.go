@@ -0,0 +1,27 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const priorityHigh = "high"
+
+// priorityAging is how overdue a normal message may get before it is
+// dispatched alongside high-priority ones, so a steady stream of
+// high-priority mail cannot starve the rest of a backlog.
+var priorityAging = 15 * time.Minute
+
+// orderDue sorts a claimed batch so that high-priority and long-overdue
+// messages are dispatched first, oldest first within each group.
+func orderDue(due []*scheduledMessage, now time.Time) {
+	urgent := func(message *scheduledMessage) bool {
+		return message.Priority == priorityHigh || now.Sub(message.SendAt) >= priorityAging
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		if a, b := urgent(due[i]), urgent(due[j]); a != b {
+			return a
+		}
+		return due[i].SendAt.Before(due[j].SendAt)
+	})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeProxy relays connections to the target its client asks for and
+// records the targets.
+type fakeProxy struct {
+	listener  net.Listener
+	handshake func(conn net.Conn, reader *bufio.Reader) (string, bool)
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func startFakeProxy(t *testing.T, handshake func(conn net.Conn, reader *bufio.Reader) (string, bool)) *fakeProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProxy{listener: listener, handshake: handshake}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	target, ok := p.handshake(conn, reader)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, reader)
+	io.Copy(conn, upstream)
+}
+
+func (p *fakeProxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// socks5Handshake accepts username/password auth (RFC 1929) for
+// user:secret and a CONNECT to an IPv4 address or a domain name.
+func socks5Handshake(conn net.Conn, reader *bufio.Reader) (string, bool) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return "", false
+	}
+	methods := make([]byte, head[1])
+	io.ReadFull(reader, methods)
+	conn.Write([]byte{5, 2})
+
+	version, _ := reader.ReadByte()
+	userLen, _ := reader.ReadByte()
+	user := make([]byte, userLen)
+	io.ReadFull(reader, user)
+	passLen, _ := reader.ReadByte()
+	pass := make([]byte, passLen)
+	io.ReadFull(reader, pass)
+	if version != 1 || string(user) != "user" || string(pass) != "secret" {
+		conn.Write([]byte{1, 1})
+		return "", false
+	}
+	conn.Write([]byte{1, 0})
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil || request[1] != 1 {
+		return "", false
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length, _ := reader.ReadByte()
+		name := make([]byte, length)
+		io.ReadFull(reader, name)
+		host = string(name)
+	default:
+		return "", false
+	}
+	port := make([]byte, 2)
+	io.ReadFull(reader, port)
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), true
+}
+
+// connectHandshake accepts an HTTP CONNECT carrying Basic credentials.
+func connectHandshake(conn net.Conn, reader *bufio.Reader) (string, bool) {
+	req, err := http.ReadRequest(reader)
+	if err != nil || req.Method != "CONNECT" {
+		return "", false
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", false
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, true
+}
+
+func sendThroughProxy(t *testing.T, proxyURL string, server *fakeSMTPServer) error {
+	t.Helper()
+	dialer, err := newSMTPProxy(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpProxy = dialer
+	defer func() { smtpProxy = nil }()
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com"}}
+	_, err = sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage))
+	return err
+}
+
+func TestSendMailThroughSOCKS5Proxy(t *testing.T) {
+	server := startFakeSMTP(t)
+	proxy := startFakeProxy(t, socks5Handshake)
+
+	if err := sendThroughProxy(t, "socks5://user:secret@"+proxy.listener.Addr().String(), server); err != nil {
+		t.Fatal(err)
+	}
+	if targets := proxy.Targets(); len(targets) != 1 || targets[0] != server.Addr() {
+		t.Errorf("proxy was asked for %v, want %s", targets, server.Addr())
+	}
+	if len(server.Messages()) != 1 {
+		t.Error("the message did not arrive through the proxy")
+	}
+
+	if err := sendThroughProxy(t, "socks5://user:wrong@"+proxy.listener.Addr().String(), server); err == nil {
+		t.Error("sent through a proxy that refused the credentials")
+	}
+}
+
+func TestSendMailThroughHTTPConnectProxy(t *testing.T) {
+	server := startFakeSMTP(t)
+	proxy := startFakeProxy(t, connectHandshake)
+
+	if err := sendThroughProxy(t, "http://user:secret@"+proxy.listener.Addr().String(), server); err != nil {
+		t.Fatal(err)
+	}
+	if targets := proxy.Targets(); len(targets) != 1 || targets[0] != server.Addr() {
+		t.Errorf("proxy was asked for %v, want %s", targets, server.Addr())
+	}
+	if len(server.Messages()) != 1 {
+		t.Error("the message did not arrive through the proxy")
+	}
+
+	if err := sendThroughProxy(t, "http://"+proxy.listener.Addr().String(), server); err == nil {
+		t.Error("sent through a proxy that asked for credentials")
+	}
+}
+
+func TestNewSMTPProxyRejectsUnknownScheme(t *testing.T) {
+	if _, err := newSMTPProxy("ftp://proxy.example.com:21"); err == nil {
+		t.Error("accepted an ftp proxy")
+	}
+}
+
+// fakeDNS answers A and AAAA queries for any name with one loopback
+// address of each family, over the stream framing Go uses for a
+// connection that is not a PacketConn.
+func fakeDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		for {
+			var length [2]byte
+			if _, err := io.ReadFull(server, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(server, query); err != nil {
+				return
+			}
+			end := 12
+			for end < len(query) && query[end] != 0 {
+				end += int(query[end]) + 1
+			}
+			end += 5
+			qtype := binary.BigEndian.Uint16(query[end-4:])
+			answer := map[uint16]net.IP{1: net.IPv4(127, 0, 0, 1).To4(), 28: net.IPv6loopback}[qtype]
+
+			reply := append([]byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, query[12:end]...)
+			if answer != nil {
+				reply[7] = 1
+				reply = append(reply, 0xc0, 12)
+				reply = binary.BigEndian.AppendUint16(reply, qtype)
+				reply = append(reply, 0, 1, 0, 0, 0, 60)
+				reply = binary.BigEndian.AppendUint16(reply, uint16(len(answer)))
+				reply = append(reply, answer...)
+			}
+			framed := binary.BigEndian.AppendUint16(nil, uint16(len(reply)))
+			if _, err := server.Write(append(framed, reply...)); err != nil {
+				return
+			}
+		}
+	}()
+	return client, nil
+}
+
+// listenDualStack listens on the same port on 127.0.0.1 and ::1.
+func listenDualStack(t *testing.T) (ipv4, ipv6 net.Listener) {
+	t.Helper()
+	for tries := 0; tries < 10; tries++ {
+		ipv4, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(ipv4.Addr().String())
+		ipv6, err := net.Listen("tcp6", net.JoinHostPort("::1", port))
+		if err == nil {
+			t.Cleanup(func() { ipv4.Close(); ipv6.Close() })
+			return ipv4, ipv6
+		}
+		ipv4.Close()
+	}
+	t.Skip("no port free on both 127.0.0.1 and ::1")
+	return nil, nil
+}
+
+func TestSMTPDialerFasterAddressWins(t *testing.T) {
+	ipv4, ipv6 := listenDualStack(t)
+	for _, listener := range []net.Listener{ipv4, ipv6} {
+		go func(listener net.Listener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}(listener)
+	}
+	_, port, _ := net.SplitHostPort(ipv4.Addr().String())
+	dialFallbackDelay = 20 * time.Millisecond
+	defer func() { dialFallbackDelay = 0 }()
+
+	for _, slow := range []string{"tcp6", "tcp4"} {
+		dialer := smtpDialer()
+		dialer.Resolver = &net.Resolver{PreferGo: true, Dial: fakeDNS}
+		// The slow family stalls before connecting until the race is won
+		// by the other one.
+		dialer.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if network != slow {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}
+		start := time.Now()
+		conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("mx.example.test", port))
+		if err != nil {
+			t.Fatalf("slow %s: %v", slow, err)
+		}
+		remote := conn.RemoteAddr().(*net.TCPAddr)
+		conn.Close()
+		if isIPv4 := remote.IP.To4() != nil; isIPv4 == (slow == "tcp4") {
+			t.Errorf("slow %s: connected to %s, want the other family", slow, remote)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("slow %s: connecting took %s, want the faster address used without waiting", slow, elapsed)
+		}
+	}
+}
+
+func TestSMTPDialerBindsSourceIP(t *testing.T) {
+	if dialer := smtpDialer(); dialer.LocalAddr != nil {
+		t.Errorf("LocalAddr = %v without a source IP", dialer.LocalAddr)
+	}
+
+	sourceIP = net.ParseIP("127.0.0.2")
+	defer func() { sourceIP = nil }()
+	dialer := smtpDialer()
+	if local, ok := dialer.LocalAddr.(*net.TCPAddr); !ok || !local.IP.Equal(sourceIP) {
+		t.Fatalf("LocalAddr = %v, want %s", dialer.LocalAddr, sourceIP)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+	conn, err := dialSMTP(context.Background(), listener.Addr().String())
+	if err != nil {
+		// Not every host routes all of 127.0.0.0/8 to the loopback.
+		t.Skipf("unable to dial from %s: %v", sourceIP, err)
+	}
+	conn.Close()
+	if remote := (<-accepted).(*net.TCPAddr); !remote.IP.Equal(sourceIP) {
+		t.Errorf("the server saw a connection from %s, want %s", remote.IP, sourceIP)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// queueBackend stores messages waiting to be sent. Claim hands due messages
+// to exactly one consumer: a claimed message stays hidden from other
+// consumers until visibility elapses, after which it is handed out again
+// unless it has been acked.
+type queueBackend interface {
+	// Push stores message, taking ownership of its attachment files.
+	Push(message *scheduledMessage) error
+	// Claim hands out at most limit due messages, in the order orderDue
+	// gives.
+	Claim(now time.Time, visibility time.Duration, limit int) ([]*scheduledMessage, error)
+	// NextDue reports when the earliest unclaimed message becomes due.
+	NextDue() (time.Time, bool, error)
+	Ack(message *scheduledMessage) error
+	// Expedite makes every unclaimed message matching filter due at now
+	// and reports how many it changed.
+	Expedite(now time.Time, filter func(*scheduledMessage) bool) (int, error)
+}
+
+// localQueue keeps messages in memory and, when dir is set, mirrors each one
+// to disk so a restart does not lose them. It serves a single instance.
+type localQueue struct {
+	mu      sync.Mutex
+	dir     string
+	pending map[string]*scheduledMessage
+	claimed map[string]time.Time
+}
+
+func newLocalQueue(dir string) (*localQueue, error) {
+	q := &localQueue{
+		dir:     dir,
+		pending: make(map[string]*scheduledMessage),
+		claimed: make(map[string]time.Time),
+	}
+	if dir == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var scheduled scheduledMessage
+		if err := json.Unmarshal(data, &scheduled); err != nil {
+			log.Printf("Skipping unreadable queued message %s: %s\n", path, err.Error())
+			continue
+		}
+		q.pending[scheduled.ID] = &scheduled
+	}
+	if len(q.pending) > 0 {
+		log.Printf("Restored %d queued messages from %s\n", len(q.pending), dir)
+	}
+	return q, nil
+}
+
+func (q *localQueue) Push(message *scheduledMessage) error {
+	if q.dir != "" {
+		for i := range message.Attachments {
+			attachment := &message.Attachments[i]
+			path := filepath.Join(q.dir, message.ID+"-"+strconv.Itoa(i)+".part")
+			if err := moveFile(attachment.Path, path); err != nil {
+				return err
+			}
+			attachment.Path = path
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(q.dir, message.ID+".json"), data); err != nil {
+			return err
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending[message.ID] = message
+	return nil
+}
+
+func (q *localQueue) Claim(now time.Time, visibility time.Duration, limit int) ([]*scheduledMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []*scheduledMessage
+	for id, message := range q.pending {
+		if until, ok := q.claimed[id]; ok && now.Before(until) {
+			continue
+		}
+		if !message.SendAt.After(now) {
+			due = append(due, message)
+		}
+	}
+	orderDue(due, now)
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, message := range due {
+		q.claimed[message.ID] = now.Add(visibility)
+	}
+	return due, nil
+}
+
+func (q *localQueue) NextDue() (time.Time, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var next time.Time
+	found := false
+	for id, message := range q.pending {
+		due := message.SendAt
+		if until, ok := q.claimed[id]; ok {
+			due = until
+		}
+		if !found || due.Before(next) {
+			next, found = due, true
+		}
+	}
+	return next, found, nil
+}
+
+func (q *localQueue) Expedite(now time.Time, filter func(*scheduledMessage) bool) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := 0
+	for id, message := range q.pending {
+		if _, ok := q.claimed[id]; ok || !message.SendAt.After(now) || !filter(message) {
+			continue
+		}
+		message.SendAt = now
+		count++
+	}
+	return count, nil
+}
+
+func (q *localQueue) Ack(message *scheduledMessage) error {
+	q.mu.Lock()
+	delete(q.pending, message.ID)
+	delete(q.claimed, message.ID)
+	q.mu.Unlock()
+
+	if q.dir != "" {
+		return os.Remove(filepath.Join(q.dir, message.ID+".json"))
+	}
+	return nil
+}
+
+// writeFileAtomic writes data via a temp file and rename so readers never
+// observe a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// moveFile renames src to dst, copying when they are on different devices.
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dailySendQuota caps the messages sent per UTC day. When nil there is no
+// cap.
+var dailySendQuota *dailyQuota
+
+var errQuotaExceeded = errors.New("daily send quota exceeded")
+
+// quotaCounter stores the per-day send count alongside the queue, so the
+// count survives restarts whenever the queue does.
+type quotaCounter interface {
+	Used(day string) (int, error)
+	// Add counts one send on day and returns the new total.
+	Add(day string) (int, error)
+}
+
+type dailyQuota struct {
+	limit   int
+	counter quotaCounter
+}
+
+func newDailyQuota(limit int, counter quotaCounter) *dailyQuota {
+	return &dailyQuota{limit: limit, counter: counter}
+}
+
+func quotaDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// Take counts a send against today's quota, failing once it is used up.
+func (q *dailyQuota) Take(now time.Time) error {
+	used, err := q.counter.Add(quotaDay(now))
+	if err != nil {
+		return err
+	}
+	if used > q.limit {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// Exhausted reports whether today's quota is used up. Errors reading the
+// count are treated as not exhausted; Take still enforces the cap.
+func (q *dailyQuota) Exhausted(now time.Time) bool {
+	used, err := q.counter.Used(quotaDay(now))
+	return err == nil && used >= q.limit
+}
+
+func (q *dailyQuota) Remaining(now time.Time) int {
+	used, err := q.counter.Used(quotaDay(now))
+	if err != nil || used >= q.limit {
+		return 0
+	}
+	return q.limit - used
+}
+
+// ResetIn is the time left until the quota resets at UTC midnight.
+func (q *dailyQuota) ResetIn(now time.Time) time.Duration {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return midnight.Sub(now)
+}
+
+// localQuota counts in memory and, when path is set, mirrors the count to
+// disk.
+type localQuota struct {
+	mu    sync.Mutex
+	path  string
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+func newLocalQuota(path string) (*localQuota, error) {
+	q := &localQuota{path: path}
+	if path == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *localQuota) Used(day string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.Day != day {
+		return 0, nil
+	}
+	return q.Count, nil
+}
+
+func (q *localQuota) Add(day string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.Day != day {
+		q.Day, q.Count = day, 0
+	}
+	q.Count++
+	if q.path != "" {
+		data, err := json.Marshal(q)
+		if err != nil {
+			return q.Count, err
+		}
+		if err := writeFileAtomic(q.path, data); err != nil {
+			return q.Count, err
+		}
+	}
+	return q.Count, nil
+}
+
+// redisQuota shares one count between every instance using the Redis.
+type redisQuota struct {
+	client *redisClient
+	prefix string
+}
+
+func newRedisQuota(client *redisClient, prefix string) *redisQuota {
+	return &redisQuota{client: client, prefix: prefix}
+}
+
+func (q *redisQuota) key(day string) string { return q.prefix + "quota:" + day }
+
+func (q *redisQuota) Used(day string) (int, error) {
+	reply, err := q.client.Do("GET", q.key(day))
+	if err != nil {
+		return 0, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func (q *redisQuota) Add(day string) (int, error) {
+	reply, err := q.client.Do("INCR", q.key(day))
+	if err != nil {
+		return 0, err
+	}
+	// Keys outlive their day slightly so late readers still see them.
+	if _, err := q.client.Do("EXPIRE", q.key(day), "172800"); err != nil {
+		return 0, err
+	}
+	count, _ := reply.(int64)
+	return int(count), nil
+}
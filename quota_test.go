@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaTakenOncePerMessage(t *testing.T) {
+	setupSendHandler(t)
+	counter, _ := newLocalQuota("")
+	dailySendQuota = newDailyQuota(10, counter)
+	defer func() { dailySendQuota = nil }()
+
+	message := &Email{From: "visitor@example.org", Body: "hello"}
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := message.Send(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		// A retry goes through the queue, which must keep the flag.
+		scheduled := &scheduledMessage{QuotaTaken: message.QuotaTaken}
+		message.QuotaTaken = scheduled.email().QuotaTaken
+	}
+	if used, _ := counter.Used(quotaDay(time.Now())); used != 1 {
+		t.Errorf("quota used %d times for one message, want 1", used)
+	}
+}
+
+func TestQuotaNotTakenWhenMessageDoesNotBuild(t *testing.T) {
+	setupSendHandler(t)
+	maxMessageBytes = 16
+	counter, _ := newLocalQuota("")
+	dailySendQuota = newDailyQuota(10, counter)
+	defer func() { dailySendQuota = nil }()
+
+	message := &Email{From: "visitor@example.org", Body: strings.Repeat("x", 64)}
+	var sizeErr *messageSizeError
+	if _, err := message.Send(context.Background()); !errors.As(err, &sizeErr) {
+		t.Fatalf("Send = %v, want a message size error", err)
+	}
+	if used, _ := counter.Used(quotaDay(time.Now())); used != 0 {
+		t.Errorf("quota used %d times by a message that never built", used)
+	}
+}
+
+func TestQuotaRefusalLeavesDeliveryHealthAlone(t *testing.T) {
+	fake := setupSendHandler(t)
+	counter, _ := newLocalQuota("")
+	dailySendQuota = newDailyQuota(1, counter)
+	dailySendQuota.Take(time.Now())
+	recentFailures = newFailureBuffer(10)
+	// deliveryHealth is reset in place, since deliveries from earlier
+	// tests may still be reading it.
+	setHealth := func(threshold int, cooldown time.Duration) {
+		deliveryHealth.mu.Lock()
+		defer deliveryHealth.mu.Unlock()
+		deliveryHealth.threshold, deliveryHealth.cooldown, deliveryHealth.failures = threshold, cooldown, 0
+	}
+	setHealth(1, time.Hour)
+	defer func() {
+		dailySendQuota, recentFailures = nil, nil
+		setHealth(0, 0)
+	}()
+
+	for i := 0; i < 3; i++ {
+		if outcome := deliver(&Email{From: "visitor@example.org", Body: "hello"}); outcome != outcomeFailed {
+			t.Fatalf("deliver over the quota = %v, want the message given up on", outcome)
+		}
+	}
+	if fake.count() != 0 {
+		t.Error("a message over the quota was sent")
+	}
+	if degraded, _ := deliveryHealth.Degraded(time.Now()); degraded {
+		t.Error("refusals by the quota marked delivery as degraded")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spoolRateLimited hands a message whose send deadline passes while it
+// waits for the rate limiter to the scheduler, to be sent once a token is
+// due, instead of dropping it.
+var spoolRateLimited = true
+
+// rateLimitedError reports a send that gave up waiting for a token.
+// retryAfter is when the bucket expects to have one.
+type rateLimitedError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, next send possible in %s", e.retryAfter.Round(time.Second))
+}
+
+// tokenBucket is a token-bucket limiter whose callers queue for the next
+// token rather than being rejected outright.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64 // tokens per second
+	burst    float64
+	tokens   float64
+	last     time.Time
+	inFlight int
+}
+
+func newTokenBucket(count int, per time.Duration) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(count) / per.Seconds(),
+		burst:  float64(count),
+		tokens: float64(count),
+		last:   time.Now(),
+	}
+}
+
+// parseRate parses a rate such as "100/h", "5/s" or "30/10m".
+func parseRate(spec string) (int, time.Duration, error) {
+	tokens := strings.SplitN(spec, "/", 2)
+	if len(tokens) != 2 {
+		return 0, 0, fmt.Errorf("rate %q must look like 100/h", spec)
+	}
+	count, err := strconv.Atoi(tokens[0])
+	if err != nil || count <= 0 {
+		return 0, 0, fmt.Errorf("rate %q must have a positive count", spec)
+	}
+	unit := tokens[1]
+	if unit != "" && (unit[0] < '0' || unit[0] > '9') {
+		unit = "1" + unit
+	}
+	per, err := time.ParseDuration(unit)
+	if err != nil || per <= 0 {
+		return 0, 0, fmt.Errorf("rate %q must have a positive period", spec)
+	}
+	return count, per, nil
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Wait blocks until a token is available or ctx is done. A caller that gives
+// up returns its reserved token to the bucket.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens--
+	if b.tokens >= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.inFlight++
+	b.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		b.mu.Lock()
+		b.inFlight--
+		b.mu.Unlock()
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.inFlight--
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Delay reports how long until the bucket has a token free, counting
+// the sends already queued for one.
+func (b *tokenBucket) Delay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Utilization reports the fraction of the burst currently consumed. Values
+// above 1 mean sends are queued waiting for tokens.
+func (b *tokenBucket) Utilization() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return (b.burst - b.tokens) / b.burst
+}
+
+// Waiting reports how many sends are currently queued for a token.
+func (b *tokenBucket) Waiting() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inFlight
+}
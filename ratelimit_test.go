@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliverSpoolsRateLimitedMessage(t *testing.T) {
+	fake := setupSendHandler(t)
+	sendDeadline = 20 * time.Millisecond
+	globalRateLimit = newTokenBucket(1, time.Hour)
+	globalRateLimit.tokens = 0
+	defer func() { globalRateLimit = nil }()
+
+	message := &Email{From: "visitor@example.org", Body: "hello"}
+	if outcome := deliver(message); outcome != outcomeDeferred {
+		t.Fatalf("deliver = %v, want the message deferred", outcome)
+	}
+	if fake.count() != 0 {
+		t.Error("the message was sent without a token")
+	}
+	next, ok, err := messageScheduler.backend.NextDue()
+	if err != nil || !ok {
+		t.Fatalf("the message was not spooled: %v", err)
+	}
+	if wait := time.Until(next); wait < 50*time.Minute || wait > time.Hour {
+		t.Errorf("spooled for %s from now, want about when the next token is due", wait)
+	}
+	if message.Attempts != 0 {
+		t.Errorf("attempts = %d, want the wait not counted as an attempt", message.Attempts)
+	}
+}
+
+func TestDeliverDropsRateLimitedMessageWhenConfigured(t *testing.T) {
+	fake := setupSendHandler(t)
+	sendDeadline = 20 * time.Millisecond
+	globalRateLimit = newTokenBucket(1, time.Hour)
+	globalRateLimit.tokens = 0
+	spoolRateLimited = false
+	recentFailures = newFailureBuffer(10)
+	defer func() { globalRateLimit, spoolRateLimited, recentFailures = nil, true, nil }()
+
+	if outcome := deliver(&Email{From: "visitor@example.org", Body: "hello"}); outcome != outcomeFailed {
+		t.Fatalf("deliver = %v, want the message given up on", outcome)
+	}
+	if fake.count() != 0 {
+		t.Error("the message was sent without a token")
+	}
+	if _, ok, _ := messageScheduler.backend.NextDue(); ok {
+		t.Error("the message was spooled with MAILER_RATE_LIMIT_ACTION=drop")
+	}
+	if failures := recentFailures.Snapshot(); len(failures) != 1 {
+		t.Errorf("recorded %d failures, want the dropped message", len(failures))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// allowedRecipients maps the keys a client may pass as To onto the
+// addresses they deliver to. When nil, every message goes to inboxAddress.
+var allowedRecipients map[string]string
+
+// parseAllowedRecipients parses a MAILER_ALLOWED_RECIPIENTS spec such as
+// "sales=sales@example.com,support@example.com". A bare address is its own
+// key.
+func parseAllowedRecipients(spec string) (map[string]string, error) {
+	recipients := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		key, address := entry, entry
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			key, address = entry[:i], entry[i+1:]
+		}
+		parsed, err := mail.ParseAddress(address)
+		if err != nil || parsed.Address != address || key == "" {
+			return nil, fmt.Errorf("invalid recipient %q", entry)
+		}
+		normalized, _, err := normalizeAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		recipients[key] = normalized
+	}
+	return recipients, nil
+}
+
+// recipient resolves the address this message is delivered to.
+func (m *Email) recipient() string {
+	if selected, ok := routes[m.To]; ok {
+		return selected.To
+	}
+	if address, ok := allowedRecipients[m.To]; ok {
+		return address
+	}
+	return inboxAddress
+}
+
+// recipientAllowed reports whether the client-chosen To is permitted. It is
+// ignored entirely when no allowlist is configured.
+func (m *Email) recipientAllowed() bool {
+	if allowedRecipients == nil || m.To == "" {
+		return true
+	}
+	if _, ok := routes[m.To]; ok {
+		return true
+	}
+	_, ok := allowedRecipients[m.To]
+	return ok
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal RESP client supporting the handful of commands
+// the queue needs. Commands are serialized over a single connection that is
+// re-established after any error.
+type redisClient struct {
+	mu       sync.Mutex
+	address  string
+	useTLS   bool
+	password string
+	username string
+	db       int
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// newRedisClient parses a redis:// or rediss:// URL of the form
+// redis://[user:password@]host[:port][/db].
+func newRedisClient(rawURL string) (*redisClient, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	client := &redisClient{address: parsed.Host}
+	switch parsed.Scheme {
+	case "redis":
+	case "rediss":
+		client.useTLS = true
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", parsed.Scheme)
+	}
+	if parsed.Port() == "" {
+		client.address = net.JoinHostPort(parsed.Hostname(), "6379")
+	}
+	if parsed.User != nil {
+		client.username = parsed.User.Username()
+		client.password, _ = parsed.User.Password()
+	}
+	if db := strings.TrimPrefix(parsed.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return client, nil
+}
+
+func (c *redisClient) connect() error {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.address)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := c.roundTrip(args); err != nil {
+			c.close()
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip([]string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Do runs a single command and returns its reply: a string, int64, nil,
+// or []interface{} of those.
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(args)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// redisQueue is a queueBackend shared by every instance pointed at the same
+// Redis. Payloads live in a hash and due times in a sorted set per
+// priority. Claiming bumps a message's score to the end of its visibility
+// timeout, so other instances skip it unless it is never acked.
+type redisQueue struct {
+	client *redisClient
+	prefix string
+}
+
+// redisClaimScript atomically selects due messages in orderDue's order and
+// hides them for the visibility timeout. KEYS: the normal schedule, the
+// payloads, the high-priority schedule. ARGV: now, now+visibility, batch
+// size, now-priorityAging (times in ms).
+const redisClaimScript = `
+local limit = tonumber(ARGV[3])
+local aged = tonumber(ARGV[4])
+local candidates = {}
+local function collect(key, urgent)
+  local items = redis.call('ZRANGEBYSCORE', KEYS[key], '-inf', ARGV[1], 'WITHSCORES', 'LIMIT', 0, limit)
+  for i = 1, #items, 2 do
+    local score = tonumber(items[i + 1])
+    table.insert(candidates, {key = KEYS[key], id = items[i], score = score, urgent = urgent or score <= aged})
+  end
+end
+collect(3, true)
+collect(1, false)
+table.sort(candidates, function(a, b)
+  if a.urgent ~= b.urgent then
+    return a.urgent
+  end
+  return a.score < b.score
+end)
+local payloads = {}
+for _, candidate in ipairs(candidates) do
+  if #payloads >= limit then
+    break
+  end
+  local payload = redis.call('HGET', KEYS[2], candidate.id)
+  if payload then
+    redis.call('ZADD', candidate.key, ARGV[2], candidate.id)
+    table.insert(payloads, payload)
+  else
+    redis.call('ZREM', candidate.key, candidate.id)
+  end
+end
+return payloads
+`
+
+// redisPushScript stores a payload and schedules it in one step.
+const redisPushScript = `
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 1
+`
+
+// redisExpediteScript moves messages forward to ARGV[1], skipping any whose
+// score no longer matches its send time because it has been claimed.
+// ARGV: now, then pairs of id and send time (all in ms).
+const redisExpediteScript = `
+local count = 0
+for i = 2, #ARGV, 2 do
+  if redis.call('ZSCORE', KEYS[1], ARGV[i]) == ARGV[i + 1] then
+    redis.call('ZADD', KEYS[1], ARGV[1], ARGV[i])
+    count = count + 1
+  end
+end
+return count
+`
+
+func newRedisQueue(client *redisClient, prefix string) *redisQueue {
+	return &redisQueue{client: client, prefix: prefix}
+}
+
+func (q *redisQueue) scheduleKey() string     { return q.prefix + "schedule" }
+func (q *redisQueue) highScheduleKey() string { return q.prefix + "schedule:high" }
+
+func (q *redisQueue) scheduleKeyFor(message *scheduledMessage) string {
+	if message.Priority == priorityHigh {
+		return q.highScheduleKey()
+	}
+	return q.scheduleKey()
+}
+func (q *redisQueue) messagesKey() string { return q.prefix + "messages" }
+
+func (q *redisQueue) Push(message *scheduledMessage) error {
+	// Attachments are inlined since other instances cannot read local files.
+	for i := range message.Attachments {
+		attachment := &message.Attachments[i]
+		content, err := os.ReadFile(attachment.Path)
+		if err != nil {
+			return err
+		}
+		attachment.Content = content
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = q.client.Do("EVAL", redisPushScript, "2", q.scheduleKeyFor(message), q.messagesKey(),
+		message.ID, strconv.FormatInt(message.SendAt.UnixMilli(), 10), string(data))
+	if err != nil {
+		return err
+	}
+	for _, attachment := range message.Attachments {
+		os.Remove(attachment.Path)
+	}
+	return nil
+}
+
+func (q *redisQueue) Claim(now time.Time, visibility time.Duration, limit int) ([]*scheduledMessage, error) {
+	reply, err := q.client.Do("EVAL", redisClaimScript, "3", q.scheduleKey(), q.messagesKey(), q.highScheduleKey(),
+		strconv.FormatInt(now.UnixMilli(), 10),
+		strconv.FormatInt(now.Add(visibility).UnixMilli(), 10),
+		strconv.Itoa(limit),
+		strconv.FormatInt(now.Add(-priorityAging).UnixMilli(), 10))
+	if err != nil {
+		return nil, err
+	}
+	payloads, _ := reply.([]interface{})
+
+	var due []*scheduledMessage
+	for _, payload := range payloads {
+		data, _ := payload.(string)
+		var message scheduledMessage
+		if err := json.Unmarshal([]byte(data), &message); err != nil {
+			return due, err
+		}
+		if err := message.materializeAttachments(); err != nil {
+			return due, err
+		}
+		due = append(due, &message)
+	}
+	return due, nil
+}
+
+func (q *redisQueue) NextDue() (time.Time, bool, error) {
+	var next time.Time
+	found := false
+	for _, key := range []string{q.highScheduleKey(), q.scheduleKey()} {
+		reply, err := q.client.Do("ZRANGE", key, "0", "0", "WITHSCORES")
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		items, _ := reply.([]interface{})
+		if len(items) < 2 {
+			continue
+		}
+		score, _ := items[1].(string)
+		millis, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if due := time.UnixMilli(int64(millis)); !found || due.Before(next) {
+			next, found = due, true
+		}
+	}
+	return next, found, nil
+}
+
+func (q *redisQueue) Expedite(now time.Time, filter func(*scheduledMessage) bool) (int, error) {
+	reply, err := q.client.Do("HGETALL", q.messagesKey())
+	if err != nil {
+		return 0, err
+	}
+	items, _ := reply.([]interface{})
+	args := make(map[string][]string)
+	for i := 1; i < len(items); i += 2 {
+		data, _ := items[i].(string)
+		var message scheduledMessage
+		if err := json.Unmarshal([]byte(data), &message); err != nil {
+			return 0, err
+		}
+		if message.SendAt.After(now) && filter(&message) {
+			key := q.scheduleKeyFor(&message)
+			args[key] = append(args[key], message.ID, strconv.FormatInt(message.SendAt.UnixMilli(), 10))
+		}
+	}
+	total := 0
+	for key, pairs := range args {
+		command := append([]string{"EVAL", redisExpediteScript, "1", key, strconv.FormatInt(now.UnixMilli(), 10)}, pairs...)
+		reply, err = q.client.Do(command...)
+		if err != nil {
+			return total, err
+		}
+		count, _ := reply.(int64)
+		total += int(count)
+	}
+	return total, nil
+}
+
+func (q *redisQueue) Ack(message *scheduledMessage) error {
+	if _, err := q.client.Do("ZREM", q.scheduleKeyFor(message), message.ID); err != nil {
+		return err
+	}
+	_, err := q.client.Do("HDEL", q.messagesKey(), message.ID)
+	return err
+}
+
+// materializeAttachments writes inlined attachment content back to temp
+// files so the message can be built like any other.
+func (m *scheduledMessage) materializeAttachments() error {
+	for i := range m.Attachments {
+		attachment := &m.Attachments[i]
+		if attachment.Content == nil {
+			continue
+		}
+		file, err := os.CreateTemp("", "mailer-upload-")
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(attachment.Content)
+		file.Close()
+		if err != nil {
+			os.Remove(file.Name())
+			return err
+		}
+		attachment.Path = file.Name()
+		attachment.Content = nil
+	}
+	return nil
+}
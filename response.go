@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// prettyJSON indents JSON responses, which is handy when debugging with curl.
+var prettyJSON bool
+
+// strictJSON rejects JSON submissions carrying fields Email does not know.
+var strictJSON bool
+
+// successMessage is returned with 202 responses. A valid JSON value is sent
+// as-is, anything else is wrapped as {"message": ...}. Empty means no body.
+var successMessage string
+
+// successRedirect and errorRedirect answer browsers posting a plain HTML
+// form with 303 See Other to a page, rather than a status and a JSON body
+// they would show as raw text. The error page is given the status and the
+// message as "status" and "error" query parameters.
+var successRedirect string
+var errorRedirect string
+
+// strictAccept requires clients to send an Accept header. Without it a
+// missing header is treated as */*.
+var strictAccept bool
+
+var errTrailingData = errors.New("unexpected data after JSON body")
+var errEmptyBody = errors.New("empty request body")
+
+// malformedJSONError reports a body that is not valid JSON, with the byte
+// offset the decoder had reached.
+type malformedJSONError struct {
+	offset int64
+	err    error
+}
+
+func (e *malformedJSONError) Error() string {
+	return fmt.Sprintf("malformed JSON at byte %d: %s", e.offset, e.err)
+}
+
+func (e *malformedJSONError) Unwrap() error { return e.err }
+
+type errorBody struct {
+	Code    int          `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+// writeError replies with a {"error":{"code":...,"message":...}} envelope,
+// or with the bare status code for clients that only accept text/plain.
+// An empty message defaults to the status text.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if message == "" {
+		message = strings.ToLower(http.StatusText(status))
+	}
+	if errorRedirect != "" && wantsRedirect(r) {
+		target, _ := url.Parse(errorRedirect)
+		query := target.Query()
+		query.Set("status", strconv.Itoa(status))
+		query.Set("error", message)
+		target.RawQuery = query.Encode()
+		http.Redirect(w, r, target.String(), http.StatusSeeOther)
+		return
+	}
+	if prefersPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprint(w, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	newJSONEncoder(w).Encode(errorEnvelope{Error: errorBody{Code: status, Message: message}})
+}
+
+// writeAccepted replies 202 with successMessage, as plain text for clients
+// that only accept text/plain.
+func writeAccepted(w http.ResponseWriter, r *http.Request) {
+	if successRedirect != "" && wantsRedirect(r) {
+		http.Redirect(w, r, successRedirect, http.StatusSeeOther)
+		return
+	}
+	if successMessage == "" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if prefersPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, successMessage)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if json.Valid([]byte(successMessage)) {
+		fmt.Fprintln(w, successMessage)
+		return
+	}
+	newJSONEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{successMessage})
+}
+
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	encoder := json.NewEncoder(w)
+	if prettyJSON {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder
+}
+
+// decodeJSON decodes a single JSON value from r into v and fails if anything
+// but whitespace follows it. An empty body is errEmptyBody and invalid JSON
+// a *malformedJSONError, so they can be told apart from values that decode
+// but do not fit v. Numbers decoded into interface values are json.Number,
+// so long integers such as phone numbers keep every digit.
+func decodeJSON(r io.Reader, v interface{}, disallowUnknown bool) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if disallowUnknown {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		var syntaxErr *json.SyntaxError
+		switch {
+		case err == io.EOF:
+			return errEmptyBody
+		case errors.As(err, &syntaxErr):
+			return &malformedJSONError{offset: syntaxErr.Offset, err: err}
+		case err == io.ErrUnexpectedEOF:
+			return &malformedJSONError{offset: decoder.InputOffset(), err: err}
+		}
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		if err != nil && !isSyntaxError(err) {
+			return err
+		}
+		return errTrailingData
+	}
+	return nil
+}
+
+func isSyntaxError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	return errors.As(err, &syntaxErr)
+}
+
+// writeValidationError replies 422 listing every invalid field. The
+// message joins them for clients that only look at it.
+func writeValidationError(w http.ResponseWriter, r *http.Request, errs []fieldError) {
+	status := http.StatusUnprocessableEntity
+	messages := make([]string, len(errs))
+	for i, fieldErr := range errs {
+		messages[i] = fieldErr.Message
+	}
+	if prefersPlainText(r) || (errorRedirect != "" && wantsRedirect(r)) {
+		writeError(w, r, status, strings.Join(messages, "; "))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	newJSONEncoder(w).Encode(errorEnvelope{Error: errorBody{Code: status, Message: strings.Join(messages, "; "), Fields: errs}})
+}
+
+// prefersPlainText reports whether the client ranks text/plain above
+// JSON, the default.
+func prefersPlainText(r *http.Request) bool {
+	return prefersType(r.Header.Get("Accept"), "text/plain", "application/json")
+}
+
+// wantsRedirect reports whether the request is a browser's native form
+// post: a form content type from a client asking for text/html. Scripts
+// posting FormData rarely ask for HTML, so they keep getting JSON.
+func wantsRedirect(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		return false
+	}
+	return prefersType(r.Header.Get("Accept"), "text/html", "application/json")
+}
+
+// acceptsJSON reports whether an Accept header admits application/json,
+// honouring wildcards and q-values. A missing header accepts anything
+// unless strictAccept is set.
+func acceptsJSON(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return !strictAccept
+	}
+	quality, _ := acceptQuality(accept, "application/json")
+	return quality > 0
+}
+
+// prefersType reports whether an Accept header ranks mediaType above
+// other: by q-value, then by how specifically it names them, so that
+// "text/html, */*" prefers HTML but "*/*" alone prefers neither.
+func prefersType(accept string, mediaType string, other string) bool {
+	quality, specificity := acceptQuality(accept, mediaType)
+	otherQuality, otherSpecificity := acceptQuality(accept, other)
+	return quality > otherQuality || (quality > 0 && quality == otherQuality && specificity > otherSpecificity)
+}
+
+// acceptQuality returns the q-value an Accept header gives mediaType and
+// the specificity of the range it comes from: 2 for the type itself, 1 for
+// type/* and 0 for */*. As RFC 9110 section 12.5.1 has it, the most
+// specific range decides, so "application/json;q=0, */*" refuses JSON. A
+// type no range covers has quality 0 and specificity -1.
+func acceptQuality(accept string, mediaType string) (float64, int) {
+	quality, specificity := 0.0, -1
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		rangeSpecificity := -1
+		switch {
+		case mediaRange == mediaType:
+			rangeSpecificity = 2
+		case mediaRange == "*/*":
+			rangeSpecificity = 0
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+			rangeSpecificity = 1
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+		quality, specificity = 1.0, rangeSpecificity
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+	}
+	return quality, specificity
+}
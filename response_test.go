@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Accept headers as browsers and common HTTP clients send them.
+const (
+	firefoxNavigation = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	chromeNavigation  = "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7"
+	axiosDefault      = "application/json, text/plain, */*"
+	fetchDefault      = "*/*"
+	jqueryJSON        = "application/json, text/javascript, */*; q=0.01"
+)
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := map[string]bool{
+		firefoxNavigation:                 true,
+		chromeNavigation:                  true,
+		axiosDefault:                      true,
+		fetchDefault:                      true,
+		jqueryJSON:                        true,
+		"application/*":                   true,
+		"Application/JSON; charset=utf-8": true,
+		"text/html":                       false,
+		"text/plain":                      false,
+		"application/json;q=0":            false,
+		"application/json;q=0, */*":       false,
+		"*/*;q=0, application/json":       true,
+		"application/*;q=0, */*":          false,
+		"application/xml;q=0, */*":        true,
+	}
+	for accept, want := range tests {
+		if got := acceptsJSON(accept); got != want {
+			t.Errorf("acceptsJSON(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestPrefersType(t *testing.T) {
+	tests := []struct {
+		accept string
+		html   bool
+		plain  bool
+	}{
+		{firefoxNavigation, true, false},
+		{chromeNavigation, true, false},
+		{axiosDefault, false, false},
+		{fetchDefault, false, false},
+		{jqueryJSON, false, false},
+		{"", false, false},
+		{"text/plain", false, true},
+		{"text/plain, */*", false, true},
+		{"text/*, application/json;q=0.5", true, true},
+		{"text/plain;q=0.1, application/json", false, false},
+		{"application/json;q=0.5, text/plain;q=0.9", false, true},
+	}
+	for _, test := range tests {
+		if got := prefersType(test.accept, "text/html", "application/json"); got != test.html {
+			t.Errorf("%q: prefers HTML = %v, want %v", test.accept, got, test.html)
+		}
+		r := httptest.NewRequest("POST", "/send", nil)
+		r.Header.Set("Accept", test.accept)
+		if got := prefersPlainText(r); got != test.plain {
+			t.Errorf("%q: prefers plain text = %v, want %v", test.accept, got, test.plain)
+		}
+	}
+}
+
+func TestWantsRedirectForBrowserFormPosts(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		accept      string
+		want        bool
+	}{
+		{"application/x-www-form-urlencoded", firefoxNavigation, true},
+		{"multipart/form-data; boundary=x", chromeNavigation, true},
+		{"application/x-www-form-urlencoded", fetchDefault, false},
+		{"multipart/form-data; boundary=x", axiosDefault, false},
+		{"application/json", firefoxNavigation, false},
+	} {
+		r := httptest.NewRequest("POST", "/send", nil)
+		r.Header.Set("Content-Type", test.contentType)
+		r.Header.Set("Accept", test.accept)
+		if got := wantsRedirect(r); got != test.want {
+			t.Errorf("%s with Accept %q: wantsRedirect = %v, want %v", test.contentType, test.accept, got, test.want)
+		}
+	}
+}
+
+func TestSendWithoutAcceptHeader(t *testing.T) {
+	fake := setupSendHandler(t)
+	body := `{"from": "visitor@example.org", "body": "hello"}`
+
+	if w := postSend("application/json", body); w.Code != http.StatusAccepted {
+		t.Fatalf("a request without Accept answered %d, want 202", w.Code)
+	}
+	waitFor(t, func() bool { return fake.count() == 1 })
+
+	strictAccept = true
+	defer func() { strictAccept = false }()
+	if w := postSend("application/json", body); w.Code != http.StatusNotAcceptable {
+		t.Errorf("with MAILER_STRICT_ACCEPT a request without Accept answered %d, want 406", w.Code)
+	}
+	r := httptest.NewRequest("POST", "/send", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", axiosDefault)
+	w := httptest.NewRecorder()
+	(&SendHandler{}).ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("with MAILER_STRICT_ACCEPT a request with Accept answered %d, want 202", w.Code)
+	}
+	waitFor(t, func() bool { return fake.count() == 2 })
+}
+
+func TestSendRejectsTrailingData(t *testing.T) {
+	fake := setupSendHandler(t)
+	valid := `{"from": "visitor@example.org", "body": "hello"}`
+	tests := map[string]int{
+		valid + ` garbage`: http.StatusUnprocessableEntity,
+		valid + valid:      http.StatusUnprocessableEntity,
+		valid + `}`:        http.StatusUnprocessableEntity,
+		`{"from": `:        http.StatusBadRequest,
+		``:                 http.StatusBadRequest,
+	}
+	for body, want := range tests {
+		w := postSend("application/json", body)
+		if w.Code != want {
+			t.Errorf("%q answered %d, want %d", body, w.Code, want)
+		}
+		if want == http.StatusUnprocessableEntity && !strings.Contains(w.Body.String(), errTrailingData.Error()) {
+			t.Errorf("%q: response %q does not name the problem", body, w.Body.String())
+		}
+	}
+	if w := postSend("application/json", valid+"\n\t "); w.Code != http.StatusAccepted {
+		t.Errorf("trailing whitespace answered %d, want 202", w.Code)
+	}
+	waitFor(t, func() bool { return fake.count() == 1 })
+}
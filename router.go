@@ -0,0 +1,31 @@
+package main
+
+import "net/http"
+
+// newRouter registers every endpoint. Endpoints the form calls share its
+// CORS policy. Operational endpoints get no CORS headers at all, so a page
+// on the form's origin cannot call them from the browser, and rely on
+// their own authentication. The middleware each group gets, and its order,
+// is set out in publicMiddleware and operationalMiddleware.
+func newRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+	publicChain := publicMiddleware()
+	operationalChain := operationalMiddleware()
+	public := func(path string, h http.Handler) {
+		mux.Handle(path, publicChain(h))
+	}
+	operational := func(path string, h http.Handler) {
+		mux.Handle(path, operationalChain(h))
+	}
+
+	public("/send", &SendHandler{})
+	public("/preview", &PreviewHandler{})
+	operational("/health", &HealthHandler{})
+	operational("/metrics", &MetricsHandler{})
+	operational("/selftest", &SelfTestHandler{})
+	operational("/admin/failures", &FailuresHandler{})
+	operational("/admin/queue/flush", &FlushHandler{})
+	operational("/admin/suppressions", &SuppressionsHandler{})
+	operational("/notifications/", &NotificationsHandler{})
+	return mux
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWrongMethodsAnswer405(t *testing.T) {
+	router := newRouter()
+	tests := []struct {
+		path    string
+		allow   string
+		refused []string
+	}{
+		{"/send", "POST, HEAD, OPTIONS", []string{"GET", "PUT", "DELETE", "PATCH"}},
+		{"/preview", "POST, OPTIONS", []string{"GET", "PUT", "DELETE", "PATCH"}},
+		{"/health", "GET, HEAD", []string{"POST", "PUT", "DELETE", "PATCH"}},
+		{"/metrics", "GET", []string{"POST", "PUT", "DELETE", "PATCH"}},
+		{"/selftest", "GET", []string{"POST", "PUT", "DELETE", "PATCH"}},
+		{"/admin/failures", "GET, DELETE", []string{"POST", "PUT", "PATCH"}},
+		{"/admin/queue/flush", "POST", []string{"GET", "PUT", "DELETE", "PATCH"}},
+	}
+	for _, test := range tests {
+		for _, method := range test.refused {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(method, test.path, nil))
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s answered %d, want 405", method, test.path, w.Code)
+			}
+			if got := w.Header().Get("Allow"); got != test.allow {
+				t.Errorf("%s %s: Allow = %q, want %q", method, test.path, got, test.allow)
+			}
+		}
+	}
+}
+
+func TestUnknownPathUnderSendAnswers404(t *testing.T) {
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/send/extra", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /send/extra answered %d, want 404", w.Code)
+	}
+	if w.Header().Get("Allow") != "" {
+		t.Error("a 404 advertised allowed methods")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// routes maps the keys a client may pass as To onto a destination with its
+// own subject and body template. It takes precedence over allowedRecipients.
+var routes map[string]*route
+
+// subjectPrefix is put in front of every subject, e.g. "[Careers]", so
+// inbox filters can sort messages from different forms.
+var subjectPrefix string
+
+// subjectMode decides what becomes of a client's subject: "default"
+// ignores it, "client" uses it when given, and "prefix" appends it to the
+// default, e.g. "New Web Inquiry: Pricing question".
+var subjectMode = "default"
+var defaultSubject = "New Web Inquiry"
+
+// subjectTemplate, when set, builds the base subject from the submitted
+// fields, e.g. "New inquiry from {{.Name}} about {{.Topic}}". It takes the
+// place of defaultSubject, which is used instead if it fails to render.
+var subjectTemplate *template.Template
+
+// unknownRouteFallback sends submissions naming an unknown route to
+// inboxAddress instead of rejecting them.
+var unknownRouteFallback bool
+
+type route struct {
+	To       string `json:"to"`
+	Subject  string `json:"subject"`
+	Template string `json:"template"`
+	// SubjectPrefix overrides subjectPrefix for the route.
+	SubjectPrefix string `json:"subject_prefix"`
+	// Priority is "high" to send the route's messages ahead of a queued
+	// backlog, or empty for normal.
+	Priority string `json:"priority"`
+	// Rate limits the route's sends, e.g. "30/h", in place of
+	// MAILER_GLOBAL_RATE. Routes without one share the global limit.
+	Rate    string `json:"rate"`
+	body    *template.Template
+	limiter *tokenBucket
+}
+
+type routeData struct {
+	Route   string
+	From    string
+	Subject string
+	Body    string
+}
+
+// loadRoutes parses a MAILER_ROUTES spec: a JSON object mapping route name
+// to {"to", "subject", "template", ...}, or the path of a file holding one.
+func loadRoutes(spec string) (map[string]*route, error) {
+	data := []byte(spec)
+	if !strings.HasPrefix(strings.TrimSpace(spec), "{") {
+		var err error
+		if data, err = os.ReadFile(spec); err != nil {
+			return nil, err
+		}
+	}
+	var parsed map[string]*route
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	for name, r := range parsed {
+		if r == nil {
+			return nil, fmt.Errorf("route %q is empty", name)
+		}
+		address, err := mail.ParseAddress(r.To)
+		if err != nil || address.Address != r.To {
+			return nil, fmt.Errorf("route %q: invalid recipient %q", name, r.To)
+		}
+		if r.To, _, err = normalizeAddress(r.To); err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+		r.Subject = stripLineBreaks(r.Subject)
+		r.SubjectPrefix = stripLineBreaks(r.SubjectPrefix)
+		switch r.Priority {
+		case "", "normal":
+			r.Priority = ""
+		case priorityHigh:
+		default:
+			return nil, fmt.Errorf("route %q: priority must be high or normal", name)
+		}
+		if r.Rate != "" {
+			count, per, err := parseRate(r.Rate)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %s", name, err)
+			}
+			r.limiter = newTokenBucket(count, per)
+		}
+		if r.Template != "" {
+			if r.body, err = template.New(name).Parse(r.Template); err != nil {
+				return nil, fmt.Errorf("route %q: %s", name, err)
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// apply renders the route's body template over the submission. The
+// route's subject is applied beforehand, by applyRoute.
+func (r *route) apply(name string, m *Email) error {
+	m.Priority = r.Priority
+	if r.body == nil {
+		return nil
+	}
+	var body bytes.Buffer
+	data := routeData{Route: name, From: m.From, Subject: m.Subject, Body: m.Body}
+	if err := r.body.Execute(&body, data); err != nil {
+		return err
+	}
+	m.Body = body.String()
+	return nil
+}
+
+// baseSubject renders subjectTemplate over the submission, falling back to
+// defaultSubject when there is no template or it renders nothing usable.
+func (m *Email) baseSubject() string {
+	if subjectTemplate == nil {
+		return defaultSubject
+	}
+	var subject strings.Builder
+	if err := subjectTemplate.Execute(&subject, m.templateData()); err != nil {
+		log.Printf("Unable to render MAILER_SUBJECT_TEMPLATE: %s\n", err.Error())
+		return defaultSubject
+	}
+	rendered := strings.TrimSpace(stripLineBreaks(subject.String()))
+	if rendered == "" {
+		return defaultSubject
+	}
+	return rendered
+}
+
+// templateData is what subjectTemplate and fromTemplate render from: the
+// submitted fields under their own names and capitalised, then the
+// message's own fields, which take precedence.
+func (m *Email) templateData() map[string]string {
+	data := make(map[string]string)
+	for key, value := range m.Fields {
+		data[key] = value
+		if key != "" {
+			data[strings.ToUpper(key[:1])+key[1:]] = value
+		}
+	}
+	data["From"], data["Name"], data["To"] = m.From, m.Name, m.To
+	data["Subject"], data["Body"] = m.Subject, m.Body
+	return data
+}
+
+// collectFields reports whether submissions need their Fields recorded.
+func collectFields() bool {
+	return subjectTemplate != nil || fromTemplate != nil
+}
+
+// composeSubject combines base, the default, templated or route subject, with the
+// client's subject according to subjectMode.
+func composeSubject(base string, client string) string {
+	client = strings.TrimSpace(stripLineBreaks(client))
+	if client == "" {
+		return base
+	}
+	switch subjectMode {
+	case "client":
+		return client
+	case "prefix":
+		return base + ": " + client
+	}
+	return base
+}
+
+// encodedSubject is the Subject header: the route's subject prefix, or the
+// global one, ahead of the subject unless it already carries it. The two
+// are RFC 2047 encoded separately and only when they are not ASCII, so an
+// ASCII prefix stays plain for filters matching the raw header.
+func (m *Email) encodedSubject() string {
+	prefix := subjectPrefix
+	if selected, ok := routes[m.To]; ok && selected.SubjectPrefix != "" {
+		prefix = selected.SubjectPrefix
+	}
+	if prefix == "" {
+		return mime.QEncoding.Encode("utf-8", m.Subject)
+	}
+	subject := strings.TrimPrefix(m.Subject, prefix+" ")
+	return mime.QEncoding.Encode("utf-8", prefix) + " " + mime.QEncoding.Encode("utf-8", subject)
+}
+
+// rateLimit returns the limiter the message's sends wait on: its route's
+// own, or the global one.
+func (m *Email) rateLimit() *tokenBucket {
+	if selected, ok := routes[m.To]; ok && selected.limiter != nil {
+		return selected.limiter
+	}
+	return globalRateLimit
+}
+
+// routeSendsTotal counts the messages handed to the transport, by route.
+var routeSendsTotal = registerCounterVec("mailer_route_sends_total", "Messages sent, by route.", "route")
+
+// routeRateWaiting reports, by route, the sends queued for their route's
+// own rate limit.
+func routeRateWaiting() map[string]float64 {
+	waiting := make(map[string]float64)
+	for name, r := range routes {
+		if r.limiter != nil {
+			waiting[name] = float64(r.limiter.Waiting())
+		}
+	}
+	return waiting
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestApplyRouteKeepsAllowedRecipients(t *testing.T) {
+	routes = map[string]*route{"sales": {To: "sales@example.com"}}
+	allowedRecipients = map[string]string{"support": "support@example.com"}
+	defer func() { routes, allowedRecipients, unknownRouteFallback = nil, nil, false }()
+
+	for _, fallback := range []bool{false, true} {
+		unknownRouteFallback = fallback
+		for to, want := range map[string]string{"sales": "sales@example.com", "support": "support@example.com"} {
+			message := &Email{From: "visitor@example.org", To: to}
+			w := httptest.NewRecorder()
+			if !applyRoute(w, httptest.NewRequest("POST", "/send", nil), message) {
+				t.Fatalf("fallback=%v: %q was refused with %d", fallback, to, w.Code)
+			}
+			if got := message.recipient(); got != want {
+				t.Errorf("fallback=%v: %q delivers to %q, want %q", fallback, to, got, want)
+			}
+		}
+	}
+}
+
+func TestApplyRouteUnknownKey(t *testing.T) {
+	routes = map[string]*route{"sales": {To: "sales@example.com"}}
+	allowedRecipients = map[string]string{"support": "support@example.com"}
+	inboxAddress = "inbox@example.com"
+	defer func() { routes, allowedRecipients, unknownRouteFallback, inboxAddress = nil, nil, false, "" }()
+
+	w := httptest.NewRecorder()
+	if applyRoute(w, httptest.NewRequest("POST", "/send", nil), &Email{To: "billing"}) || w.Code != http.StatusNotFound {
+		t.Errorf("unknown key answered %d, want 404", w.Code)
+	}
+
+	unknownRouteFallback = true
+	message := &Email{To: "billing"}
+	if !applyRoute(httptest.NewRecorder(), httptest.NewRequest("POST", "/send", nil), message) {
+		t.Fatal("unknown key was refused despite the fallback")
+	}
+	if got := message.recipient(); got != inboxAddress {
+		t.Errorf("unknown key delivers to %q, want the inbox", got)
+	}
+}
+
+func TestComposeSubject(t *testing.T) {
+	defer func() { subjectMode = "default" }()
+	tests := []struct {
+		mode   string
+		client string
+		want   string
+	}{
+		{"default", "Pricing question", "New Web Inquiry"},
+		{"client", "Pricing question", "Pricing question"},
+		{"client", "  ", "New Web Inquiry"},
+		{"prefix", "Pricing question", "New Web Inquiry: Pricing question"},
+		{"prefix", "", "New Web Inquiry"},
+		{"client", "Pricing\r\nBcc: victim@example.net", "PricingBcc: victim@example.net"},
+	}
+	for _, test := range tests {
+		subjectMode = test.mode
+		if got := composeSubject("New Web Inquiry", test.client); got != test.want {
+			t.Errorf("%s mode, client %q: subject = %q, want %q", test.mode, test.client, got, test.want)
+		}
+	}
+}
+
+func TestEncodedSubject(t *testing.T) {
+	defer func() { subjectPrefix, routes = "", nil }()
+	routes = map[string]*route{"careers": {To: "jobs@example.com", SubjectPrefix: "[Café]"}}
+	subjectPrefix = "[Site]"
+	tests := []struct {
+		to      string
+		subject string
+		want    string
+	}{
+		{"", "Pricing question", "[Site] Pricing question"},
+		{"", "[Site] Pricing question", "[Site] Pricing question"},
+		{"", "Café au lait", "[Site] =?utf-8?q?Caf=C3=A9_au_lait?="},
+		{"", "[Site] Café au lait", "[Site] =?utf-8?q?Caf=C3=A9_au_lait?="},
+		{"careers", "Application", "=?utf-8?q?[Caf=C3=A9]?= Application"},
+	}
+	for _, test := range tests {
+		message := &Email{To: test.to, Subject: test.subject}
+		got := message.encodedSubject()
+		if got != test.want {
+			t.Errorf("to %q, subject %q: header = %q, want %q", test.to, test.subject, got, test.want)
+		}
+		decoded, err := new(mime.WordDecoder).DecodeHeader(got)
+		if err != nil {
+			t.Errorf("to %q, subject %q: %v", test.to, test.subject, err)
+		} else if prefix, _, _ := strings.Cut(decoded, " "); prefix != "[Site]" && prefix != "[Café]" {
+			t.Errorf("to %q, subject %q: decodes to %q, which does not start with the prefix", test.to, test.subject, decoded)
+		}
+	}
+
+	subjectPrefix = ""
+	if got := (&Email{Subject: "Café"}).encodedSubject(); got != "=?utf-8?q?Caf=C3=A9?=" {
+		t.Errorf("without a prefix: header = %q", got)
+	}
+}
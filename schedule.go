@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+var maxScheduleAhead time.Duration
+var messageScheduler *scheduler
+
+// scheduledMessage is the queued form of a message waiting for its SendAt
+// time.
+type scheduledMessage struct {
+	ID          string                `json:"id"`
+	SendAt      time.Time             `json:"send_at"`
+	From        string                `json:"from"`
+	Name        string                `json:"name,omitempty"`
+	To          string                `json:"to,omitempty"`
+	Cc          []string              `json:"cc,omitempty"`
+	ReplyTo     string                `json:"reply_to,omitempty"`
+	Subject     string                `json:"subject"`
+	Body        string                `json:"body"`
+	HTML        string                `json:"html,omitempty"`
+	Attachments []scheduledAttachment `json:"attachments,omitempty"`
+	Metadata    *submissionMetadata   `json:"metadata,omitempty"`
+	// Fields keeps what the From and subject templates render from, so a
+	// retry builds the same From as the first attempt.
+	Fields map[string]string `json:"fields,omitempty"`
+	// RetryRecipients narrows the envelope for a partial-delivery retry.
+	RetryRecipients []string `json:"retry_recipients,omitempty"`
+	Attempts        int      `json:"attempts,omitempty"`
+	Priority        string   `json:"priority,omitempty"`
+	MessageID       string   `json:"message_id,omitempty"`
+	QuotaTaken      bool     `json:"quota_taken,omitempty"`
+}
+
+type scheduledAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Inline      bool   `json:"inline,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+	Path        string `json:"path,omitempty"`
+	// Content carries the attachment inline for backends shared between
+	// instances, which cannot rely on a local path.
+	Content []byte `json:"content,omitempty"`
+}
+
+func (s *scheduledMessage) email() *Email {
+	message := &Email{
+		From:            s.From,
+		Name:            s.Name,
+		To:              s.To,
+		Cc:              s.Cc,
+		ReplyTo:         s.ReplyTo,
+		Subject:         s.Subject,
+		Body:            s.Body,
+		HTML:            s.HTML,
+		SendAt:          s.SendAt,
+		Metadata:        s.Metadata,
+		Fields:          s.Fields,
+		RetryRecipients: s.RetryRecipients,
+		Attempts:        s.Attempts,
+		Priority:        s.Priority,
+		MessageID:       s.MessageID,
+		QuotaTaken:      s.QuotaTaken,
+	}
+	for _, attachment := range s.Attachments {
+		message.Attachments = append(message.Attachments, &Attachment{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        attachment.Size,
+			Inline:      attachment.Inline,
+			ContentID:   attachment.ContentID,
+			path:        attachment.Path,
+		})
+	}
+	return message
+}
+
+// scheduler holds messages in a queue backend until their SendAt time and
+// then hands them to deliver on a fixed number of workers. Messages are
+// only claimed when a worker is free to take them, so when a backlog
+// builds up the backend's claim order, high priority first, decides what
+// is sent next.
+type scheduler struct {
+	backend    queueBackend
+	visibility time.Duration
+	// poll bounds how long Run sleeps, so messages pushed by other
+	// instances sharing the backend are noticed.
+	poll time.Duration
+	wake chan struct{}
+	// claimMu keeps Run and Flush from claiming at the same time.
+	claimMu sync.Mutex
+	// workers holds a token for each delivery in progress.
+	workers chan struct{}
+	deliver func(*Email) deliveryOutcome
+}
+
+func newScheduler(backend queueBackend, visibility time.Duration, poll time.Duration, workers int) *scheduler {
+	return &scheduler{
+		backend:    backend,
+		visibility: visibility,
+		poll:       poll,
+		wake:       make(chan struct{}, 1),
+		workers:    make(chan struct{}, workers),
+		deliver:    deliver,
+	}
+}
+
+// Schedule queues message for delivery at its SendAt time, taking ownership
+// of its attachment files.
+func (s *scheduler) Schedule(message *Email) error {
+	id, err := newMessageID()
+	if err != nil {
+		return err
+	}
+	scheduled := &scheduledMessage{
+		ID:              id,
+		SendAt:          message.SendAt,
+		From:            message.From,
+		Name:            message.Name,
+		To:              message.To,
+		Cc:              message.Cc,
+		ReplyTo:         message.ReplyTo,
+		Subject:         message.Subject,
+		Body:            message.Body,
+		HTML:            message.HTML,
+		Metadata:        message.Metadata,
+		Fields:          message.Fields,
+		RetryRecipients: message.RetryRecipients,
+		Attempts:        message.Attempts,
+		Priority:        message.Priority,
+		MessageID:       message.MessageID,
+		QuotaTaken:      message.QuotaTaken,
+	}
+	for _, attachment := range message.Attachments {
+		scheduled.Attachments = append(scheduled.Attachments, scheduledAttachment{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        attachment.Size,
+			Inline:      attachment.Inline,
+			ContentID:   attachment.ContentID,
+			Path:        attachment.path,
+		})
+	}
+	if err := s.backend.Push(scheduled); err != nil {
+		return err
+	}
+	// The backend now owns the files.
+	message.Attachments = nil
+	s.notify()
+	return nil
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches due messages until the process exits.
+func (s *scheduler) Run() {
+	for {
+		now := time.Now()
+		if idle := cap(s.workers) - len(s.workers); idle > 0 {
+			s.claimMu.Lock()
+			due, err := s.backend.Claim(now, s.visibility, idle)
+			s.claimMu.Unlock()
+			if err != nil {
+				log.Printf("Unable to claim queued messages: %s\n", err.Error())
+			}
+			for _, scheduled := range due {
+				s.start(scheduled, nil)
+			}
+		}
+
+		// With every worker busy, a finished delivery wakes Run to claim
+		// the next message.
+		next := now.Add(s.poll)
+		if len(s.workers) < cap(s.workers) {
+			if due, ok, err := s.backend.NextDue(); err != nil {
+				log.Printf("Unable to inspect the queue: %s\n", err.Error())
+			} else if ok && due.Before(next) {
+				next = due
+			}
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+		timer.Stop()
+	}
+}
+
+// start waits for a free worker and delivers scheduled on it, passing the
+// outcome to done when set.
+func (s *scheduler) start(scheduled *scheduledMessage, done func(deliveryOutcome)) {
+	s.workers <- struct{}{}
+	go func() {
+		outcome := s.dispatch(scheduled)
+		<-s.workers
+		s.notify()
+		if done != nil {
+			done(outcome)
+		}
+	}()
+}
+
+func (s *scheduler) dispatch(scheduled *scheduledMessage) deliveryOutcome {
+	outcome := s.deliver(scheduled.email())
+	if err := s.backend.Ack(scheduled); err != nil {
+		log.Printf("Unable to remove delivered message %s from the queue: %s\n", scheduled.ID, err.Error())
+	}
+	return outcome
+}
+
+// flushSummary counts what happened to the messages a flush attempted.
+type flushSummary struct {
+	Attempted int `json:"attempted"`
+	Delivered int `json:"delivered"`
+	Deferred  int `json:"deferred"`
+	Failed    int `json:"failed"`
+}
+
+// Flush makes every queued retry due now, delivers it along with anything
+// else already due and waits for the outcomes. Messages scheduled by
+// their sender for later are left alone. Deliveries go through the same
+// workers as Run's, one claim per free worker, so they keep priority
+// order.
+func (s *scheduler) Flush() (flushSummary, error) {
+	var summary flushSummary
+	now := time.Now()
+	s.claimMu.Lock()
+	_, err := s.backend.Expedite(now, func(message *scheduledMessage) bool {
+		return len(message.RetryRecipients) > 0
+	})
+	s.claimMu.Unlock()
+	if err != nil {
+		return summary, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	record := func(outcome deliveryOutcome) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch outcome {
+		case outcomeDelivered:
+			summary.Delivered++
+		case outcomeDeferred:
+			summary.Deferred++
+		case outcomeFailed:
+			summary.Failed++
+		}
+		wg.Done()
+	}
+	for {
+		s.workers <- struct{}{}
+		s.claimMu.Lock()
+		due, claimErr := s.backend.Claim(now, s.visibility, 1)
+		s.claimMu.Unlock()
+		<-s.workers
+		if claimErr != nil {
+			err = claimErr
+		}
+		if len(due) == 0 {
+			break
+		}
+		mu.Lock()
+		summary.Attempted++
+		mu.Unlock()
+		wg.Add(1)
+		s.start(due[0], record)
+	}
+	wg.Wait()
+	return summary, err
+}
+
+func newMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
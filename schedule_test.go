@@ -0,0 +1,165 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalQueueClaimsHighPriorityFirst(t *testing.T) {
+	queue, _ := newLocalQueue("")
+	now := time.Now()
+	queue.Push(&scheduledMessage{ID: "normal-old", SendAt: now.Add(-2 * time.Minute)})
+	queue.Push(&scheduledMessage{ID: "normal-new", SendAt: now.Add(-time.Minute)})
+	queue.Push(&scheduledMessage{ID: "high", SendAt: now.Add(-time.Second), Priority: priorityHigh})
+	queue.Push(&scheduledMessage{ID: "later", SendAt: now.Add(time.Hour), Priority: priorityHigh})
+
+	var claimed []string
+	for {
+		due, err := queue.Claim(now, time.Minute, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(due) == 0 {
+			break
+		}
+		claimed = append(claimed, due[0].ID)
+	}
+	if want := []string{"high", "normal-old", "normal-new"}; !reflect.DeepEqual(claimed, want) {
+		t.Errorf("claim order = %v, want %v", claimed, want)
+	}
+}
+
+func TestLocalQueueAgedNormalBeatsNewHigh(t *testing.T) {
+	queue, _ := newLocalQueue("")
+	now := time.Now()
+	queue.Push(&scheduledMessage{ID: "high", SendAt: now.Add(-time.Second), Priority: priorityHigh})
+	queue.Push(&scheduledMessage{ID: "starved", SendAt: now.Add(-2 * priorityAging)})
+
+	due, _ := queue.Claim(now, time.Minute, 1)
+	if len(due) != 1 || due[0].ID != "starved" {
+		t.Errorf("claimed %v, want the long-overdue normal message first", due)
+	}
+}
+
+func TestSchedulerDispatchesHighPriorityFirstWhenSaturated(t *testing.T) {
+	queue, _ := newLocalQueue("")
+	s := newScheduler(queue, time.Minute, 10*time.Millisecond, 1)
+
+	var mu sync.Mutex
+	var order []string
+	release := make(chan struct{})
+	delivered := make(chan struct{}, 3)
+	s.deliver = func(message *Email) deliveryOutcome {
+		mu.Lock()
+		order = append(order, message.Subject)
+		first := len(order) == 1
+		mu.Unlock()
+		if first {
+			<-release
+		}
+		delivered <- struct{}{}
+		return outcomeDelivered
+	}
+	go s.Run()
+
+	now := time.Now()
+	s.Schedule(&Email{Subject: "blocking", SendAt: now.Add(-time.Minute)})
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order) == 1
+	})
+	// The only worker is busy, so both of these wait in the queue.
+	s.Schedule(&Email{Subject: "normal", SendAt: now.Add(-time.Minute)})
+	s.Schedule(&Email{Subject: "high", SendAt: now, Priority: priorityHigh})
+	close(release)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for deliveries")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"blocking", "high", "normal"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("dispatch order = %v, want %v", order, want)
+	}
+}
+
+func TestSchedulerFlushUsesWorkers(t *testing.T) {
+	queue, _ := newLocalQueue("")
+	s := newScheduler(queue, time.Minute, time.Hour, 2)
+
+	var mu sync.Mutex
+	active, peak := 0, 0
+	s.deliver = func(message *Email) deliveryOutcome {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return outcomeDelivered
+	}
+	for i := 0; i < 6; i++ {
+		s.Schedule(&Email{Subject: "retry", SendAt: time.Now().Add(time.Hour), RetryRecipients: []string{"a@example.com"}})
+	}
+
+	summary, err := s.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Attempted != 6 || summary.Delivered != 6 {
+		t.Errorf("summary = %+v, want 6 attempted and delivered", summary)
+	}
+	if peak > 2 {
+		t.Errorf("%d deliveries ran at once with 2 workers", peak)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScheduleKeepsInlineAttachments(t *testing.T) {
+	queue, _ := newLocalQueue("")
+	s := newScheduler(queue, time.Minute, time.Hour, 1)
+	sendAt := time.Now().Add(-time.Second)
+	message := &Email{
+		From:   "visitor@example.org",
+		HTML:   `<img src="cid:logo">`,
+		SendAt: sendAt,
+		Attachments: []*Attachment{
+			{Filename: "logo.png", ContentType: "image/png", Size: 3, Inline: true, ContentID: "logo", path: "/tmp/logo.png"},
+		},
+	}
+	if err := s.Schedule(message); err != nil {
+		t.Fatal(err)
+	}
+
+	due, err := queue.Claim(time.Now(), time.Minute, 1)
+	if err != nil || len(due) != 1 {
+		t.Fatalf("claimed %v, %v", due, err)
+	}
+	attachments := due[0].email().Attachments
+	if len(attachments) != 1 {
+		t.Fatalf("claimed %d attachments, want 1", len(attachments))
+	}
+	want := Attachment{Filename: "logo.png", ContentType: "image/png", Size: 3, Inline: true, ContentID: "logo", path: "/tmp/logo.png"}
+	if *attachments[0] != want {
+		t.Errorf("claimed attachment %+v, want %+v", *attachments[0], want)
+	}
+}
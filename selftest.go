@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SelfTestHandler checks that the inbox is reachable without sending mail.
+type SelfTestHandler struct{}
+
+type selfTestStep struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type selfTestReport struct {
+	OK    bool            `json:"ok"`
+	Steps []*selfTestStep `json:"steps"`
+}
+
+func (report *selfTestReport) run(name string, step func() (string, error)) bool {
+	started := time.Now()
+	detail, err := step()
+	result := &selfTestStep{Name: name, OK: err == nil, Detail: detail, DurationMS: time.Since(started).Milliseconds()}
+	if err != nil {
+		result.Detail = err.Error()
+		report.OK = false
+	}
+	report.Steps = append(report.Steps, result)
+	return err == nil
+}
+
+func (h *SelfTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	report := &selfTestReport{OK: true}
+	var server string
+	var credentials *smtpCredentials
+	var conn net.Conn
+	var client *smtp.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		} else if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	steps := []struct {
+		name string
+		step func() (string, error)
+	}{{"resolve_mx", func() (string, error) {
+		if smarthostAddress != "" {
+			server, credentials = smarthostAddress, smarthostCredentials
+			return "using smarthost " + smarthostAddress, nil
+		}
+		mailTokens := strings.Split(inboxAddress, "@")
+		domain := mailTokens[len(mailTokens)-1]
+		if ownDomainViaSmarthost && deliversToOwnDomain(domain) {
+			server, credentials = fallbackSmarthost, smarthostCredentials
+			return "using smarthost " + fallbackSmarthost + " for the sender's own domain", nil
+		}
+		mxServers, err := net.DefaultResolver.LookupMX(ctx, domain)
+		if err != nil {
+			return "", err
+		}
+		if len(mxServers) == 0 {
+			return "", fmt.Errorf("no MX records for %s", domain)
+		}
+		var hosts []string
+		for _, mx := range mxServers {
+			hosts = append(hosts, fmt.Sprintf("%s (%d)", strings.TrimRight(mx.Host, "."), mx.Pref))
+		}
+		server = fmt.Sprintf("%s:25", strings.TrimRight(mxServers[0].Host, "."))
+		detail := strings.Join(hosts, ", ")
+		if warning := ownDomainWarning(); warning != "" {
+			detail += "; note: " + warning
+		}
+		return detail, nil
+	}}, {"connect", func() (string, error) {
+		var err error
+		conn, err = dialSMTP(ctx, server)
+		if err != nil {
+			return "", err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		return server, nil
+	}}, {"ehlo", func() (string, error) {
+		var err error
+		host, _, _ := net.SplitHostPort(server)
+		client, err = smtp.NewClient(conn, host)
+		if err != nil {
+			return "", err
+		}
+		return "", client.Hello("localhost")
+	}}, {"starttls", func() (string, error) {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return "", fmt.Errorf("%s does not advertise STARTTLS", server)
+		}
+		host, _, _ := net.SplitHostPort(server)
+		if err := client.StartTLS(smtpTLSConfig(host)); err != nil {
+			return "", err
+		}
+		state, _ := client.TLSConnectionState()
+		return tls.VersionName(state.Version), nil
+	}}, {"auth", func() (string, error) {
+		if credentials == nil {
+			return "no credentials for " + server, nil
+		}
+		host, _, _ := net.SplitHostPort(server)
+		if err := credentials.authenticate(client, host); err != nil {
+			return "", err
+		}
+		return "authenticated as " + credentials.Username, nil
+	}}, {"rset", func() (string, error) {
+		return "", client.Reset()
+	}}, {"quit", func() (string, error) {
+		err := client.Quit()
+		client = nil
+		conn = nil
+		return "", err
+	}}}
+	for _, step := range steps {
+		if !report.run(step.name, step.step) {
+			break
+		}
+	}
+
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	newJSONEncoder(w).Encode(report)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// runSelfTest runs /selftest against a STARTTLS smarthost that accepts
+// form:secret with AUTH PLAIN.
+func runSelfTest(t *testing.T, credentials *smtpCredentials) (*httptest.ResponseRecorder, *selfTestReport, *fakeSMTPServer) {
+	t.Helper()
+	server := startTrustedTLSServer(t, 0, "AUTH PLAIN LOGIN")
+	server.setReply("AUTH", "535 5.7.8 authentication failed")
+	server.setReply("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00form\x00secret")), "235 2.7.0 Authentication successful")
+	adminToken, smarthostAddress, smarthostCredentials = "token", server.Addr(), credentials
+	defer func() { adminToken, smarthostAddress, smarthostCredentials = "", "", nil }()
+
+	r := httptest.NewRequest("GET", "/selftest", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	(&SelfTestHandler{}).ServeHTTP(w, r)
+	report := &selfTestReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), report); err != nil {
+		t.Fatalf("response %q is not a report: %v", w.Body.String(), err)
+	}
+	return w, report, server
+}
+
+func (report *selfTestReport) step(name string) *selfTestStep {
+	for _, step := range report.Steps {
+		if step.Name == name {
+			return step
+		}
+	}
+	return nil
+}
+
+func TestSelfTestAuthenticatesToSmarthost(t *testing.T) {
+	w, report, server := runSelfTest(t, &smtpCredentials{Username: "form", Password: "secret", Mechanism: "auto"})
+	if w.Code != http.StatusOK || !report.OK {
+		t.Fatalf("answered %d with %+v, want every step to pass", w.Code, report.Steps)
+	}
+	if auth := report.step("auth"); auth == nil || auth.Detail != "authenticated as form" {
+		t.Errorf("auth step = %+v, want it to authenticate", auth)
+	}
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "MAIL FROM") || strings.HasPrefix(command, "RCPT TO") {
+			t.Errorf("the self-test sent %q", command)
+		}
+	}
+
+	w, report, _ = runSelfTest(t, &smtpCredentials{Username: "form", Password: "wrong", Mechanism: "plain"})
+	if w.Code != http.StatusServiceUnavailable || report.OK {
+		t.Fatalf("bad credentials answered %d with %+v, want the self-test to fail", w.Code, report.Steps)
+	}
+	if auth := report.step("auth"); auth == nil || auth.OK || !strings.Contains(auth.Detail, "535") {
+		t.Errorf("auth step = %+v, want the server's refusal", auth)
+	}
+	if report.Steps[len(report.Steps)-1].Name != "auth" {
+		t.Error("the self-test went on after AUTH failed")
+	}
+}
+
+func TestSelfTestWithoutCredentialsSkipsAuth(t *testing.T) {
+	w, report, server := runSelfTest(t, nil)
+	if w.Code != http.StatusOK || !report.OK {
+		t.Fatalf("answered %d with %+v, want every step to pass", w.Code, report.Steps)
+	}
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "AUTH") {
+			t.Errorf("sent %q without credentials", command)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runSendTest delivers a canned message to inboxAddress through the normal
+// Send path and reports the outcome, returning the process exit code.
+func runSendTest() int {
+	message := &Email{
+		From:    outboundSender,
+		Subject: "Mailer test message",
+		Body:    fmt.Sprintf("This is a test message sent by mailer %s at %s.", version, time.Now().UTC().Format(time.RFC1123Z)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendDeadline)
+	defer cancel()
+
+	result, err := message.Send(ctx)
+	if result != nil {
+		fmt.Println(result)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL: test message to %s was not delivered: %s\n", message.recipient(), err)
+		return 1
+	}
+	fmt.Printf("OK: test message delivered to %s\n", message.recipient())
+	return 0
+}
@@ -1,74 +1,295 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net"
+	"math"
+	"mime"
 	"net/http"
-	"net/smtp"
+	"net/mail"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	email "gopkg.in/jordan-wright/email.v1"
 )
 
+// version is stamped at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 type SendHandler struct{}
 
 type Email struct {
-	From    string
-	Subject string `json:'-'`
-	Body    string
+	From        string
+	Name        string
+	To          string
+	Cc          []string
+	ReplyTo     string
+	Subject     string `json:"subject"`
+	Body        string
+	HTML        string
+	Attachments []*Attachment `json:"-"`
+	SendAt      time.Time
+	// Metadata records where the submission came from. It is filled in by
+	// the server, never by the client.
+	Metadata *submissionMetadata `json:"-"`
+	// RetryRecipients, when set, replaces the envelope recipients for a
+	// retry of an earlier partial delivery.
+	RetryRecipients []string `json:"-"`
+	// Attempts counts the retries already made.
+	Attempts int `json:"-"`
+	// MessageID is the Message-Id header, assigned when the message is
+	// first built and kept across retries.
+	MessageID string `json:"-"`
+	// Priority is set from the route. High-priority messages are sent
+	// ahead of a queued backlog.
+	Priority string `json:"-"`
+	// QuotaTaken is set once the message has been counted against
+	// dailySendQuota, and kept across retries.
+	QuotaTaken bool `json:"-"`
+	// Fields holds every top-level string field of the submission by its
+	// submitted name, for subjectTemplate and fromTemplate. It is only
+	// filled in when one of them is configured.
+	Fields map[string]string `json:"-"`
 }
 
 var inboxAddress string
 var outboundSender string
 var whitelistedDomain string
+var sendDeadline time.Duration
+var submissionDedup *dedupCache
+var bounceAddress string
+var returnPathHeader bool
+var globalRateLimit *tokenBucket
+var setSenderHeader bool
+var userAgent string
+var enforceOrigin bool
+var allowNoOrigin bool
+
+// requireOriginMatch answers only an exactly matching Origin with CORS
+// headers, on preflights and responses alike, and allows credentials for
+// it. varyOrigin marks responses as varying by Origin so shared caches do
+// not hand one origin's headers to another.
+var requireOriginMatch bool
+var varyOrigin bool
+var blockedFromDomains domainSet
+var allowInvalidUTF8 bool
+var logBodyTruncate int
+
+// envelopeSender is the SMTP MAIL FROM, which is where bounces are routed.
+func envelopeSender() string {
+	if bounceAddress != "" {
+		return bounceAddress
+	}
+	return outboundSender
+}
+
+// submitter is the From header for the person who filled in the form,
+// built from Name when they gave one separately.
+func (m *Email) submitter() string {
+	if m.Name == "" {
+		return m.From
+	}
+	address, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return m.From
+	}
+	address.Name = m.Name
+	return address.String()
+}
+
+// assignMessageID gives the message its Message-Id unless it already has
+// one.
+func (m *Email) assignMessageID() error {
+	if m.MessageID != "" {
+		return nil
+	}
+	id, err := newMessageID()
+	if err != nil {
+		return err
+	}
+	m.MessageID = fmt.Sprintf("<%s@%s>", id, addressDomain(outboundSender))
+	return nil
+}
+
+// parts returns the text and HTML bodies as they are sent, with the
+// configured headers and footers and LF line breaks.
+func (m *Email) parts() (string, string) {
+	body := m.Body
+	if fromTemplate != nil {
+		body = "From: " + m.submitter() + "\n\n" + body
+	}
+	text := normalizeNewlines(decorateBody(body))
+	if m.HTML == "" {
+		return text, ""
+	}
+	return text, normalizeNewlines(decorateHTML(m.HTML))
+}
 
 func (m *Email) ConstructMessage() ([]byte, error) {
 	message := email.NewEmail()
-	message.From = m.From
-	message.To = []string{inboxAddress}
-	message.Subject = m.Subject
-	message.Text = []byte(m.Body)
-	return message.Bytes()
+	message.From = m.submitter()
+	if fromTemplate != nil {
+		message.From = m.templatedFrom()
+		message.Headers.Set("Reply-To", m.submitter())
+	} else if alignFromTemplate != nil {
+		from, replyTo := alignedFrom(m.submitter())
+		message.From = from
+		if replyTo != "" {
+			message.Headers.Set("Reply-To", replyTo)
+		}
+	}
+	if setSenderHeader && !sameAddress(message.From, outboundSender) {
+		message.Headers.Set("Sender", outboundSender)
+	}
+	if m.ReplyTo != "" {
+		message.Headers.Set("Reply-To", m.ReplyTo)
+	}
+	if replyToAlias != "" {
+		if copyReplyToAlias {
+			if message.Headers.Get("Reply-To") == "" {
+				message.Headers.Set("Reply-To", m.submitter())
+			}
+		} else {
+			message.Headers.Set("Reply-To", replyToAlias)
+		}
+	}
+	message.To = []string{m.recipient()}
+	message.Cc = m.copies()
+	message.Subject = m.encodedSubject()
+	text, html := m.parts()
+	message.Text = []byte(text)
+	if html != "" {
+		message.HTML = []byte(html)
+	}
+	if err := m.assignMessageID(); err != nil {
+		return nil, err
+	}
+	message.Headers.Set("Message-Id", m.MessageID)
+	if userAgent != "" {
+		message.Headers.Set("X-Mailer", userAgent)
+	}
+	if includeMetadata && m.Metadata != nil {
+		m.Metadata.setHeaders(message.Headers)
+	}
+	// The header is built from the stored metadata rather than added to
+	// stored bytes, so a retry carries it once with the original time.
+	if addReceived && m.Metadata != nil {
+		message.Headers.Set("Received", m.Metadata.receivedHeader(m.MessageID))
+	}
+	if returnPathHeader {
+		message.Headers.Set("Return-Path", fmt.Sprintf("<%s>", envelopeSender()))
+	}
+	for _, attachment := range m.Attachments {
+		file, err := os.Open(attachment.path)
+		if err != nil {
+			return nil, err
+		}
+		part, err := message.Attach(file, attachment.Filename, attachment.ContentType)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if attachment.Inline {
+			part.Header.Set("Content-Disposition", contentDisposition("inline", attachment.Filename))
+			part.Header.Set("Content-ID", "<"+attachment.ContentID+">")
+		} else {
+			part.Header.Set("Content-Disposition", contentDisposition("attachment", attachment.Filename))
+		}
+	}
+	// SMTP needs CRLF throughout. Normalizing before the seal keeps its
+	// body hash valid for the bytes that go on the wire. Dot-stuffing is
+	// left to the DATA writer, and BDAT needs none.
+	var msg []byte
+	var err error
+	if m.hasInline() {
+		msg, err = relatedMessage(message)
+	} else {
+		msg, err = message.Bytes()
+	}
+	if err == nil {
+		msg = toCRLF(msg)
+	}
+	if err == nil && arcSealer != nil {
+		msg, err = arcSealer.Seal(msg, time.Now())
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Templates, footers and encoding can grow a message well past the
+	// size of the submission, so the limit applies to the built message.
+	if int64(len(msg)) > maxMessageBytes {
+		return nil, &messageSizeError{size: len(msg), limit: maxMessageBytes}
+	}
+	return msg, nil
 }
 
-func (e *Email) Send() error {
+// Send delivers the message and reports, per recipient, whether it was
+// accepted. The error is set when any part of the delivery failed.
+func (e *Email) Send(ctx context.Context) (*deliveryResult, error) {
 	var err error
-	var servers = make([]string, 0)
-
-	mailTokens := strings.Split(inboxAddress, "@")
-	domain := mailTokens[len(mailTokens)-1]
 
-	mxServers, err := net.LookupMX(domain)
+	if limiter := e.rateLimit(); limiter != nil {
+		if err = limiter.Wait(ctx); err != nil {
+			if spoolRateLimited && errors.Is(err, context.DeadlineExceeded) {
+				return nil, &rateLimitedError{retryAfter: max(limiter.Delay(), time.Second)}
+			}
+			droppedTotal.Inc("rate_limit")
+			return nil, err
+		}
+	}
+	// The message is built once so every MX attempt carries identical bytes.
+	msg, err := e.ConstructMessage()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, server := range mxServers {
-		servers = append(servers, fmt.Sprintf("%s:25", strings.TrimRight(server.Host, ".")))
-	}
-
-	for _, server := range servers {
-		msg, err := e.ConstructMessage()
-		if err == nil {
-			log.Printf("Attempting send to: %s, smtp_from: %s, rcpt_to: %s, message: %s\n", server, outboundSender, inboxAddress, string(msg))
-			err = smtp.SendMail(
-				server,
-				nil,
-				outboundSender,
-				[]string{inboxAddress},
-				msg,
-			)
-			if err == nil {
-				break
-			} else {
-				log.Printf("Received error from mx server: %s\n", err.Error())
+	// A message counts against the quota once, when it first builds, not
+	// again for each retry.
+	if dailySendQuota != nil && !e.QuotaTaken {
+		if err = dailySendQuota.Take(time.Now()); err != nil {
+			if err == errQuotaExceeded {
+				droppedTotal.Inc("quota")
 			}
+			return nil, err
+		}
+		e.QuotaTaken = true
+	}
+	if _, ok := routes[e.To]; ok {
+		routeSendsTotal.Inc(e.To)
+	}
+	result, err := transport.Deliver(ctx, e, msg)
+	if result != nil && len(result.Rejected) > 0 {
+		log.Printf("Partial delivery from %s, %s\n", e.From, result)
+	}
+	return result, err
+}
+
+// logSummary describes the message for the send log without its raw bytes:
+// attachments are listed by name, type and size, and the body is cut to
+// logBodyTruncate bytes.
+func (e *Email) logSummary() string {
+	body := e.Body
+	if len(body) > logBodyTruncate {
+		cut := logBodyTruncate
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut--
 		}
+		body = body[:cut] + fmt.Sprintf("... (%d bytes)", len(e.Body))
 	}
-	return err
+	summary := fmt.Sprintf("subject: %q, body: %q", e.Subject, body)
+	for _, attachment := range e.Attachments {
+		summary += fmt.Sprintf(", attachment: %q (%s, %d bytes)", attachment.Filename, attachment.ContentType, attachment.Size)
+	}
+	return summary
 }
 
 func sendErrorMessage(err error) {
@@ -77,100 +298,697 @@ func sendErrorMessage(err error) {
 	domain := mailTokens[len(mailTokens)-1]
 	from := fmt.Sprintf("errors@%s", domain)
 	email := &Email{From: from, Subject: "Application Error", Body: err.Error()}
-	email.Send()
+	ctx, cancel := context.WithTimeout(context.Background(), sendDeadline)
+	defer cancel()
+	email.Send(ctx)
 }
 
-func corsPanicHandler(h http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var err error
-		defer func() {
-			recovery := recover()
-			if recovery != nil {
-				switch val := recovery.(type) {
-				case string:
-					err = errors.New(val)
-				case error:
-					err = val
-				default:
-					err = errors.New("Unknown error")
-				}
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
-		}()
+func (s *SendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/send" {
+		writeError(w, r, http.StatusNotFound, "")
+		return
+	}
+	if r.Method != "POST" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "POST, HEAD, OPTIONS")
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if settings := maintenance.Load(); settings.enabled {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(settings.retryAfter.Seconds()))))
+		writeError(w, r, http.StatusServiceUnavailable, settings.message)
+		return
+	}
+	if failWhenDegraded {
+		if degraded, retryAfter := deliveryHealth.Degraded(time.Now()); degraded {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, r, http.StatusServiceUnavailable, "mail delivery is temporarily unavailable")
+			return
+		}
+	}
+	if dailySendQuota != nil && r.Method == "POST" && dailySendQuota.Exhausted(time.Now()) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(dailySendQuota.ResetIn(time.Now()).Seconds()))))
+		writeError(w, r, http.StatusTooManyRequests, errQuotaExceeded.Error())
+		return
+	}
+	// HEAD lets uptime monitors probe the endpoint, including its degraded
+	// state, without submitting anything.
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !acceptsJSON(r.Header.Get("Accept")) {
+		writeError(w, r, http.StatusNotAcceptable, "accept must allow application/json")
+		return
+	}
+	message, ok := readSubmission(w, r)
+	if !ok {
+		return
+	}
 
-		if r.Method == "OPTIONS" {
-			if origin := r.Header.Get("Origin"); origin == whitelistedDomain {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				w.Header().Set("Access-Control-Allow-Methods", "POST")
-				w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding")
+	if blockedFromDomains != nil && blockedFromDomains.Contains(addressDomain(message.From)) {
+		droppedTotal.Inc("blocked_domain")
+		log.Printf("Rejected submission from blocked domain: %s, client_ip: %s\n", message.From, clientIP(r))
+		message.cleanup()
+		writeError(w, r, http.StatusForbidden, "sender domain is not allowed")
+		return
+	}
+
+	if disposableDomains != nil && disposableDomains.Contains(addressDomain(message.From)) {
+		droppedTotal.Inc("disposable")
+		log.Printf("Rejected submission from disposable address: %s, client_ip: %s\n", message.From, clientIP(r))
+		message.cleanup()
+		writeError(w, r, http.StatusForbidden, "disposable email addresses are not allowed")
+		return
+	}
+
+	if verifySender {
+		if rejected, reason := senderRejected(r.Context(), message.From); rejected {
+			droppedTotal.Inc("sender_callout")
+			log.Printf("Rejected submission from undeliverable sender %s (%s), client_ip: %s\n", message.From, reason, clientIP(r))
+			message.cleanup()
+			writeError(w, r, http.StatusUnprocessableEntity, "sender address does not accept mail")
+			return
+		}
+	}
+
+	if rejectLinkOnly {
+		if ratio := linkRatio(message.Body); ratio >= linkRatioThreshold {
+			message.cleanup()
+			droppedTotal.Inc("link_only")
+			if dropLinkOnly {
+				log.Printf("Dropped link-only submission from %s (link ratio %.2f), client_ip: %s\n", message.From, ratio, clientIP(r))
+				if submissionLog != nil {
+					submissionLog.Record(r, message, "dropped")
+				}
+				writeAccepted(w, r)
+				return
 			}
-		} else {
-			h.ServeHTTP(w, r)
+			log.Printf("Rejected link-only submission from %s (link ratio %.2f), client_ip: %s\n", message.From, ratio, clientIP(r))
+			writeError(w, r, http.StatusUnprocessableEntity, "message body consists only of links")
+			return
 		}
 	}
-}
 
-func (s *SendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" || r.URL.Path != "/send" {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "404")
+	if !applyRoute(w, r, message) {
+		return
+	}
+	// accepted is set once the message is in the hands of the scheduler,
+	// the digest or delivery.
+	accepted := false
+
+	if !message.recipientAllowed() {
+		droppedTotal.Inc("recipient")
+		log.Printf("Rejected submission to unknown recipient %q, client_ip: %s\n", message.To, clientIP(r))
+		message.cleanup()
+		writeError(w, r, http.StatusForbidden, "recipient is not allowed")
 		return
 	}
-	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		fmt.Fprint(w, "415")
+
+	if submissionDedup != nil {
+		fingerprint := message.fingerprint()
+		if submissionDedup.Check(fingerprint, time.Now()) {
+			droppedTotal.Inc("duplicate")
+			log.Printf("Suppressed duplicate submission from %s, client_ip: %s\n", message.From, clientIP(r))
+			if submissionLog != nil {
+				submissionLog.Record(r, message, "duplicate")
+			}
+			message.cleanup()
+			writeAccepted(w, r)
+			return
+		}
+		defer func() {
+			if accepted {
+				submissionDedup.Record(fingerprint, time.Now())
+			} else {
+				submissionDedup.Forget(fingerprint)
+			}
+		}()
+	}
+
+	if err := message.assignMessageID(); err != nil {
+		log.Printf("Unable to assign a message id: %s\n", err.Error())
+		message.cleanup()
+		writeError(w, r, http.StatusInternalServerError, "")
 		return
 	}
-	if accept := r.Header.Get("Accept"); accept != "*/*" && accept != "application/json" {
-		w.WriteHeader(http.StatusNotAcceptable)
-		fmt.Fprint(w, "406")
+	if !message.SendAt.IsZero() && message.SendAt.After(time.Now()) {
+		if message.SendAt.After(time.Now().Add(maxScheduleAhead)) {
+			message.cleanup()
+			writeError(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("SendAt may be at most %s in the future", maxScheduleAhead))
+			return
+		}
+		if err := messageScheduler.Schedule(message); err != nil {
+			log.Printf("Unable to schedule message from %s: %s\n", message.From, err.Error())
+			message.cleanup()
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		accepted = true
+		if submissionLog != nil {
+			submissionLog.Record(r, message, "scheduled")
+		}
+		writeAccepted(w, r)
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	var message Email
-	err := decoder.Decode(&message)
-	if err != nil {
-		w.WriteHeader(http.StatusNotAcceptable)
-		fmt.Fprintf(w, "422")
+	if digests != nil && message.digestible() {
+		if err := digests.Add(message); err != nil {
+			log.Printf("Unable to buffer submission from %s for the digest: %s\n", message.From, err.Error())
+			message.cleanup()
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		accepted = true
+		if submissionLog != nil {
+			submissionLog.Record(r, message, "digested")
+		}
+		writeAccepted(w, r)
 		return
 	}
 
-	go func() {
-		message.Subject = "New Web Inquiry"
-		message.Send()
-	}()
+	accepted = true
+	if submissionLog != nil {
+		submissionLog.Record(r, message, "accepted")
+	}
+	go deliver(message)
 
-	w.WriteHeader(http.StatusAccepted)
+	writeAccepted(w, r)
 	return
 }
 
-func main() {
-	var interfaceAddress string
+// readSubmission decodes and validates the submission in r. On failure it
+// has already written the response.
+func readSubmission(w http.ResponseWriter, r *http.Request) (*Email, bool) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isMultipart := mediaType == "multipart/form-data"
+	isForm := mediaType == "application/x-www-form-urlencoded"
+	if !slices.Contains(allowedContentTypes, mediaType) {
+		writeError(w, r, http.StatusUnsupportedMediaType, "content type must be one of "+strings.Join(allowedContentTypes, ", "))
+		return nil, false
+	}
 
-	inboxAddress = os.Getenv("MAILER_INBOX")
-	outboundSender = os.Getenv("MAILER_SENDER")
-	whitelistedDomain = os.Getenv("MAILER_WHITELISTED_DOMAIN")
-	mailerPort := os.Getenv("MAILER_PORT")
+	// A declared length over the limit is refused before anything is read.
+	// For bodies sent without one, MaxBytesReader below is the backstop.
+	// Compressed bodies are left to it too, since the limits apply to the
+	// decompressed size.
+	limit := maxBodyBytes
+	if isMultipart {
+		limit = multipartLimit()
+	}
+	if encoding := r.Header.Get("Content-Encoding"); (encoding == "" || encoding == "identity") && r.ContentLength > limit {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+		return nil, false
+	}
 
+	if err := decompressBody(r); err == errUnsupportedEncoding {
+		writeError(w, r, http.StatusUnsupportedMediaType, err.Error())
+		return nil, false
+	} else if err != nil {
+		writeError(w, r, http.StatusBadRequest, "malformed gzip body")
+		return nil, false
+	}
+	if mediaType == "application/json" {
+		if err := transcodeBody(r, params["charset"]); err != nil {
+			writeError(w, r, http.StatusUnsupportedMediaType, err.Error())
+			return nil, false
+		}
+	}
+
+	message := &Email{}
+	if isMultipart {
+		if status, err := message.readMultipart(w, r); err != nil {
+			message.cleanup()
+			writeError(w, r, status, err.Error())
+			return nil, false
+		}
+	} else if isForm {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		if status, err := message.readForm(r); err != nil {
+			writeError(w, r, status, err.Error())
+			return nil, false
+		}
+	} else {
+		var err error
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		if fieldMap != nil {
+			err = message.decodeMapped(r.Body)
+		} else if collectFields() {
+			var raw bytes.Buffer
+			if err = decodeJSON(io.TeeReader(r.Body, &raw), message, strictJSON); err == nil {
+				var payload map[string]interface{}
+				decodeJSON(&raw, &payload, false)
+				message.Fields = stringFields(payload)
+			}
+		} else {
+			err = decodeJSON(r.Body, message, strictJSON)
+		}
+		if err != nil {
+			writeError(w, r, bodyErrorStatus(r, err), err.Error())
+			return nil, false
+		}
+	}
+
+	if includeMetadata || addReceived {
+		message.Metadata = newSubmissionMetadata(r, time.Now())
+	}
+
+	if errs := message.validate(); len(errs) > 0 {
+		for _, fieldErr := range errs {
+			if fieldErr.Field == "cc" || fieldErr.Field == "reply_to" {
+				droppedTotal.Inc("copies")
+				break
+			}
+		}
+		message.cleanup()
+		writeValidationError(w, r, errs)
+		return nil, false
+	}
+	return message, true
+}
+
+// applyRoute settles the message's subject from the client's and the
+// default, or the route's, per subjectMode and, for a routed submission,
+// renders the route's body. On failure it has already written the
+// response.
+func applyRoute(w http.ResponseWriter, r *http.Request, message *Email) bool {
+	clientSubject := message.Subject
+	message.Subject = composeSubject(message.baseSubject(), clientSubject)
+	if routes != nil && message.To != "" {
+		if selected, ok := routes[message.To]; ok {
+			if selected.Subject != "" {
+				message.Subject = composeSubject(selected.Subject, clientSubject)
+			}
+			if err := selected.apply(message.To, message); err != nil {
+				log.Printf("Unable to render template for route %q: %s\n", message.To, err.Error())
+				message.cleanup()
+				writeError(w, r, http.StatusInternalServerError, "")
+				return false
+			}
+		} else if allowedRecipients != nil && message.recipientAllowed() {
+			// A MAILER_ALLOWED_RECIPIENTS key, delivered as before routes.
+		} else if unknownRouteFallback {
+			message.To = ""
+		} else {
+			droppedTotal.Inc("route")
+			message.cleanup()
+			writeError(w, r, http.StatusNotFound, "unknown route")
+			return false
+		}
+	}
+	return true
+}
+
+// deliver sends message within the send deadline and then releases its
+// attachment files. It reports whether the message was delivered, queued
+// for a retry or given up on.
+func deliver(message *Email) deliveryOutcome {
+	ctx, cancel := context.WithTimeout(context.Background(), sendDeadline)
+	defer cancel()
+	defer message.cleanup()
+	if !message.suppressRecipients() {
+		return outcomeFailed
+	}
+	result, err := message.Send(ctx)
+	var limited *rateLimitedError
+	if errors.As(err, &limited) {
+		// Nothing was attempted, so the attempt is not counted.
+		message.SendAt = time.Now().Add(limited.retryAfter)
+		if scheduleErr := messageScheduler.Schedule(message); scheduleErr != nil {
+			log.Printf("Unable to defer rate-limited message from %s: %s\n", message.From, scheduleErr.Error())
+			droppedTotal.Inc("rate_limit")
+			return outcomeFailed
+		}
+		log.Printf("Deferred message from %s: %s\n", message.From, err.Error())
+		return outcomeDeferred
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Abandoned send from %s after exceeding deadline of %s\n", message.From, sendDeadline)
+	}
+	var sizeErr *messageSizeError
+	if errors.As(err, &sizeErr) {
+		// No server will take it, so it says nothing about delivery health.
+		droppedTotal.Inc("message_size")
+		log.Printf("Not delivering message from %s: %s\n", message.From, err.Error())
+	} else if errors.Is(err, errQuotaExceeded) {
+		// Nothing was sent, so neither does a refusal by the quota.
+		log.Printf("Not delivering message from %s: %s\n", message.From, err.Error())
+	} else if err != nil && (result == nil || len(result.Accepted) == 0) {
+		deliveryHealth.recordFailure(time.Now())
+	} else {
+		deliveryHealth.recordSuccess()
+	}
+	if successWebhook != "" && result != nil && len(result.Accepted) > 0 {
+		notifyDelivered(message, result)
+	}
+	// Only the recipients that failed temporarily are retried. Scheduling
+	// takes over the attachment files.
+	if retryAfter, ok := retryDelay(message.Attempts, err); ok && result != nil {
+		if retry := result.temporaryFailures(); len(retry) > 0 {
+			message.RetryRecipients = retry
+			message.Attempts++
+			message.SendAt = time.Now().Add(retryAfter)
+			if scheduleErr := messageScheduler.Schedule(message); scheduleErr != nil {
+				log.Printf("Unable to schedule retry for %s: %s\n", strings.Join(retry, ", "), scheduleErr.Error())
+			} else {
+				return outcomeDeferred
+			}
+		}
+	}
+	if err != nil {
+		record := failureRecord{From: message.From, Subject: message.Subject, Error: err.Error(), FailedAt: time.Now()}
+		if result != nil {
+			for _, status := range result.Rejected {
+				record.Recipients = append(record.Recipients, status.Address)
+			}
+		}
+		recentFailures.Add(record)
+		return outcomeFailed
+	}
+	return outcomeDelivered
+}
+
+func validPort(port string) bool {
+	number, err := strconv.Atoi(port)
+	return err == nil && number >= 1 && number <= 65535
+}
+
+// apply installs the settings in c for the rest of the package and sets
+// up what they call for: the queue backend and scheduler, caches, lists
+// read from files and the transport. Problems found here are the ones
+// validate cannot see, such as unreadable files.
+func (c *Config) apply() error {
+	inboxAddress, outboundSender, whitelistedDomain = c.Inbox, c.Sender, c.WhitelistedDomain
+	adminToken = c.AdminToken
+	bounceAddress, returnPathHeader = c.BounceAddress, c.ReturnPathHeader
+	sendDeadline = c.SendDeadline
+	maxBodyBytes, maxAttachmentBytes, maxUploadBytes, maxMessageBytes = c.MaxBodyBytes, c.MaxAttachmentBytes, c.MaxUploadBytes, c.MaxMessageBytes
+	maxAttachments = c.MaxAttachments
+	allowedAttachmentTypes = make(map[string]bool)
+	for _, mediaType := range c.AttachmentTypes {
+		allowedAttachmentTypes[strings.ToLower(mediaType)] = true
+	}
+	if len(c.ContentTypes) > 0 {
+		allowedContentTypes = nil
+		for _, mediaType := range c.ContentTypes {
+			if mediaType = strings.ToLower(mediaType); !slices.Contains(allowedContentTypes, mediaType) {
+				allowedContentTypes = append(allowedContentTypes, mediaType)
+			}
+		}
+	}
+	fieldMap = c.fieldMap
+	strictJSON, prettyJSON, strictAccept = c.StrictJSON, c.PrettyJSON, c.StrictAccept
+	allowHTML, allowInvalidUTF8, smtpUTF8Enabled = c.AllowHTML, c.AllowInvalidUTF8, c.SMTPUTF8
+	allowCc, maxCc, allowReplyTo = c.AllowCc, c.MaxCc, c.AllowReplyTo
+	if c.CcAllowedDomains != "" {
+		ccAllowedDomains = make(domainSet)
+		ccAllowedDomains.addList(c.CcAllowedDomains)
+	}
+	replyToAlias, copyReplyToAlias = c.ReplyTo, c.ReplyToMode == "cc"
+	maxScheduleAhead = c.MaxScheduleAhead
+	successMessage, successRedirect, errorRedirect = c.SuccessMessage, c.SuccessRedirect, c.ErrorRedirect
+	failWhenDegraded = c.FailWhenDegraded
+	deliveryHealth.threshold, deliveryHealth.cooldown = c.DegradedAfterFailures, c.DegradedCooldown
+	if c.DedupWindow > 0 {
+		submissionDedup = newDedupCache(c.DedupWindow, 4096)
+	}
+	if c.globalRate.count > 0 {
+		globalRateLimit = newTokenBucket(c.globalRate.count, c.globalRate.per)
+		registerGaugeFunc("mailer_global_rate_utilization", "Fraction of the global send rate budget in use.", globalRateLimit.Utilization)
+		registerGaugeFunc("mailer_global_rate_waiting", "Sends queued waiting for the global rate limiter.", func() float64 {
+			return float64(globalRateLimit.Waiting())
+		})
+	}
+
+	enforceOrigin, allowNoOrigin, requireOriginMatch, varyOrigin = c.EnforceOrigin, c.AllowNoOrigin, c.RequireOriginMatch, c.CORSVary
+	clientIPHeader, trustedProxyHops = c.ClientIPHeader, c.TrustedProxyHops
+	if clientIPHeader != "" {
+		log.Printf("Trusting client IP from the %s header; ensure a proxy always overwrites it\n", clientIPHeader)
+	}
+	proxyProtocolUpstreams = c.proxyUpstreams
+
+	if c.BlockedFromDomains != "" || c.BlockedFromDomainsFile != "" {
+		blockedFromDomains = make(domainSet)
+		blockedFromDomains.addList(c.BlockedFromDomains)
+		if c.BlockedFromDomainsFile != "" {
+			if err := blockedFromDomains.loadFile(c.BlockedFromDomainsFile); err != nil {
+				return fmt.Errorf("Unable to load MAILER_BLOCKED_FROM_DOMAINS_FILE: %s", err)
+			}
+		}
+	}
+	if c.BlockDisposable {
+		domains, err := loadDisposableDomains(c.DisposableList)
+		if err != nil {
+			return fmt.Errorf("Unable to load MAILER_DISPOSABLE_LIST: %s", err)
+		}
+		disposableDomains = domains
+	}
+	verifySender, verifySenderTimeout = c.VerifySender, c.VerifySenderTimeout
+	rejectLinkOnly, dropLinkOnly, linkRatioThreshold = c.RejectLinkOnly, c.LinkOnlyAction == "drop", c.LinkRatioThreshold
+	if c.SuppressFile != "" {
+		list, err := loadSuppressionList(c.SuppressFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load MAILER_SUPPRESS_FILE: %s", err)
+		}
+		suppressions = list
+	}
+	registerGaugeFunc("mailer_suppressed_addresses", "Addresses and domains deliveries skip.", func() float64 {
+		return float64(suppressions.Len())
+	})
+
+	allowedRecipients = c.allowedRecipients
+	if c.Routes != "" {
+		parsed, err := loadRoutes(c.Routes)
+		if err != nil {
+			return fmt.Errorf("MAILER_ROUTES is invalid: %s", err)
+		}
+		routes = parsed
+		registerGaugeVecFunc("mailer_route_rate_waiting", "Sends queued waiting for their route's rate limiter.", "route", routeRateWaiting)
+	}
+	unknownRouteFallback = c.UnknownRoute == "default"
+	subjectPrefix = stripLineBreaks(c.SubjectPrefix)
+	subjectMode, defaultSubject, subjectTemplate = c.SubjectMode, stripLineBreaks(c.DefaultSubject), c.subjectTemplate
+	alignFromTemplate, fromTemplate = c.alignFromTemplate, c.fromTemplate
+	if fromTemplate != nil && alignFromTemplate != nil {
+		log.Printf("Warning: MAILER_FROM_TEMPLATE is set, so MAILER_ALIGN_FROM has no effect\n")
+	}
+	setSenderHeader = c.SetSender
+	userAgent = "andrewstucki-mailer/" + version
+	if c.UserAgent != nil {
+		userAgent = stripLineBreaks(*c.UserAgent)
+	}
+	includeMetadata, addReceived = c.IncludeMetadata, c.AddReceived
+	if addReceived {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = addressDomain(outboundSender)
+		}
+		receivedHost = stripLineBreaks(hostname)
+	}
+	bodyHeader, bodyFooter = c.BodyHeader, c.BodyFooter
+	htmlBodyHeader, htmlBodyFooter = c.HTMLBodyHeader, c.HTMLBodyFooter
+	bodySeparator = "\n\n"
+	if c.BodySeparator != nil {
+		bodySeparator = *c.BodySeparator
+	}
+	if c.ARCDomain != "" {
+		signer, err := loadARCSigner(c.ARCDomain, c.ARCSelector, c.ARCKeyFile, c.ARCAuthservID)
+		if err != nil {
+			return fmt.Errorf("Unable to load ARC signing key: %s", err)
+		}
+		arcSealer = signer
+	}
+	debugDumpDir, debugDumpMaxBytes = c.DebugDumpDir, c.DebugDumpMaxBytes
+	if debugDumpDir != "" {
+		if err := os.MkdirAll(debugDumpDir, 0700); err != nil {
+			return fmt.Errorf("Unable to create MAILER_DEBUG_DUMP_DIR: %s", err)
+		}
+		log.Printf("Dumping every outbound message to %s\n", debugDumpDir)
+	}
+	logBodyTruncate, logDeliveryAttempts = c.LogBodyTruncate, c.LogDeliveryAttempt
+
+	var backend queueBackend
+	var quotaStore quotaCounter
+	poll := time.Hour
+	switch c.QueueBackend {
+	case "memory":
+		backend, _ = newLocalQueue("")
+		quotaStore, _ = newLocalQuota("")
+	case "disk":
+		queue, err := newLocalQueue(c.SpoolDir)
+		if err != nil {
+			return fmt.Errorf("Unable to open MAILER_SPOOL_DIR: %s", err)
+		}
+		backend = queue
+		counter, err := newLocalQuota(filepath.Join(c.SpoolDir, "quota"))
+		if err != nil {
+			return fmt.Errorf("Unable to read the daily quota from MAILER_SPOOL_DIR: %s", err)
+		}
+		quotaStore = counter
+	case "redis":
+		client, err := newRedisClient(c.RedisURL)
+		if err != nil {
+			return fmt.Errorf("MAILER_REDIS_URL is invalid: %s", err)
+		}
+		backend = newRedisQueue(client, "mailer:")
+		quotaStore = newRedisQuota(client, "mailer:")
+		poll = 5 * time.Second
+	}
+	messageScheduler = newScheduler(backend, c.QueueVisibility, poll, c.QueueWorkers)
+	priorityAging = c.PriorityAging
+	if c.DigestInterval > 0 {
+		path := ""
+		if c.SpoolDir != "" {
+			path = filepath.Join(c.SpoolDir, "digest.jsonl")
+		} else {
+			log.Println("Warning: without MAILER_SPOOL_DIR, submissions waiting for a digest are lost on restart")
+		}
+		buffer, err := newDigestBuffer(path, c.DigestInterval, c.DigestMax)
+		if err != nil {
+			return fmt.Errorf("Unable to read the digest buffer: %s", err)
+		}
+		digests = buffer
+		registerGaugeFunc("mailer_digest_buffered", "Submissions waiting for the next digest.", func() float64 {
+			return float64(digests.Len())
+		})
+	}
+	if c.DailyQuota > 0 {
+		dailySendQuota = newDailyQuota(c.DailyQuota, quotaStore)
+		registerGaugeFunc("mailer_daily_quota_remaining", "Messages that may still be sent today.", func() float64 {
+			return float64(dailySendQuota.Remaining(time.Now()))
+		})
+	}
+	retryRejectedAfter, retrySchedule = c.RetryRejectedAfter, c.RetrySchedule
+	dnsRetryAfter, dnsRetryWindow = c.DNSRetryAfter, c.DNSRetryWindow
+	recentFailures = newFailureBuffer(c.FailureBufferSize)
+
+	transport = newTransport(c)
+	mailgunWebhookKey = c.MailgunWebhookKey
+	if len(c.SNSTopicARNs) > 0 {
+		snsTopicARNs = make(map[string]bool)
+		for _, arn := range c.SNSTopicARNs {
+			snsTopicARNs[arn] = true
+		}
+	}
+	smarthostAddress, fallbackSmarthost, ownDomainViaSmarthost = c.Smarthost, c.FallbackSmarthost, c.OwnDomainViaSmarthost
+	if warning := ownDomainWarning(); warning != "" {
+		log.Printf("Warning: %s\n", warning)
+	}
+	if c.SMTPUsername != "" {
+		smarthostCredentials = &smtpCredentials{
+			Username:  c.SMTPUsername,
+			Password:  c.SMTPPassword,
+			Mechanism: c.SMTPAuth,
+		}
+	}
+	if c.SMTPProxy != "" {
+		dialer, err := newSMTPProxy(c.SMTPProxy)
+		if err != nil {
+			return fmt.Errorf("MAILER_SMTP_PROXY is invalid: %s", err)
+		}
+		smtpProxy = dialer
+	}
+	if sourceIP = c.sourceIP; sourceIP != nil {
+		if local, err := isLocalAddress(sourceIP); err != nil {
+			log.Printf("Warning: unable to list local addresses to check MAILER_SOURCE_IP: %s\n", err)
+		} else if !local {
+			log.Printf("Warning: MAILER_SOURCE_IP %s is not assigned to any local interface; deliveries will fail until it is\n", sourceIP)
+		}
+		if smtpProxy != nil {
+			log.Println("Warning: MAILER_SOURCE_IP is not used for connections through MAILER_SMTP_PROXY")
+		}
+	}
+	spoolRateLimited = c.RateLimitAction == "spool"
+	dialFallbackDelay, smtpQuitTimeout, smtpKeepAlive = c.DialFallbackDelay, c.SMTPQuitTimeout, c.SMTPKeepAlive
+	maxConnsPerHost, bdatThreshold = c.MaxConnsPerHost, c.BDATThreshold
+	registerGaugeVecFunc("mailer_smtp_connections", "Deliveries in progress, by SMTP server.", "host", hostConns.counts)
+	requireTLS, tlsMinVersion, tlsCipherSuites = c.TLSRequired, c.tlsMinVersion, c.tlsCipherSuites
+	if c.TLSCAFile != "" {
+		pool, err := loadRootCAs(c.TLSCAFile, c.TLSCAMode == "replace")
+		if err != nil {
+			return fmt.Errorf("MAILER_TLS_CA_FILE is invalid: %s", err)
+		}
+		tlsRootCAs = pool
+	}
+
+	successWebhook, webhookTimeout = c.SuccessWebhook, c.WebhookTimeout
+	httpClient.Timeout = c.HTTPClientTimeout
+	if c.DBDSN != "" {
+		recorder, err := newAuditLog(c.DBDriver, c.DBDSN, c.DBBuffer)
+		if err != nil {
+			return fmt.Errorf("Unable to set up the submissions database: %s", err)
+		}
+		submissionLog = recorder
+	}
+	registerGaugeFunc("mailer_degraded", "Whether outbound delivery is currently considered broken.", func() float64 {
+		if degraded, _ := deliveryHealth.Degraded(time.Now()); degraded {
+			return 1
+		}
+		return 0
+	})
+	return nil
+}
+
+// listenAddresses returns where the server listens: MAILER_LISTEN, or
+// else the OpenShift address or MAILER_PORT.
+func (c *Config) listenAddresses() []string {
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
 	openshiftPort := os.Getenv("OPENSHIFT_GO_PORT")
 	openshiftIP := os.Getenv("OPENSHIFT_GO_IP")
+	if openshiftIP != "" && openshiftPort != "" {
+		return []string{fmt.Sprintf("%s:%s", openshiftIP, openshiftPort)}
+	}
+	if strings.Contains(c.Port, ":") {
+		return []string{c.Port}
+	}
+	return []string{fmt.Sprintf(":%s", c.Port)}
+}
 
-	if inboxAddress == "" || outboundSender == "" || whitelistedDomain == "" {
-		log.Fatal("MAILER_INBOX, MAILER_SENDER, and MAILER_WHITELISTED_DOMAIN must be set")
-		os.Exit(1)
+func main() {
+	sendTest := flag.Bool("send-test", false, "send a test message to MAILER_INBOX and exit")
+	configFile := flag.String("config", "", "read settings from this NAME=VALUE file (default $MAILER_CONFIG)")
+	flag.Var(config.flags, "set", "set a setting as NAME=VALUE, overriding the environment (repeatable)")
+	registerSettingFlags(flag.CommandLine, config.flags)
+	flag.Parse()
+	if *configFile == "" {
+		*configFile = os.Getenv("MAILER_CONFIG")
 	}
-	if mailerPort == "" {
-		mailerPort = "8080"
+	if *configFile != "" {
+		settings, err := loadConfigFile(*configFile)
+		if err != nil {
+			log.Fatalf("Unable to read config file: %s", err)
+		}
+		config.file = settings
 	}
 
-	if openshiftIP != "" && openshiftPort != "" {
-		interfaceAddress = fmt.Sprintf("%s:%s", openshiftIP, openshiftPort)
-	} else {
-		interfaceAddress = fmt.Sprintf(":%s", mailerPort)
+	cfg, err := loadConfig(config)
+	if err != nil {
+		log.Fatal(err)
 	}
+	settings, err := loadMaintenance()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if unknown := config.unknown(); len(unknown) > 0 {
+		log.Fatalf("Unknown settings: %s", strings.Join(unknown, ", "))
+	}
+	if err := cfg.apply(); err != nil {
+		log.Fatal(err)
+	}
+	maintenance.Store(settings)
+	if *sendTest {
+		os.Exit(runSendTest())
+	}
+	// Started only once configuration is complete, as restored messages
+	// may be dispatched straight away.
+	go messageScheduler.Run()
+	if digests != nil {
+		go digests.Run()
+	}
+	go reloadOnHangup(*configFile)
 
-	sendEndpoint := &SendHandler{}
-	http.Handle("/send", corsPanicHandler(sendEndpoint))
-	log.Fatal(http.ListenAndServe(interfaceAddress, nil))
+	if err := serve(&http.Server{Handler: newRouter()}, cfg.listenAddresses()); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport records the messages handed to it instead of sending them.
+type fakeTransport struct {
+	mu        sync.Mutex
+	delivered []*Email
+	err       error
+}
+
+func (f *fakeTransport) Deliver(ctx context.Context, message *Email, msg []byte) (*deliveryResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delivered = append(f.delivered, message)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &deliveryResult{Accepted: []string{message.recipient()}}, nil
+}
+
+func (f *fakeTransport) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.delivered)
+}
+
+// setupSendHandler sets the settings /send needs to the values main would
+// give them, with delivery going to the returned transport.
+func setupSendHandler(t *testing.T) *fakeTransport {
+	t.Helper()
+	fake := &fakeTransport{}
+	saved := transport
+	transport = fake
+	inboxAddress = "inbox@example.com"
+	outboundSender = "mailer@example.com"
+	maxBodyBytes = 1 << 20
+	maxMessageBytes = 25 << 20
+	sendDeadline = 5 * time.Second
+	maxScheduleAhead = 30 * 24 * time.Hour
+	maintenance.Store(&maintenanceSettings{})
+	queue, _ := newLocalQueue("")
+	messageScheduler = newScheduler(queue, time.Minute, time.Hour, 1)
+	t.Cleanup(func() {
+		transport = saved
+		inboxAddress, outboundSender = "", ""
+		maxBodyBytes, maxMessageBytes = 0, 0
+		messageScheduler = nil
+		submissionDedup = nil
+		allowedContentTypes = submissionContentTypes
+	})
+	return fake
+}
+
+// postSend submits body to /send with the given content type.
+func postSend(contentType string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/send", strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	(&SendHandler{}).ServeHTTP(w, r)
+	return w
+}
+
+// failingQueue is a queue backend that cannot store anything.
+type failingQueue struct{ *localQueue }
+
+func (failingQueue) Push(*scheduledMessage) error { return errors.New("disk full") }
+
+func TestDedupForgetsFailedSubmission(t *testing.T) {
+	setupSendHandler(t)
+	submissionDedup = newDedupCache(time.Minute, 16)
+	broken, _ := newLocalQueue("")
+	messageScheduler = newScheduler(failingQueue{broken}, time.Minute, time.Hour, 1)
+
+	body := `{"from": "visitor@example.org", "body": "hello", "sendat": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`
+	if w := postSend("application/json", body); w.Code != http.StatusInternalServerError {
+		t.Fatalf("failed schedule answered %d, want 500", w.Code)
+	}
+	queue, _ := newLocalQueue("")
+	messageScheduler = newScheduler(queue, time.Minute, time.Hour, 1)
+	if w := postSend("application/json", body); w.Code != http.StatusAccepted {
+		t.Fatalf("retry answered %d, want 202", w.Code)
+	}
+	if next, ok, _ := queue.NextDue(); !ok || next.IsZero() {
+		t.Error("the retry was taken for a duplicate and never scheduled")
+	}
+}
+
+func TestDedupSuppressesRepeat(t *testing.T) {
+	fake := setupSendHandler(t)
+	submissionDedup = newDedupCache(time.Minute, 16)
+
+	body := `{"from": "visitor@example.org", "body": "hello"}`
+	for i := 0; i < 2; i++ {
+		if w := postSend("application/json", body); w.Code != http.StatusAccepted {
+			t.Fatalf("submission %d answered %d, want 202", i, w.Code)
+		}
+	}
+	waitFor(t, func() bool { return fake.count() >= 1 })
+	time.Sleep(20 * time.Millisecond)
+	if n := fake.count(); n != 1 {
+		t.Errorf("delivered %d messages, want 1", n)
+	}
+}
+
+func TestSendBindsClientSubject(t *testing.T) {
+	fake := setupSendHandler(t)
+	subjectMode = "client"
+	defer func() { subjectMode = "default" }()
+
+	body := `{"from": "visitor@example.org", "subject": "Pricing question", "body": "hello"}`
+	if w := postSend("application/json", body); w.Code != http.StatusAccepted {
+		t.Fatalf("answered %d, want 202", w.Code)
+	}
+	waitFor(t, func() bool { return fake.count() == 1 })
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if got := fake.delivered[0].Subject; got != "Pricing question" {
+		t.Errorf("delivered subject %q, want the client's", got)
+	}
+}
+
+func TestSendRestrictsContentTypes(t *testing.T) {
+	fake := setupSendHandler(t)
+	body := `{"from": "visitor@example.org", "body": "hello"}`
+
+	if w := postSend("text/plain", body); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("text/plain answered %d, want 415", w.Code)
+	}
+
+	allowedContentTypes = []string{"application/json"}
+	w := postSend("application/x-www-form-urlencoded", "from=visitor%40example.org&body=hello")
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("a form outside MAILER_ALLOWED_CONTENT_TYPES answered %d, want 415", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "application/json") || strings.Contains(w.Body.String(), "multipart") {
+		t.Errorf("415 response %q does not list just the allowed type", w.Body.String())
+	}
+	for _, contentType := range []string{"application/json", "application/json; charset=utf-8", "Application/JSON; charset=UTF-8"} {
+		if w := postSend(contentType, body); w.Code != http.StatusAccepted {
+			t.Errorf("%q answered %d, want 202", contentType, w.Code)
+		}
+	}
+	waitFor(t, func() bool { return fake.count() == 3 })
+}
+
+func TestSendHonorsCharset(t *testing.T) {
+	fake := setupSendHandler(t)
+	allowedContentTypes = []string{"application/json"}
+
+	body := "{\"from\": \"visitor@example.org\", \"body\": \"caf\xe9\"}"
+	if w := postSend("application/json; charset=iso-8859-1", body); w.Code != http.StatusAccepted {
+		t.Fatalf("answered %d, want 202", w.Code)
+	}
+	waitFor(t, func() bool { return fake.count() == 1 })
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if got := fake.delivered[0].Body; got != "café" {
+		t.Errorf("body = %q, want it decoded from Latin-1", got)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	read   int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestSendRefusesOversizedBodies(t *testing.T) {
+	fake := setupSendHandler(t)
+	maxBodyBytes = 1 << 10
+	oversized := `{"from": "visitor@example.org", "body": "` + strings.Repeat("x", 64<<10) + `"}`
+
+	// With a declared length the body is refused unread.
+	body := &countingReader{reader: strings.NewReader(oversized)}
+	r := httptest.NewRequest("POST", "/send", body)
+	r.Header.Set("Content-Type", "application/json")
+	r.ContentLength = int64(len(oversized))
+	w := httptest.NewRecorder()
+	(&SendHandler{}).ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a declared oversized body answered %d, want 413", w.Code)
+	}
+	if body.read != 0 {
+		t.Errorf("read %d bytes of a body whose declared length is over the limit", body.read)
+	}
+
+	// Sent chunked, it is cut off at the limit.
+	body = &countingReader{reader: strings.NewReader(oversized)}
+	r = httptest.NewRequest("POST", "/send", body)
+	r.Header.Set("Content-Type", "application/json")
+	r.ContentLength = -1
+	r.TransferEncoding = []string{"chunked"}
+	w = httptest.NewRecorder()
+	(&SendHandler{}).ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a chunked oversized body answered %d, want 413", w.Code)
+	}
+	if body.read > int(maxBodyBytes)+1 {
+		t.Errorf("read %d bytes of a chunked body over the %d byte limit", body.read, maxBodyBytes)
+	}
+	if fake.count() != 0 {
+		t.Error("an oversized body was delivered")
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Config holds every MAILER_* setting main reads at startup. loadConfig
+// fills it from the layered sources, using the defaults given here, and
+// checks it as a whole, so a bad setting is reported before anything is
+// started. Each field can also be given as a flag named after its setting,
+// e.g. -send-deadline for MAILER_SEND_DEADLINE. Maintenance mode is read
+// separately as it can be reloaded.
+type Config struct {
+	Inbox             string   `setting:"MAILER_INBOX"`
+	Sender            string   `setting:"MAILER_SENDER"`
+	WhitelistedDomain string   `setting:"MAILER_WHITELISTED_DOMAIN"`
+	Port              string   `setting:"MAILER_PORT" default:"8080"`
+	Listen            []string `setting:"MAILER_LISTEN"`
+	AdminToken        string   `setting:"MAILER_ADMIN_TOKEN"`
+
+	// Submissions.
+	SendDeadline          time.Duration `setting:"MAILER_SEND_DEADLINE" default:"5m"`
+	DedupWindow           time.Duration `setting:"MAILER_DEDUP_WINDOW"`
+	MaxBodyBytes          int64         `setting:"MAILER_MAX_BODY_BYTES" default:"1048576"`
+	MaxAttachmentBytes    int64         `setting:"MAILER_MAX_ATTACHMENT_BYTES" default:"5242880"`
+	MaxUploadBytes        int64         `setting:"MAILER_MAX_UPLOAD_BYTES" default:"10485760"`
+	MaxMessageBytes       int64         `setting:"MAILER_MAX_MESSAGE_BYTES" default:"26214400"`
+	MaxAttachments        int           `setting:"MAILER_MAX_ATTACHMENTS" default:"10"`
+	AttachmentTypes       []string      `setting:"MAILER_ALLOWED_ATTACHMENT_TYPES" default:"application/pdf,image/png,image/jpeg,image/gif,text/plain"`
+	ContentTypes          []string      `setting:"MAILER_ALLOWED_CONTENT_TYPES"`
+	FieldMap              string        `setting:"MAILER_FIELD_MAP"`
+	StrictJSON            bool          `setting:"MAILER_STRICT_JSON"`
+	PrettyJSON            bool          `setting:"MAILER_PRETTY_JSON"`
+	StrictAccept          bool          `setting:"MAILER_STRICT_ACCEPT"`
+	AllowHTML             bool          `setting:"MAILER_ALLOW_HTML"`
+	AllowInvalidUTF8      bool          `setting:"MAILER_ALLOW_INVALID_UTF8"`
+	SMTPUTF8              bool          `setting:"MAILER_SMTPUTF8"`
+	AllowCc               bool          `setting:"MAILER_ALLOW_CC"`
+	CcAllowedDomains      string        `setting:"MAILER_CC_ALLOWED_DOMAINS"`
+	MaxCc                 int           `setting:"MAILER_MAX_CC" default:"5"`
+	AllowReplyTo          bool          `setting:"MAILER_ALLOW_REPLY_TO"`
+	ReplyTo               string        `setting:"MAILER_REPLY_TO"`
+	ReplyToMode           string        `setting:"MAILER_REPLY_TO_MODE" default:"reply-to"`
+	MaxScheduleAhead      time.Duration `setting:"MAILER_MAX_SCHEDULE_AHEAD" default:"720h"`
+	SuccessMessage        string        `setting:"MAILER_SUCCESS_MESSAGE"`
+	SuccessRedirect       string        `setting:"MAILER_SUCCESS_REDIRECT"`
+	ErrorRedirect         string        `setting:"MAILER_ERROR_REDIRECT"`
+	FailWhenDegraded      bool          `setting:"MAILER_FAIL_WHEN_DEGRADED"`
+	DegradedAfterFailures int           `setting:"MAILER_DEGRADED_AFTER_FAILURES" default:"5"`
+	DegradedCooldown      time.Duration `setting:"MAILER_DEGRADED_COOLDOWN" default:"1m"`
+	DailyQuota            int           `setting:"MAILER_DAILY_QUOTA"`
+	GlobalRate            string        `setting:"MAILER_GLOBAL_RATE"`
+	RateLimitAction       string        `setting:"MAILER_RATE_LIMIT_ACTION" default:"spool"`
+
+	// Origin and client checks.
+	EnforceOrigin          bool   `setting:"MAILER_ENFORCE_ORIGIN"`
+	AllowNoOrigin          bool   `setting:"MAILER_ALLOW_NO_ORIGIN"`
+	RequireOriginMatch     bool   `setting:"MAILER_REQUIRE_ORIGIN_MATCH"`
+	CORSVary               bool   `setting:"MAILER_CORS_VARY" default:"true"`
+	ClientIPHeader         string `setting:"MAILER_CLIENT_IP_HEADER"`
+	TrustedProxyHops       int    `setting:"MAILER_TRUSTED_PROXY_HOPS" default:"1"`
+	ProxyProtocol          bool   `setting:"MAILER_PROXY_PROTOCOL"`
+	ProxyProtocolUpstreams string `setting:"MAILER_PROXY_PROTOCOL_UPSTREAMS"`
+
+	// Sender and content filters.
+	BlockedFromDomains     string        `setting:"MAILER_BLOCKED_FROM_DOMAINS"`
+	BlockedFromDomainsFile string        `setting:"MAILER_BLOCKED_FROM_DOMAINS_FILE"`
+	BlockDisposable        bool          `setting:"MAILER_BLOCK_DISPOSABLE"`
+	DisposableList         string        `setting:"MAILER_DISPOSABLE_LIST"`
+	VerifySender           bool          `setting:"MAILER_VERIFY_SENDER"`
+	VerifySenderTimeout    time.Duration `setting:"MAILER_VERIFY_SENDER_TIMEOUT" default:"5s"`
+	RejectLinkOnly         bool          `setting:"MAILER_REJECT_LINK_ONLY"`
+	LinkOnlyAction         string        `setting:"MAILER_LINK_ONLY_ACTION" default:"reject"`
+	LinkRatioThreshold     float64       `setting:"MAILER_LINK_RATIO_THRESHOLD" default:"0.8"`
+	SuppressFile           string        `setting:"MAILER_SUPPRESS_FILE"`
+
+	// Routing and composition.
+	AllowedRecipients  string  `setting:"MAILER_ALLOWED_RECIPIENTS"`
+	Routes             string  `setting:"MAILER_ROUTES"`
+	UnknownRoute       string  `setting:"MAILER_UNKNOWN_ROUTE" default:"reject"`
+	SubjectPrefix      string  `setting:"MAILER_SUBJECT_PREFIX"`
+	SubjectMode        string  `setting:"MAILER_SUBJECT_MODE" default:"default"`
+	DefaultSubject     string  `setting:"MAILER_DEFAULT_SUBJECT" default:"New Web Inquiry"`
+	SubjectTemplate    string  `setting:"MAILER_SUBJECT_TEMPLATE"`
+	FromTemplate       string  `setting:"MAILER_FROM_TEMPLATE"`
+	AlignFrom          bool    `setting:"MAILER_ALIGN_FROM"`
+	AlignFromTemplate  string  `setting:"MAILER_ALIGN_FROM_TEMPLATE"`
+	SetSender          bool    `setting:"MAILER_SET_SENDER"`
+	BounceAddress      string  `setting:"MAILER_BOUNCE_ADDRESS"`
+	ReturnPathHeader   bool    `setting:"MAILER_RETURN_PATH_HEADER"`
+	UserAgent          *string `setting:"MAILER_USER_AGENT"`
+	IncludeMetadata    bool    `setting:"MAILER_INCLUDE_METADATA"`
+	AddReceived        bool    `setting:"MAILER_ADD_RECEIVED"`
+	BodyHeader         string  `setting:"MAILER_BODY_HEADER"`
+	BodyFooter         string  `setting:"MAILER_BODY_FOOTER"`
+	BodySeparator      *string `setting:"MAILER_BODY_SEPARATOR"`
+	HTMLBodyHeader     string  `setting:"MAILER_HTML_BODY_HEADER"`
+	HTMLBodyFooter     string  `setting:"MAILER_HTML_BODY_FOOTER"`
+	ARCDomain          string  `setting:"MAILER_ARC_DOMAIN"`
+	ARCSelector        string  `setting:"MAILER_ARC_SELECTOR"`
+	ARCKeyFile         string  `setting:"MAILER_ARC_KEY_FILE"`
+	ARCAuthservID      string  `setting:"MAILER_ARC_AUTHSERV_ID"`
+	DebugDumpDir       string  `setting:"MAILER_DEBUG_DUMP_DIR"`
+	DebugDumpMaxBytes  int64   `setting:"MAILER_DEBUG_DUMP_MAX_BYTES" default:"52428800"`
+	LogBodyTruncate    int     `setting:"MAILER_LOG_BODY_TRUNCATE" default:"256"`
+	LogDeliveryAttempt bool    `setting:"MAILER_LOG_DELIVERY_ATTEMPTS"`
+
+	// Queueing and retries.
+	SpoolDir           string          `setting:"MAILER_SPOOL_DIR"`
+	QueueBackend       string          `setting:"MAILER_QUEUE_BACKEND"`
+	RedisURL           string          `setting:"MAILER_REDIS_URL"`
+	QueueVisibility    time.Duration   `setting:"MAILER_QUEUE_VISIBILITY_TIMEOUT"`
+	QueueWorkers       int             `setting:"MAILER_QUEUE_WORKERS" default:"10"`
+	PriorityAging      time.Duration   `setting:"MAILER_PRIORITY_AGING" default:"15m"`
+	DigestInterval     time.Duration   `setting:"MAILER_DIGEST_INTERVAL"`
+	DigestMax          int             `setting:"MAILER_DIGEST_MAX"`
+	RetryRejectedAfter time.Duration   `setting:"MAILER_RETRY_REJECTED_AFTER"`
+	RetrySchedule      []time.Duration `setting:"MAILER_RETRY_SCHEDULE"`
+	DNSRetryAfter      time.Duration   `setting:"MAILER_DNS_RETRY_AFTER" default:"5m"`
+	DNSRetryWindow     time.Duration   `setting:"MAILER_DNS_RETRY_WINDOW" default:"24h"`
+	FailureBufferSize  int             `setting:"MAILER_FAILURE_BUFFER_SIZE" default:"100"`
+
+	// Transport.
+	Transport             string        `setting:"MAILER_TRANSPORT" default:"smtp"`
+	MailgunDomain         string        `setting:"MAILER_MAILGUN_DOMAIN"`
+	MailgunAPIKey         string        `setting:"MAILER_MAILGUN_API_KEY"`
+	MailgunAPIBase        string        `setting:"MAILER_MAILGUN_API_BASE" default:"https://api.mailgun.net"`
+	MailgunWebhookKey     string        `setting:"MAILER_MAILGUN_WEBHOOK_KEY"`
+	SNSTopicARNs          []string      `setting:"MAILER_SNS_TOPIC_ARNS"`
+	Smarthost             string        `setting:"MAILER_SMARTHOST"`
+	FallbackSmarthost     string        `setting:"MAILER_FALLBACK_SMARTHOST"`
+	OwnDomainViaSmarthost bool          `setting:"MAILER_OWN_DOMAIN_VIA_SMARTHOST"`
+	SMTPUsername          string        `setting:"MAILER_SMTP_USERNAME"`
+	SMTPPassword          string        `setting:"MAILER_SMTP_PASSWORD"`
+	SMTPAuth              string        `setting:"MAILER_SMTP_AUTH" default:"auto"`
+	SMTPProxy             string        `setting:"MAILER_SMTP_PROXY"`
+	SourceIP              string        `setting:"MAILER_SOURCE_IP"`
+	DialFallbackDelay     time.Duration `setting:"MAILER_DIAL_FALLBACK_DELAY"`
+	SMTPQuitTimeout       time.Duration `setting:"MAILER_SMTP_QUIT_TIMEOUT" default:"5s"`
+	SMTPKeepAlive         time.Duration `setting:"MAILER_SMTP_KEEPALIVE"`
+	MaxConnsPerHost       int           `setting:"MAILER_MAX_CONNS_PER_HOST"`
+	BDATThreshold         int           `setting:"MAILER_BDAT_THRESHOLD" default:"1048576"`
+	TLSRequired           bool          `setting:"MAILER_TLS_REQUIRED"`
+	TLSMinVersion         string        `setting:"MAILER_TLS_MIN_VERSION" default:"1.2"`
+	TLSCipherSuites       string        `setting:"MAILER_TLS_CIPHER_SUITES"`
+	TLSCAFile             string        `setting:"MAILER_TLS_CA_FILE"`
+	TLSCAMode             string        `setting:"MAILER_TLS_CA_MODE"`
+
+	// Integrations.
+	SuccessWebhook    string        `setting:"MAILER_SUCCESS_WEBHOOK"`
+	WebhookTimeout    time.Duration `setting:"MAILER_WEBHOOK_TIMEOUT" default:"10s"`
+	HTTPClientTimeout time.Duration `setting:"MAILER_HTTP_CLIENT_TIMEOUT" default:"1m"`
+	DBDriver          string        `setting:"MAILER_DB_DRIVER" default:"postgres"`
+	DBDSN             string        `setting:"MAILER_DB_DSN"`
+	DBBuffer          int           `setting:"MAILER_DB_BUFFER" default:"1000"`
+
+	// Parsed forms of the settings above, set by validate.
+	fieldMap          map[string]string
+	globalRate        tokenBucketRate
+	proxyUpstreams    []*net.IPNet
+	allowedRecipients map[string]string
+	subjectTemplate   *template.Template
+	fromTemplate      *template.Template
+	alignFromTemplate *template.Template
+	tlsMinVersion     uint16
+	tlsCipherSuites   []uint16
+	sourceIP          net.IP
+}
+
+// tokenBucketRate is a parsed MAILER_GLOBAL_RATE.
+type tokenBucketRate struct {
+	count int
+	per   time.Duration
+}
+
+// validate checks the settings against each other and parses those with
+// a format of their own. It reports the first problem found.
+func (c *Config) validate() error {
+	if c.Inbox == "" || c.Sender == "" || c.WhitelistedDomain == "" {
+		return errors.New("MAILER_INBOX, MAILER_SENDER, and MAILER_WHITELISTED_DOMAIN must be set")
+	}
+	for _, address := range []*string{&c.Inbox, &c.Sender, &c.BounceAddress} {
+		normalized, _, err := normalizeAddress(*address)
+		if err != nil {
+			return fmt.Errorf("Invalid address %q: %s", *address, err)
+		}
+		*address = normalized
+	}
+	if strings.Contains(c.Port, ":") {
+		if _, port, err := net.SplitHostPort(c.Port); err != nil || !validPort(port) {
+			return fmt.Errorf("MAILER_PORT %q must be a port number or a host:port address such as 127.0.0.1:8080", c.Port)
+		}
+	} else if !validPort(c.Port) {
+		return fmt.Errorf("MAILER_PORT %q must be a port number between 1 and 65535", c.Port)
+	}
+
+	positive := []struct {
+		value   time.Duration
+		message string
+	}{
+		{c.SendDeadline, "MAILER_SEND_DEADLINE must be a positive duration, e.g. 90s"},
+		{c.MaxScheduleAhead, "MAILER_MAX_SCHEDULE_AHEAD must be a positive duration, e.g. 168h"},
+		{c.DegradedCooldown, "MAILER_DEGRADED_COOLDOWN must be a positive duration, e.g. 30s"},
+		{c.VerifySenderTimeout, "MAILER_VERIFY_SENDER_TIMEOUT must be a positive duration, e.g. 5s"},
+		{c.PriorityAging, "MAILER_PRIORITY_AGING must be a positive duration, e.g. 15m"},
+		{c.DNSRetryAfter, "MAILER_DNS_RETRY_AFTER must be a positive duration, e.g. 5m"},
+		{c.DNSRetryWindow, "MAILER_DNS_RETRY_WINDOW must be a positive duration, e.g. 24h"},
+		{c.WebhookTimeout, "MAILER_WEBHOOK_TIMEOUT must be a positive duration, e.g. 10s"},
+		{c.HTTPClientTimeout, "MAILER_HTTP_CLIENT_TIMEOUT must be a positive duration, e.g. 30s"},
+	}
+	for _, setting := range positive {
+		if setting.value <= 0 {
+			return errors.New(setting.message)
+		}
+	}
+	nonNegative := []struct {
+		value   time.Duration
+		message string
+	}{
+		{c.DedupWindow, "MAILER_DEDUP_WINDOW must be a positive duration, e.g. 30s"},
+		{c.DigestInterval, "MAILER_DIGEST_INTERVAL must be a positive duration, e.g. 1h"},
+		{c.SMTPQuitTimeout, "MAILER_SMTP_QUIT_TIMEOUT must be a duration, e.g. 5s, or 0 to close without QUIT"},
+		{c.SMTPKeepAlive, "MAILER_SMTP_KEEPALIVE must be a non-negative duration, e.g. 30s"},
+		{c.RetryRejectedAfter, "MAILER_RETRY_REJECTED_AFTER must be a non-negative duration, e.g. 15m"},
+	}
+	for _, setting := range nonNegative {
+		if setting.value < 0 {
+			return errors.New(setting.message)
+		}
+	}
+	for _, delay := range c.RetrySchedule {
+		if delay <= 0 {
+			return errors.New("MAILER_RETRY_SCHEDULE must be a comma-separated list of positive durations, e.g. 1m,5m,30m,2h")
+		}
+	}
+	if len(c.RetrySchedule) > 0 && c.RetryRejectedAfter > 0 {
+		return errors.New("MAILER_RETRY_SCHEDULE cannot be combined with MAILER_RETRY_REJECTED_AFTER")
+	}
+	if c.QueueVisibility == 0 {
+		c.QueueVisibility = 2 * c.SendDeadline
+	} else if c.QueueVisibility <= c.SendDeadline {
+		return errors.New("MAILER_QUEUE_VISIBILITY_TIMEOUT must be a duration longer than MAILER_SEND_DEADLINE")
+	}
+
+	counts := []struct {
+		value   int64
+		min     int64
+		message string
+	}{
+		{c.MaxBodyBytes, 1, "MAILER_MAX_BODY_BYTES must be a positive integer"},
+		{c.MaxAttachmentBytes, 1, "MAILER_MAX_ATTACHMENT_BYTES must be a positive integer"},
+		{c.MaxUploadBytes, 1, "MAILER_MAX_UPLOAD_BYTES must be a positive integer"},
+		{c.MaxMessageBytes, 1, "MAILER_MAX_MESSAGE_BYTES must be a positive integer"},
+		{c.DebugDumpMaxBytes, 1, "MAILER_DEBUG_DUMP_MAX_BYTES must be a positive integer"},
+		{int64(c.MaxAttachments), 0, "MAILER_MAX_ATTACHMENTS must be a non-negative integer"},
+		{int64(c.MaxCc), 0, "MAILER_MAX_CC must be a non-negative integer, 0 meaning no limit"},
+		{int64(c.DegradedAfterFailures), 1, "MAILER_DEGRADED_AFTER_FAILURES must be a positive integer"},
+		{int64(c.DailyQuota), 0, "MAILER_DAILY_QUOTA must be a positive integer"},
+		{int64(c.TrustedProxyHops), 1, "MAILER_TRUSTED_PROXY_HOPS must be a positive integer"},
+		{int64(c.LogBodyTruncate), 0, "MAILER_LOG_BODY_TRUNCATE must be a non-negative integer"},
+		{int64(c.QueueWorkers), 1, "MAILER_QUEUE_WORKERS must be a positive integer"},
+		{int64(c.DigestMax), 0, "MAILER_DIGEST_MAX must be a positive integer"},
+		{int64(c.FailureBufferSize), 1, "MAILER_FAILURE_BUFFER_SIZE must be a positive integer"},
+		{int64(c.MaxConnsPerHost), 0, "MAILER_MAX_CONNS_PER_HOST must be a non-negative integer"},
+		{int64(c.BDATThreshold), 0, "MAILER_BDAT_THRESHOLD must be a non-negative integer"},
+		{int64(c.DBBuffer), 1, "MAILER_DB_BUFFER must be a positive integer"},
+	}
+	for _, setting := range counts {
+		if setting.value < setting.min {
+			return errors.New(setting.message)
+		}
+	}
+	if c.LinkRatioThreshold <= 0 || c.LinkRatioThreshold > 1 {
+		return errors.New("MAILER_LINK_RATIO_THRESHOLD must be a number in (0, 1]")
+	}
+	if c.DigestMax > 0 && c.DigestInterval == 0 {
+		return errors.New("MAILER_DIGEST_MAX requires MAILER_DIGEST_INTERVAL")
+	}
+
+	enums := []struct {
+		value   string
+		allowed []string
+		message string
+	}{
+		{c.UnknownRoute, []string{"reject", "default"}, "MAILER_UNKNOWN_ROUTE must be reject or default"},
+		{c.SubjectMode, []string{"default", "client", "prefix"}, "MAILER_SUBJECT_MODE must be one of default, client, or prefix"},
+		{c.ReplyToMode, []string{"reply-to", "cc"}, "MAILER_REPLY_TO_MODE must be reply-to or cc"},
+		{c.LinkOnlyAction, []string{"reject", "drop"}, "MAILER_LINK_ONLY_ACTION must be reject or drop"},
+		{c.RateLimitAction, []string{"spool", "drop"}, "MAILER_RATE_LIMIT_ACTION must be spool or drop"},
+		{c.Transport, []string{"smtp", "mailgun"}, "MAILER_TRANSPORT must be smtp or mailgun"},
+		{c.SMTPAuth, []string{"auto", "plain", "login", "cram-md5"}, "MAILER_SMTP_AUTH must be one of auto, plain, login, or cram-md5"},
+		{c.TLSCAMode, []string{"", "append", "replace"}, "MAILER_TLS_CA_MODE must be append or replace"},
+	}
+	for _, setting := range enums {
+		if !slices.Contains(setting.allowed, setting.value) {
+			return errors.New(setting.message)
+		}
+	}
+	if c.QueueBackend == "" {
+		c.QueueBackend = "memory"
+		if c.SpoolDir != "" {
+			c.QueueBackend = "disk"
+		}
+	}
+	switch c.QueueBackend {
+	case "memory":
+	case "disk":
+		if c.SpoolDir == "" {
+			return errors.New("MAILER_QUEUE_BACKEND=disk requires MAILER_SPOOL_DIR")
+		}
+	case "redis":
+		if c.RedisURL == "" {
+			return errors.New("MAILER_QUEUE_BACKEND=redis requires MAILER_REDIS_URL")
+		}
+	default:
+		return errors.New("MAILER_QUEUE_BACKEND must be one of memory, disk, or redis")
+	}
+
+	if c.BounceAddress != "" {
+		if address, err := mail.ParseAddress(c.BounceAddress); err != nil || address.Address != c.BounceAddress {
+			return errors.New("MAILER_BOUNCE_ADDRESS must be a bare email address, e.g. bounces@example.com")
+		}
+	}
+	if c.ReplyTo != "" {
+		address, err := mail.ParseAddress(c.ReplyTo)
+		if err != nil || address.Address != c.ReplyTo {
+			return errors.New("MAILER_REPLY_TO must be a bare email address, e.g. team@example.com")
+		}
+		if c.ReplyTo, _, err = normalizeAddress(c.ReplyTo); err != nil {
+			return fmt.Errorf("MAILER_REPLY_TO is invalid: %s", err)
+		}
+	}
+	if c.SetSender {
+		if addresses, err := mail.ParseAddressList(c.Sender); err != nil || len(addresses) != 1 || addresses[0].Address != c.Sender {
+			return errors.New("MAILER_SET_SENDER requires MAILER_SENDER to be a single bare email address")
+		}
+	}
+	for name, target := range map[string]string{"MAILER_SUCCESS_REDIRECT": c.SuccessRedirect, "MAILER_ERROR_REDIRECT": c.ErrorRedirect} {
+		if target == "" {
+			continue
+		}
+		if parsed, err := url.Parse(target); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https" && !strings.HasPrefix(target, "/")) {
+			return fmt.Errorf("%s must be an http or https URL or an absolute path", name)
+		}
+	}
+	if c.SuccessWebhook != "" {
+		if parsed, err := url.Parse(c.SuccessWebhook); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.New("MAILER_SUCCESS_WEBHOOK must be an http or https URL")
+		}
+	}
+	for _, arn := range c.SNSTopicARNs {
+		if !strings.HasPrefix(arn, "arn:") {
+			return errors.New("MAILER_SNS_TOPIC_ARNS must be a comma-separated list of topic ARNs")
+		}
+	}
+	for _, mediaType := range c.ContentTypes {
+		if !slices.Contains(submissionContentTypes, strings.ToLower(mediaType)) {
+			return fmt.Errorf("MAILER_ALLOWED_CONTENT_TYPES may only list %s", strings.Join(submissionContentTypes, ", "))
+		}
+	}
+
+	if c.ARCDomain != "" || c.ARCSelector != "" || c.ARCKeyFile != "" {
+		if c.ARCDomain == "" || c.ARCSelector == "" || c.ARCKeyFile == "" {
+			return errors.New("MAILER_ARC_DOMAIN, MAILER_ARC_SELECTOR, and MAILER_ARC_KEY_FILE must be set together")
+		}
+		if c.ARCAuthservID == "" {
+			c.ARCAuthservID = c.ARCDomain
+		}
+	}
+	if c.ProxyProtocol {
+		if c.ProxyProtocolUpstreams == "" {
+			return errors.New("MAILER_PROXY_PROTOCOL requires MAILER_PROXY_PROTOCOL_UPSTREAMS")
+		}
+		upstreams, err := parseUpstreams(c.ProxyProtocolUpstreams)
+		if err != nil {
+			return fmt.Errorf("MAILER_PROXY_PROTOCOL_UPSTREAMS is invalid: %s", err)
+		}
+		c.proxyUpstreams = upstreams
+	} else if c.ProxyProtocolUpstreams != "" {
+		return errors.New("MAILER_PROXY_PROTOCOL_UPSTREAMS requires MAILER_PROXY_PROTOCOL=true")
+	}
+	if c.FieldMap != "" {
+		mapping, err := parseFieldMap(c.FieldMap)
+		if err != nil {
+			return fmt.Errorf("MAILER_FIELD_MAP is invalid: %s", err)
+		}
+		c.fieldMap = mapping
+	}
+	if c.GlobalRate != "" {
+		count, per, err := parseRate(c.GlobalRate)
+		if err != nil {
+			return fmt.Errorf("MAILER_GLOBAL_RATE is invalid: %s", err)
+		}
+		c.globalRate = tokenBucketRate{count: count, per: per}
+	}
+	if c.AllowedRecipients != "" {
+		recipients, err := parseAllowedRecipients(c.AllowedRecipients)
+		if err != nil {
+			return fmt.Errorf("MAILER_ALLOWED_RECIPIENTS is invalid: %s", err)
+		}
+		c.allowedRecipients = recipients
+	}
+
+	if c.AlignFrom {
+		text := c.AlignFromTemplate
+		if text == "" {
+			text = defaultAlignFromTemplate
+		}
+		parsed, err := template.New("align-from").Parse(text)
+		if err != nil {
+			return fmt.Errorf("MAILER_ALIGN_FROM_TEMPLATE is invalid: %s", err)
+		}
+		c.alignFromTemplate = parsed
+	}
+	if c.FromTemplate != "" {
+		parsed, err := template.New("from").Option("missingkey=zero").Parse(c.FromTemplate)
+		if err != nil {
+			return fmt.Errorf("MAILER_FROM_TEMPLATE is invalid: %s", err)
+		}
+		c.fromTemplate = parsed
+		if _, err := renderFrom(parsed, (&Email{}).templateData()); err != nil {
+			return fmt.Errorf("MAILER_FROM_TEMPLATE must render a single address such as \"Website Contact\" <noreply@example.com>: %s", err)
+		}
+	}
+	if c.SubjectTemplate != "" {
+		parsed, err := template.New("subject").Option("missingkey=zero").Parse(c.SubjectTemplate)
+		if err != nil {
+			return fmt.Errorf("MAILER_SUBJECT_TEMPLATE is invalid: %s", err)
+		}
+		c.subjectTemplate = parsed
+	}
+
+	version, err := parseTLSVersion(c.TLSMinVersion)
+	if err != nil {
+		return errors.New("MAILER_TLS_MIN_VERSION must be one of 1.0, 1.1, 1.2, or 1.3")
+	}
+	c.tlsMinVersion = version
+	if c.TLSCipherSuites != "" {
+		suites, err := parseCipherSuites(c.TLSCipherSuites)
+		if err != nil {
+			return fmt.Errorf("MAILER_TLS_CIPHER_SUITES is invalid: %s", err)
+		}
+		c.tlsCipherSuites = suites
+	}
+	if c.TLSCAMode != "" && c.TLSCAFile == "" {
+		return errors.New("MAILER_TLS_CA_MODE requires MAILER_TLS_CA_FILE")
+	}
+
+	if c.Transport == "mailgun" && (c.MailgunDomain == "" || c.MailgunAPIKey == "") {
+		return errors.New("MAILER_TRANSPORT=mailgun requires MAILER_MAILGUN_DOMAIN and MAILER_MAILGUN_API_KEY")
+	}
+	if c.Smarthost != "" {
+		if _, _, err := net.SplitHostPort(c.Smarthost); err != nil {
+			return errors.New("MAILER_SMARTHOST must be a host:port, e.g. smtp.example.com:587")
+		}
+	}
+	if c.FallbackSmarthost != "" {
+		if c.Smarthost != "" {
+			return errors.New("MAILER_FALLBACK_SMARTHOST cannot be combined with MAILER_SMARTHOST")
+		}
+		if _, _, err := net.SplitHostPort(c.FallbackSmarthost); err != nil {
+			return errors.New("MAILER_FALLBACK_SMARTHOST must be a host:port, e.g. smtp.example.com:587")
+		}
+	}
+	if c.OwnDomainViaSmarthost && c.FallbackSmarthost == "" {
+		return errors.New("MAILER_OWN_DOMAIN_VIA_SMARTHOST requires MAILER_FALLBACK_SMARTHOST")
+	}
+	if c.SMTPUsername != "" && c.Smarthost == "" && c.FallbackSmarthost == "" {
+		return errors.New("MAILER_SMTP_USERNAME requires MAILER_SMARTHOST or MAILER_FALLBACK_SMARTHOST")
+	}
+	if c.SourceIP != "" {
+		if c.sourceIP = net.ParseIP(c.SourceIP); c.sourceIP == nil {
+			return errors.New("MAILER_SOURCE_IP must be an IP address")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// smarthostAddress, when set, relays every message through a single
+// host:port instead of delivering to each recipient domain's MX.
+var smarthostAddress string
+var smarthostCredentials *smtpCredentials
+
+// ownDomainViaSmarthost sends mail for the sender's own domain through
+// fallbackSmarthost instead of its MX. Many MX servers refuse mail whose
+// MAIL FROM claims their own domain unless it was authenticated.
+var ownDomainViaSmarthost bool
+
+// deliversToOwnDomain reports whether domain is the one the envelope
+// sender claims.
+func deliversToOwnDomain(domain string) bool {
+	return strings.EqualFold(domain, addressDomain(envelopeSender()))
+}
+
+// ownDomainWarning explains the risk of delivering the inbox's mail
+// straight to the MX of the sender's own domain, or is empty when that
+// is not what happens.
+func ownDomainWarning() string {
+	if smarthostAddress != "" || !deliversToOwnDomain(addressDomain(inboxAddress)) {
+		return ""
+	}
+	if ownDomainViaSmarthost && fallbackSmarthost != "" {
+		return ""
+	}
+	return fmt.Sprintf("the inbox and the sender share the domain %s, and its MX may reject unauthenticated mail from its own domain; consider MAILER_SMARTHOST or MAILER_OWN_DOMAIN_VIA_SMARTHOST", addressDomain(inboxAddress))
+}
+
+// smtpCredentials authenticates to the smarthost. Mechanism is one of
+// plain, login, cram-md5, or auto to pick from what the server advertises.
+type smtpCredentials struct {
+	Username  string
+	Password  string
+	Mechanism string
+}
+
+func (s *smtpCredentials) authenticate(c *smtp.Client, host string) error {
+	ok, advertised := c.Extension("AUTH")
+	if !ok {
+		return fmt.Errorf("%s does not support AUTH", host)
+	}
+	_, encrypted := c.TLSConnectionState()
+	mechanism := s.Mechanism
+	if mechanism == "auto" {
+		if mechanism = negotiateAuth(advertised, encrypted); mechanism == "" {
+			return fmt.Errorf("no usable AUTH mechanism offered by %s: %s", host, advertised)
+		}
+	}
+	// PLAIN and LOGIN send the password as-is.
+	if (mechanism == "plain" || mechanism == "login") && !encrypted {
+		return fmt.Errorf("refusing %s authentication to %s without TLS", strings.ToUpper(mechanism), host)
+	}
+
+	var auth smtp.Auth
+	switch mechanism {
+	case "plain":
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	case "login":
+		auth = &loginAuth{username: s.Username, password: s.Password}
+	case "cram-md5":
+		auth = smtp.CRAMMD5Auth(s.Username, s.Password)
+	default:
+		return fmt.Errorf("unknown AUTH mechanism %q", mechanism)
+	}
+	return c.Auth(auth)
+}
+
+// negotiateAuth picks the preferred mechanism among those advertised.
+// Without TLS only CRAM-MD5 keeps the password off the wire.
+func negotiateAuth(advertised string, encrypted bool) string {
+	offered := make(map[string]bool)
+	for _, mechanism := range strings.Fields(strings.ToLower(advertised)) {
+		offered[mechanism] = true
+	}
+	preferred := []string{"cram-md5"}
+	if encrypted {
+		preferred = []string{"plain", "login", "cram-md5"}
+	}
+	for _, mechanism := range preferred {
+		if offered[mechanism] {
+			return mechanism
+		}
+	}
+	return ""
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp lacks.
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateAuth(t *testing.T) {
+	tests := []struct {
+		advertised string
+		encrypted  bool
+		want       string
+	}{
+		{"PLAIN LOGIN CRAM-MD5", true, "plain"},
+		{"LOGIN CRAM-MD5", true, "login"},
+		{"PLAIN LOGIN CRAM-MD5", false, "cram-md5"},
+		{"PLAIN LOGIN", false, ""},
+		{"XOAUTH2", true, ""},
+	}
+	for _, test := range tests {
+		if got := negotiateAuth(test.advertised, test.encrypted); got != test.want {
+			t.Errorf("negotiateAuth(%q, %v) = %q, want %q", test.advertised, test.encrypted, got, test.want)
+		}
+	}
+}
+
+func TestLoginAuth(t *testing.T) {
+	auth := &loginAuth{username: "form", password: "secret"}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "relay.example.com"}); err == nil {
+		t.Error("LOGIN started over an unencrypted connection")
+	}
+	mechanism, _, err := auth.Start(&smtp.ServerInfo{Name: "relay.example.com", TLS: true})
+	if err != nil || mechanism != "LOGIN" {
+		t.Fatalf("Start = %q, %v", mechanism, err)
+	}
+	for prompt, want := range map[string]string{"Username:": "form", "Password:": "secret"} {
+		if got, err := auth.Next([]byte(prompt), true); err != nil || string(got) != want {
+			t.Errorf("Next(%q) = %q, %v; want %q", prompt, got, err, want)
+		}
+	}
+	if _, err := auth.Next([]byte("Token:"), true); err == nil {
+		t.Error("answered an unexpected challenge")
+	}
+}
+
+// sendAuthenticated delivers testMessage to server with credentials.
+func sendAuthenticated(server *fakeSMTPServer, credentials *smtpCredentials) error {
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com"}}
+	_, err := sendMail(context.Background(), server.Addr(), credentials, env, []byte(testMessage))
+	return err
+}
+
+func TestSmarthostCRAMMD5(t *testing.T) {
+	const challenge = "<1896.697170952@relay.example.com>"
+	mac := hmac.New(md5.New, []byte("secret"))
+	mac.Write([]byte(challenge))
+	response := base64.StdEncoding.EncodeToString([]byte("form " + hex.EncodeToString(mac.Sum(nil))))
+
+	for _, mechanism := range []string{"cram-md5", "auto"} {
+		server := startFakeSMTP(t, "AUTH PLAIN LOGIN CRAM-MD5")
+		server.setReply("AUTH CRAM-MD5", "334 "+base64.StdEncoding.EncodeToString([]byte(challenge)))
+		server.setReply(response, "235 2.7.0 Authentication successful")
+
+		err := sendAuthenticated(server, &smtpCredentials{Username: "form", Password: "secret", Mechanism: mechanism})
+		if err != nil {
+			t.Errorf("%s: %v", mechanism, err)
+		} else if len(server.Messages()) != 1 {
+			t.Errorf("%s: the message was not delivered after AUTH", mechanism)
+		}
+	}
+}
+
+func TestSmarthostRefusesPlaintextPasswordsWithoutTLS(t *testing.T) {
+	for _, mechanism := range []string{"plain", "login"} {
+		server := startFakeSMTP(t, "AUTH PLAIN LOGIN")
+		err := sendAuthenticated(server, &smtpCredentials{Username: "form", Password: "secret", Mechanism: mechanism})
+		if err == nil || !strings.Contains(err.Error(), "without TLS") {
+			t.Errorf("%s without TLS: err = %v", mechanism, err)
+		}
+		for _, command := range server.Commands() {
+			if strings.HasPrefix(command, "AUTH") {
+				t.Errorf("%s: sent %q without TLS", mechanism, command)
+			}
+		}
+	}
+
+	server := startFakeSMTP(t, "AUTH PLAIN LOGIN")
+	if err := sendAuthenticated(server, &smtpCredentials{Username: "form", Password: "secret", Mechanism: "auto"}); err == nil {
+		t.Error("auto picked a plaintext mechanism without TLS")
+	}
+}
+
+func TestSmarthostRequiresAUTH(t *testing.T) {
+	server := startFakeSMTP(t)
+	if err := sendAuthenticated(server, &smtpCredentials{Username: "form", Password: "secret", Mechanism: "auto"}); err == nil {
+		t.Error("sent with credentials to a server without AUTH")
+	}
+}
+
+func TestSmarthostPlainAndLoginOverTLS(t *testing.T) {
+	defer func() { tlsRootCAs = nil }()
+	ca := newTestCA(t)
+	pool, err := loadRootCAs(ca.writePEM(t), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsRootCAs = pool
+	encode := func(value string) string { return base64.StdEncoding.EncodeToString([]byte(value)) }
+
+	for _, mechanism := range []string{"plain", "login", "auto"} {
+		server := startFakeSMTPWithTLS(t, ca.serverConfig(t), "AUTH PLAIN LOGIN")
+		server.setReply("AUTH PLAIN "+encode("\x00form\x00secret"), "235 2.7.0 Authentication successful")
+		server.setReply("AUTH LOGIN", "334 "+encode("Username:"))
+		server.setReply(encode("form"), "334 "+encode("Password:"))
+		server.setReply(encode("secret"), "235 2.7.0 Authentication successful")
+
+		err := sendAuthenticated(server, &smtpCredentials{Username: "form", Password: "secret", Mechanism: mechanism})
+		if err != nil {
+			t.Errorf("%s over TLS: %v", mechanism, err)
+		} else if len(server.Messages()) != 1 {
+			t.Errorf("%s over TLS: the message was not delivered after AUTH", mechanism)
+		}
+	}
+}
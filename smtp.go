@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// bdatThreshold is the message size above which CHUNKING (RFC 3030) is used
+// instead of DATA when the server advertises it.
+var bdatThreshold int
+
+const bdatChunkSize = 1 << 20
+
+// sizeLimitError reports a message larger than the SIZE (RFC 1870) limit a
+// server advertised, so it was never offered to that server.
+type sizeLimitError struct {
+	host  string
+	limit int
+	size  int
+}
+
+func (e *sizeLimitError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds the %d byte limit advertised by %s", e.size, e.limit, e.host)
+}
+
+// envelope is the SMTP envelope of a single delivery.
+type envelope struct {
+	From string
+	To   []string
+	// SMTPUTF8 is set when an address or header needs RFC 6531 support
+	// from the server.
+	SMTPUTF8 bool
+}
+
+// sendMail mirrors smtp.SendMail but honours ctx: the connection is torn
+// down as soon as ctx is done, so no single step of the conversation can
+// outlive the send deadline. credentials, when non-nil, are used to AUTH
+// after STARTTLS. At most maxConnsPerHost deliveries to addr run at once.
+// With smtpKeepAlive set, the session is kept for reuse by the next
+// message to addr instead of being closed.
+func sendMail(ctx context.Context, addr string, credentials *smtpCredentials, env envelope, msg []byte) (*deliveryResult, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hostConns.acquire(ctx, addr); err != nil {
+		return nil, err
+	}
+	defer hostConns.release(addr)
+
+	session := idleSessions.take(addr)
+	reused := session != nil
+	if !reused {
+		conn, err := dialSMTP(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		session = &smtpSession{addr: addr, conn: conn}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		session.conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { session.conn.Close() })
+
+	if !reused {
+		err = session.handshake(host, credentials)
+	}
+	var result *deliveryResult
+	if err == nil {
+		result, err = session.send(host, env, msg)
+	}
+	stopped := stop()
+	if !stopped {
+		// ctx ended the session by closing the connection.
+		session.close()
+		return result, err
+	}
+	if err != nil {
+		if sessionBroken(err) {
+			session.close()
+		} else {
+			session.quit()
+		}
+		return result, err
+	}
+	if smtpKeepAlive > 0 {
+		idleSessions.put(session, smtpKeepAlive)
+		return result, nil
+	}
+	// The message has been accepted, so a failed QUIT does not fail it.
+	session.quit()
+	return result, nil
+}
+
+// smtpSession is a connection that has been greeted, secured and, if
+// needed, authenticated.
+type smtpSession struct {
+	addr   string
+	conn   net.Conn
+	client *smtp.Client
+	idle   *time.Timer
+}
+
+func (s *smtpSession) handshake(host string, credentials *smtpCredentials) error {
+	c, err := smtp.NewClient(s.conn, host)
+	if err != nil {
+		return err
+	}
+	s.client = c
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(smtpTLSConfig(host)); err != nil {
+			return err
+		}
+	} else if requireTLS {
+		return fmt.Errorf("%w: %s", errTLSRequired, host)
+	}
+	if credentials != nil {
+		if err = credentials.authenticate(c, host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send runs a single mail transaction over the session. A recipient
+// refused at RCPT TO is recorded in the result rather than failing the
+// transaction, which goes ahead for the others.
+func (s *smtpSession) send(host string, env envelope, msg []byte) (*deliveryResult, error) {
+	c := s.client
+	if ok, _ := c.Extension("SMTPUTF8"); env.SMTPUTF8 && !ok {
+		return nil, fmt.Errorf("%w: %s", errNoSMTPUTF8, host)
+	}
+	if ok, param := c.Extension("SIZE"); ok {
+		// A missing or zero limit means the server sets none.
+		if limit, err := strconv.Atoi(param); err == nil && limit > 0 && len(msg) > limit {
+			return nil, &sizeLimitError{host: host, limit: limit, size: len(msg)}
+		}
+	}
+	// Mail adds the SMTPUTF8 parameter whenever the server advertises it.
+	if err := c.Mail(env.From); err != nil {
+		return nil, err
+	}
+	result := &deliveryResult{}
+	for _, addr := range env.To {
+		err := c.Rcpt(addr)
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			result.reject(addr, err)
+		} else if err != nil {
+			return nil, err
+		} else {
+			result.Accepted = append(result.Accepted, addr)
+		}
+	}
+	if len(result.Accepted) == 0 {
+		c.Reset()
+		return result, fmt.Errorf("%w by %s", errAllRejected, host)
+	}
+	var err error
+	if ok, _ := c.Extension("CHUNKING"); ok && len(msg) > bdatThreshold {
+		err = sendChunked(c, msg)
+	} else {
+		err = sendData(c, msg)
+	}
+	if err != nil {
+		// Acceptance at RCPT TO counts for nothing unless the message
+		// itself was taken.
+		result.rejectAccepted(err)
+	}
+	return result, err
+}
+
+func sendData(c *smtp.Client, msg []byte) error {
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// smtpQuitTimeout bounds the wait for the 221 reply to QUIT before the
+// connection is closed regardless. Zero closes without sending QUIT.
+var smtpQuitTimeout = 5 * time.Second
+
+// quit ends the session with QUIT rather than dropping the connection,
+// which some servers count against the sender's reputation.
+func (s *smtpSession) quit() {
+	if s.client != nil && smtpQuitTimeout > 0 {
+		s.conn.SetDeadline(time.Now().Add(smtpQuitTimeout))
+		s.client.Quit()
+	}
+	s.close()
+}
+
+// close drops the connection without QUIT, for when it is no longer in a
+// state to carry one.
+func (s *smtpSession) close() {
+	if s.client != nil {
+		s.client.Close()
+	} else {
+		s.conn.Close()
+	}
+}
+
+// sessionBroken reports whether err left the connection unusable, as a
+// network error does, rather than being a reply or a check made before
+// anything was sent.
+func sessionBroken(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// sendChunked transfers msg with BDAT. Unlike DATA there is no dot-stuffing
+// or line-ending translation, so the message is sent with CRLF line endings
+// exactly as counted.
+func sendChunked(c *smtp.Client, msg []byte) error {
+	msg = toCRLF(msg)
+	for len(msg) > 0 {
+		chunk := msg
+		if len(chunk) > bdatChunkSize {
+			chunk = chunk[:bdatChunkSize]
+		}
+		msg = msg[len(chunk):]
+
+		command := fmt.Sprintf("BDAT %d", len(chunk))
+		if len(msg) == 0 {
+			command += " LAST"
+		}
+		id, err := c.Text.Cmd("%s", command)
+		if err != nil {
+			return err
+		}
+		if _, err = c.Text.W.Write(chunk); err != nil {
+			return err
+		}
+		if err = c.Text.W.Flush(); err != nil {
+			return err
+		}
+		c.Text.StartResponse(id)
+		_, _, err = c.Text.ReadResponse(250)
+		c.Text.EndResponse(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toCRLF rewrites bare LF and bare CR line endings as CRLF.
+func toCRLF(msg []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(msg))
+	for i, b := range msg {
+		switch {
+		case b == '\n' && (i == 0 || msg[i-1] != '\r'):
+			out.WriteString("\r\n")
+		case b == '\r' && (i+1 == len(msg) || msg[i+1] != '\n'):
+			out.WriteString("\r\n")
+		default:
+			out.WriteByte(b)
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer is a scripted SMTP server. Every command is answered 250
+// unless replies holds another answer for the command line, or for its
+// verb; "." is the reply to the end of DATA or to BDAT LAST. An empty
+// reply to QUIT leaves it unanswered.
+type fakeSMTPServer struct {
+	listener   net.Listener
+	extensions []string
+	// tlsConfig, when set, is offered with STARTTLS.
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	replies  map[string]string
+	commands []string
+	messages [][]byte
+}
+
+func startFakeSMTP(t testing.TB, extensions ...string) *fakeSMTPServer {
+	t.Helper()
+	return startFakeSMTPWithTLS(t, nil, extensions...)
+}
+
+func startFakeSMTPWithTLS(t testing.TB, config *tls.Config, extensions ...string) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: listener, extensions: extensions, tlsConfig: config, replies: make(map[string]string)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeSMTPServer) setReply(command string, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies[command] = reply
+}
+
+func (s *fakeSMTPServer) reply(command string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reply, ok := s.replies[command]; ok {
+		return reply
+	}
+	if reply, ok := s.replies[strings.ToUpper(strings.Fields(command + " ")[0])]; ok {
+		return reply
+	}
+	return "250 OK"
+}
+
+// Commands lists the command lines received so far, over all connections.
+func (s *fakeSMTPServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Messages lists the messages received so far, as DATA or BDAT sent them.
+func (s *fakeSMTPServer) Messages() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.messages...)
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ESMTP")
+	var chunks []byte
+	secured := false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+		fields := strings.Fields(strings.ToUpper(line))
+		if len(fields) == 0 {
+			text.PrintfLine("500 empty command")
+			continue
+		}
+		switch fields[0] {
+		case "EHLO":
+			lines := append([]string{"fake"}, s.extensions...)
+			if s.tlsConfig != nil && !secured {
+				lines = append(lines, "STARTTLS")
+			}
+			for i, extension := range lines {
+				separator := "-"
+				if i == len(lines)-1 {
+					separator = " "
+				}
+				text.PrintfLine("250%s%s", separator, extension)
+			}
+		case "STARTTLS":
+			if s.tlsConfig == nil || secured {
+				text.PrintfLine("502 not offered")
+				continue
+			}
+			text.PrintfLine("220 ready to start TLS")
+			conn = tls.Server(conn, s.tlsConfig)
+			text = textproto.NewConn(conn)
+			secured = true
+		case "DATA":
+			if reply := s.reply(line); !strings.HasPrefix(reply, "250") {
+				text.PrintfLine("%s", reply)
+				continue
+			}
+			text.PrintfLine("354 go ahead")
+			message, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.received(message)
+			text.PrintfLine("%s", s.reply("."))
+		case "BDAT":
+			size, _ := strconv.Atoi(fields[1])
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(text.R, chunk); err != nil {
+				return
+			}
+			chunks = append(chunks, chunk...)
+			if len(fields) < 3 || fields[2] != "LAST" {
+				text.PrintfLine("250 OK")
+				continue
+			}
+			s.received(chunks)
+			chunks = nil
+			text.PrintfLine("%s", s.reply("."))
+		case "QUIT":
+			reply := s.reply(line)
+			if reply == "" {
+				// Hold the connection open until the client gives up.
+				io.Copy(io.Discard, conn)
+				return
+			}
+			text.PrintfLine("%s", strings.Replace(reply, "250", "221", 1))
+			return
+		default:
+			text.PrintfLine("%s", s.reply(line))
+		}
+	}
+}
+
+func (s *fakeSMTPServer) received(message []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, message)
+}
+
+const testMessage = "Subject: test\r\n\r\nhello\r\n"
+
+func TestSendMailDataFailureRejectsAcceptedRecipients(t *testing.T) {
+	server := startFakeSMTP(t)
+	server.setReply("RCPT TO:<gone@example.com>", "550 5.1.1 no such user")
+	server.setReply(".", "451 4.3.0 try again later")
+
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com", "gone@example.com"}}
+	result, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage))
+	if err == nil {
+		t.Fatal("sendMail succeeded after DATA failed")
+	}
+	if len(result.Accepted) != 0 {
+		t.Errorf("accepted %v although DATA failed", result.Accepted)
+	}
+	if got := result.temporaryFailures(); !reflect.DeepEqual(got, []string{"inbox@example.com"}) {
+		t.Errorf("temporary failures = %v, want [inbox@example.com]", got)
+	}
+}
+
+func TestDeliverDataFailureIsNotDelivered(t *testing.T) {
+	server := startFakeSMTP(t)
+	server.setReply("RCPT TO:<gone@example.com>", "550 5.1.1 no such user")
+	server.setReply(".", "554 5.6.0 message refused")
+	smarthostAddress = server.Addr()
+	defer func() { smarthostAddress = "" }()
+
+	message := &Email{From: "visitor@example.org", RetryRecipients: []string{"inbox@example.com", "gone@example.com"}}
+	result, err := smtpTransport{}.Deliver(context.Background(), message, []byte(testMessage))
+	if err == nil {
+		t.Fatal("Deliver succeeded after DATA failed")
+	}
+	if len(result.Accepted) != 0 {
+		t.Errorf("accepted %v although DATA failed", result.Accepted)
+	}
+	if len(result.Rejected) != 2 {
+		t.Errorf("rejected %v, want both recipients", result.Rejected)
+	}
+}
+
+func TestSendMailPartialRcptDelivers(t *testing.T) {
+	server := startFakeSMTP(t)
+	server.setReply("RCPT TO:<gone@example.com>", "550 5.1.1 no such user")
+
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com", "gone@example.com"}}
+	result, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Accepted, []string{"inbox@example.com"}) {
+		t.Errorf("accepted %v, want [inbox@example.com]", result.Accepted)
+	}
+	if len(server.Messages()) != 1 {
+		t.Errorf("server received %d messages, want 1", len(server.Messages()))
+	}
+}
+
+func TestSendMailUsesBDATWhenChunking(t *testing.T) {
+	defer func(threshold int) { bdatThreshold = threshold }(bdatThreshold)
+	bdatThreshold = 0
+	server := startFakeSMTP(t, "CHUNKING")
+
+	// A leading dot must reach the server as sent, since BDAT is not
+	// dot-stuffed, and the message spans several chunks.
+	msg := "Subject: big\r\n\r\n.hidden\r\n" + strings.Repeat("x", 2*bdatChunkSize+10) + "\r\n"
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com"}}
+	if _, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	var bdat []string
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "BDAT") {
+			bdat = append(bdat, command)
+		} else if command == "DATA" {
+			t.Error("DATA was used although the server offers CHUNKING")
+		}
+	}
+	want := []string{
+		"BDAT " + strconv.Itoa(bdatChunkSize),
+		"BDAT " + strconv.Itoa(bdatChunkSize),
+		"BDAT " + strconv.Itoa(len(msg)-2*bdatChunkSize) + " LAST",
+	}
+	if !reflect.DeepEqual(bdat, want) {
+		t.Errorf("BDAT commands = %v, want %v", bdat, want)
+	}
+	if messages := server.Messages(); len(messages) != 1 || string(messages[0]) != msg {
+		t.Error("the server did not receive the message byte for byte")
+	}
+}
+
+func TestSendMailUsesDATABelowBDATThreshold(t *testing.T) {
+	defer func(threshold int) { bdatThreshold = threshold }(bdatThreshold)
+	bdatThreshold = len(testMessage)
+	server := startFakeSMTP(t, "CHUNKING")
+
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com"}}
+	if _, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "BDAT") {
+			t.Errorf("sent %q for a message under the threshold", command)
+		}
+	}
+	if len(server.Messages()) != 1 {
+		t.Error("the message was not delivered with DATA")
+	}
+}
+
+func lastCommand(server *fakeSMTPServer) string {
+	commands := server.Commands()
+	if len(commands) == 0 {
+		return ""
+	}
+	return commands[len(commands)-1]
+}
+
+func TestSendMailEndsWithQuit(t *testing.T) {
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com"}}
+
+	server := startFakeSMTP(t)
+	if _, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastCommand(server); got != "QUIT" {
+		t.Errorf("session ended with %q, want QUIT", got)
+	}
+
+	// A refused transaction is still ended politely.
+	refused := startFakeSMTP(t)
+	refused.setReply("RCPT", "550 5.1.1 no such user")
+	if _, err := sendMail(context.Background(), refused.Addr(), nil, env, []byte(testMessage)); err == nil {
+		t.Fatal("sendMail succeeded with every recipient refused")
+	}
+	if got := lastCommand(refused); got != "QUIT" {
+		t.Errorf("refused session ended with %q, want QUIT", got)
+	}
+}
+
+func TestSendMailQuitWaitIsBounded(t *testing.T) {
+	defer func(timeout time.Duration) { smtpQuitTimeout = timeout }(smtpQuitTimeout)
+	smtpQuitTimeout = 50 * time.Millisecond
+	server := startFakeSMTP(t)
+	server.setReply("QUIT", "")
+
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com"}}
+	start := time.Now()
+	if _, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage)); err != nil {
+		t.Fatalf("an unanswered QUIT failed the delivery: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("waited %s for the 221", elapsed)
+	}
+
+	smtpQuitTimeout = 0
+	silent := startFakeSMTP(t)
+	if _, err := sendMail(context.Background(), silent.Addr(), nil, env, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range silent.Commands() {
+		if command == "QUIT" {
+			t.Error("sent QUIT with MAILER_SMTP_QUIT_TIMEOUT=0")
+		}
+	}
+}
+
+func TestToCRLF(t *testing.T) {
+	tests := map[string]string{
+		"a\nb\n":         "a\r\nb\r\n",
+		"a\rb\r":         "a\r\nb\r\n",
+		"a\r\nb\r\n":     "a\r\nb\r\n",
+		"\na\r\r\n":      "\r\na\r\n\r\n",
+		"no line breaks": "no line breaks",
+	}
+	for input, want := range tests {
+		if got := string(toCRLF([]byte(input))); got != want {
+			t.Errorf("toCRLF(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestConstructMessageUsesCRLF(t *testing.T) {
+	setupSendHandler(t)
+	message := &Email{From: "visitor@example.org", Subject: "hi", Body: "line one\nline two\r\nline three\r"}
+	msg, err := message.ConstructMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range msg {
+		if b == '\n' && (i == 0 || msg[i-1] != '\r') {
+			t.Fatalf("bare LF at byte %d of %q", i, msg)
+		}
+		if b == '\r' && (i+1 == len(msg) || msg[i+1] != '\n') {
+			t.Fatalf("bare CR at byte %d of %q", i, msg)
+		}
+	}
+}
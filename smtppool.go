@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// smtpKeepAlive is how long a session stays open after a delivery waiting
+// for the next message to the same server. Zero closes it right away.
+var smtpKeepAlive time.Duration
+
+var idleSessions = &sessionPool{idle: make(map[string]*smtpSession)}
+
+// sessionPool holds at most one idle session per server address.
+type sessionPool struct {
+	mu   sync.Mutex
+	idle map[string]*smtpSession
+}
+
+// take removes the idle session for addr, if any, and checks it is still
+// usable with RSET.
+func (p *sessionPool) take(addr string) *smtpSession {
+	p.mu.Lock()
+	session := p.idle[addr]
+	delete(p.idle, addr)
+	p.mu.Unlock()
+
+	if session == nil {
+		return nil
+	}
+	session.idle.Stop()
+	session.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := session.client.Reset(); err != nil {
+		session.close()
+		return nil
+	}
+	return session
+}
+
+// put parks session for reuse, closing it with QUIT once ttl passes unused.
+func (p *sessionPool) put(session *smtpSession, ttl time.Duration) {
+	session.conn.SetDeadline(time.Time{})
+
+	p.mu.Lock()
+	previous := p.idle[session.addr]
+	p.idle[session.addr] = session
+	session.idle = time.AfterFunc(ttl, func() { p.expire(session) })
+	p.mu.Unlock()
+
+	if previous != nil {
+		previous.idle.Stop()
+		previous.quit()
+	}
+}
+
+func (p *sessionPool) expire(session *smtpSession) {
+	p.mu.Lock()
+	current := p.idle[session.addr] == session
+	if current {
+		delete(p.idle, session.addr)
+	}
+	p.mu.Unlock()
+
+	if current {
+		session.quit()
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTrustedTLSServer starts a fake STARTTLS server whose certificate
+// sendMail trusts, and sets smtpKeepAlive for the rest of the test.
+func startTrustedTLSServer(tb testing.TB, keepAlive time.Duration, extensions ...string) *fakeSMTPServer {
+	tb.Helper()
+	ca := newTestCA(tb)
+	pool, err := loadRootCAs(ca.writePEM(tb), true)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tlsRootCAs, smtpKeepAlive = pool, keepAlive
+	tb.Cleanup(func() {
+		tlsRootCAs, smtpKeepAlive = nil, 0
+		closeIdleSessions()
+	})
+	return startFakeSMTPWithTLS(tb, ca.serverConfig(tb), extensions...)
+}
+
+// closeIdleSessions quits every session parked in idleSessions.
+func closeIdleSessions() {
+	idleSessions.mu.Lock()
+	sessions := idleSessions.idle
+	idleSessions.idle = make(map[string]*smtpSession)
+	idleSessions.mu.Unlock()
+	for _, session := range sessions {
+		session.idle.Stop()
+		session.quit()
+	}
+}
+
+func TestSendMailReusesSessionWithKeepAlive(t *testing.T) {
+	server := startTrustedTLSServer(t, time.Minute)
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com"}}
+	for i := 0; i < 3; i++ {
+		if _, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage)); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+	if got := len(server.Messages()); got != 3 {
+		t.Errorf("delivered %d messages, want 3", got)
+	}
+	handshakes := 0
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "STARTTLS") {
+			handshakes++
+		}
+	}
+	if handshakes != 1 {
+		t.Errorf("negotiated TLS %d times, want once for all three messages", handshakes)
+	}
+}
+
+func BenchmarkSendMail(b *testing.B) {
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com"}}
+	for _, bench := range []struct {
+		name      string
+		keepAlive time.Duration
+	}{
+		{"KeepAliveOff", 0},
+		{"KeepAliveOn", time.Minute},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			server := startTrustedTLSServer(b, bench.keepAlive)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// rejectLinkOnly enables the link-ratio filter. Submissions whose body is at
+// least linkRatioThreshold links are rejected, or accepted and silently
+// discarded when dropLinkOnly is set.
+var rejectLinkOnly bool
+var dropLinkOnly bool
+var linkRatioThreshold float64
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// linkRatio returns the fraction of the body's non-whitespace characters
+// that belong to URLs.
+func linkRatio(body string) float64 {
+	total := len(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, body))
+	if total == 0 {
+		return 0
+	}
+	links := 0
+	for _, link := range linkPattern.FindAllString(body, -1) {
+		links += len(link)
+	}
+	return float64(links) / float64(total)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// suppressions holds addresses and whole domains that must never receive
+// mail: those an operator lists, plus addresses that bounced permanently or
+// complained, as reported by a provider's notifications. Deliveries skip
+// them.
+var suppressions = newSuppressionList("")
+
+// suppressionList is a set of addresses and domains, optionally persisted
+// to a file of "entry<TAB>reason<TAB>time" lines. An entry is an address,
+// or a domain, optionally written "@example.com", which also covers its
+// subdomains. Additions are appended to the file; a removal rewrites it,
+// dropping any comments.
+type suppressionList struct {
+	mu      sync.Mutex
+	entries map[string]suppressionEntry
+	path    string
+}
+
+type suppressionEntry struct {
+	Entry   string    `json:"entry"`
+	Reason  string    `json:"reason,omitempty"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+func newSuppressionList(path string) *suppressionList {
+	return &suppressionList{entries: make(map[string]suppressionEntry), path: path}
+}
+
+// loadSuppressionList reads the list at path, which need not exist yet.
+// Blank lines and lines starting with # are ignored.
+func loadSuppressionList(path string) (*suppressionList, error) {
+	list := newSuppressionList(path)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		key, err := suppressionKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		entry := suppressionEntry{Entry: key}
+		if len(fields) > 1 {
+			entry.Reason = fields[1]
+		}
+		if len(fields) > 2 {
+			entry.AddedAt, _ = time.Parse(time.RFC3339, fields[2])
+		}
+		list.entries[key] = entry
+	}
+	return list, scanner.Err()
+}
+
+// suppressionKey normalizes an entry to a lowercased address or domain.
+func suppressionKey(entry string) (string, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if domain := strings.TrimPrefix(entry, "@"); !strings.Contains(domain, "@") {
+		domain = strings.Trim(domain, ".")
+		if domain == "" || strings.ContainsAny(domain, " \t,<>") {
+			return "", fmt.Errorf("invalid domain %q", entry)
+		}
+		return domain, nil
+	}
+	if parsed, err := mail.ParseAddress(entry); err != nil || parsed.Address != entry {
+		return "", fmt.Errorf("invalid address %q", entry)
+	}
+	return entry, nil
+}
+
+func (e suppressionEntry) line() string {
+	added := ""
+	if !e.AddedAt.IsZero() {
+		added = e.AddedAt.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\n", e.Entry, strings.ReplaceAll(e.Reason, "\t", " "), added)
+}
+
+// Add suppresses an address or domain, recording why. Entries already on
+// the list are left as they are.
+func (l *suppressionList) Add(entry string, reason string) error {
+	key, err := suppressionKey(entry)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[key]; ok {
+		return nil
+	}
+	added := suppressionEntry{Entry: key, Reason: reason, AddedAt: time.Now()}
+	l.entries[key] = added
+	if l.path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(added.line())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Remove lifts a suppression, reporting whether the entry was listed.
+func (l *suppressionList) Remove(entry string) (bool, error) {
+	key, err := suppressionKey(entry)
+	if err != nil {
+		return false, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[key]; !ok {
+		return false, nil
+	}
+	delete(l.entries, key)
+	if l.path == "" {
+		return true, nil
+	}
+	return true, l.rewrite()
+}
+
+// rewrite replaces the file with the current entries. The caller holds mu.
+func (l *suppressionList) rewrite() error {
+	file, err := os.CreateTemp(filepath.Dir(l.path), ".suppressions-")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, entry := range l.sorted() {
+		writer.WriteString(entry.line())
+	}
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), l.path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (l *suppressionList) sorted() []suppressionEntry {
+	entries := make([]suppressionEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Entry < entries[j].Entry })
+	return entries
+}
+
+// Snapshot lists the entries in order.
+func (l *suppressionList) Snapshot() []suppressionEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sorted()
+}
+
+// Contains reports whether address, its domain or a parent of its domain
+// is suppressed.
+func (l *suppressionList) Contains(address string) bool {
+	address = strings.ToLower(strings.TrimSpace(address))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == 0 {
+		return false
+	}
+	if _, ok := l.entries[address]; ok {
+		return true
+	}
+	domain := addressDomain(address)
+	for domain != "" {
+		if _, ok := l.entries[domain]; ok {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return false
+}
+
+func (l *suppressionList) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// suppressRecipients narrows the message's envelope to the recipients that
+// are not suppressed. It reports false when none are left.
+func (m *Email) suppressRecipients() bool {
+	domains, groups := m.envelopeRecipients()
+	var remaining, skipped []string
+	for _, domain := range domains {
+		for _, address := range groups[domain] {
+			if suppressions.Contains(address) {
+				skipped = append(skipped, address)
+			} else {
+				remaining = append(remaining, address)
+			}
+		}
+	}
+	if len(skipped) == 0 {
+		return true
+	}
+	droppedTotal.Inc("suppressed")
+	log.Printf("Skipping suppressed recipients %s for message from %s\n", strings.Join(skipped, ", "), m.From)
+	m.RetryRecipients = remaining
+	return len(remaining) > 0
+}
+
+// SuppressionsHandler lists the suppression list on GET, adds an entry
+// posted as {"entry": ..., "reason": ...} and removes the one named by
+// ?entry= on DELETE.
+type SuppressionsHandler struct{}
+
+func (h *SuppressionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		var request struct {
+			Entry  string `json:"entry"`
+			Reason string `json:"reason"`
+		}
+		if err := decodeJSON(http.MaxBytesReader(w, r.Body, 64<<10), &request, true); err != nil {
+			writeError(w, r, bodyErrorStatus(r, err), err.Error())
+			return
+		}
+		if request.Reason == "" {
+			request.Reason = "admin"
+		}
+		if _, err := suppressionKey(request.Entry); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if err := suppressions.Add(request.Entry, request.Reason); err != nil {
+			log.Printf("Unable to persist suppression of %s: %s\n", request.Entry, err.Error())
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		log.Printf("Suppressed %s: %s\n", request.Entry, request.Reason)
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		removed, err := suppressions.Remove(r.URL.Query().Get("entry"))
+		if err != nil && !removed {
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("Unable to persist the suppression list: %s\n", err.Error())
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if !removed {
+			writeError(w, r, http.StatusNotFound, "entry is not suppressed")
+			return
+		}
+		log.Printf("Lifted suppression of %s\n", r.URL.Query().Get("entry"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		newJSONEncoder(w).Encode(struct {
+			Suppressions []suppressionEntry `json:"suppressions"`
+		}{suppressions.Snapshot()})
+	}
+}
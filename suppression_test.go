@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSuppressedRecipientsGetNoRcpt(t *testing.T) {
+	setupSendHandler(t)
+	transport = smtpTransport{}
+	server := startFakeSMTP(t)
+	smarthostAddress = server.Addr()
+	suppressions = newSuppressionList("")
+	defer func() { smarthostAddress, suppressions = "", newSuppressionList("") }()
+	suppressions.Add("bounced@example.net", "bounce")
+	suppressions.Add("@blocked.example", "admin")
+
+	message := &Email{
+		From: "visitor@example.org",
+		Body: "hello",
+		Cc:   []string{"Bounced@example.net", "someone@mail.blocked.example", "colleague@example.net"},
+	}
+	if outcome := deliver(message); outcome != outcomeDelivered {
+		t.Fatalf("deliver = %v, want the message delivered", outcome)
+	}
+	var rcpts []string
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "RCPT TO:") {
+			rcpts = append(rcpts, command)
+		}
+	}
+	want := []string{"RCPT TO:<inbox@example.com>", "RCPT TO:<colleague@example.net>"}
+	if strings.Join(rcpts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("issued %q, want %q", rcpts, want)
+	}
+}
+
+func TestSuppressionListContains(t *testing.T) {
+	list := newSuppressionList("")
+	list.Add("bounced@example.net", "bounce")
+	list.Add("@blocked.example", "admin")
+	tests := map[string]bool{
+		"bounced@example.net":         true,
+		"BOUNCED@Example.NET":         true,
+		"other@example.net":           false,
+		"anyone@blocked.example":      true,
+		"anyone@mail.blocked.example": true,
+		"anyone@notblocked.example":   false,
+	}
+	for address, want := range tests {
+		if got := list.Contains(address); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestSuppressionsWrongMethodAnswers405(t *testing.T) {
+	for _, method := range []string{"PUT", "PATCH"} {
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, httptest.NewRequest(method, "/admin/suppressions", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s answered %d, want 405", method, w.Code)
+		}
+		if got := w.Header().Get("Allow"); got != "GET, POST, DELETE" {
+			t.Errorf("%s: Allow = %q, want %q", method, got, "GET, POST, DELETE")
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The TLS policy for outbound SMTP. By default STARTTLS is used whenever a
+// server offers it, with TLS 1.2 or newer and a verified certificate;
+// servers that cannot meet that fail rather than falling back.
+var tlsMinVersion uint16 = tls.VersionTLS12
+var tlsCipherSuites []uint16
+
+// requireTLS refuses servers that do not offer STARTTLS at all.
+var requireTLS bool
+
+var errTLSRequired = errors.New("server does not offer STARTTLS")
+
+// tlsRootCAs, when set, verifies SMTP servers in place of the system
+// roots, e.g. to trust an internal smarthost's private CA.
+var tlsRootCAs *x509.CertPool
+
+func smtpTLSConfig(host string) *tls.Config {
+	return &tls.Config{
+		ServerName:   host,
+		MinVersion:   tlsMinVersion,
+		CipherSuites: tlsCipherSuites,
+		RootCAs:      tlsRootCAs,
+	}
+}
+
+// loadRootCAs reads the PEM certificates in path into the system pool, or
+// into an empty one when replace is set.
+func loadRootCAs(path string, replace bool) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !replace {
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("unable to load the system roots: %s", err)
+		}
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// parseCipherSuites maps a comma-separated list of Go cipher suite names,
+// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, to their IDs. Only secure
+// suites are accepted. TLS 1.3 suites are not configurable.
+func parseCipherSuites(list string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a private CA that can issue server certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t testing.TB) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Internal CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// serverConfig issues a certificate for 127.0.0.1.
+func (ca *testCA) serverConfig(t testing.TB) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "relay.internal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func (ca *testCA) writePEM(t testing.TB) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSendMailTrustsPrivateCA(t *testing.T) {
+	defer func() { tlsRootCAs = nil }()
+	ca := newTestCA(t)
+	server := startFakeSMTPWithTLS(t, ca.serverConfig(t))
+
+	pool, err := loadRootCAs(ca.writePEM(t), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsRootCAs = pool
+	env := envelope{From: "form@example.com", To: []string{"inbox@example.com"}}
+	if _, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage)); err != nil {
+		t.Fatalf("delivery to a server with a certificate from the configured CA failed: %v", err)
+	}
+	if len(server.Messages()) != 1 {
+		t.Error("the message was not delivered over TLS")
+	}
+
+	// A CA other than the server's is not trusted, and the delivery fails
+	// instead of going ahead in the clear.
+	other, err := loadRootCAs(newTestCA(t).writePEM(t), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsRootCAs = other
+	if _, err := sendMail(context.Background(), server.Addr(), nil, env, []byte(testMessage)); err == nil {
+		t.Error("trusted a certificate from a CA that is not configured")
+	}
+}
+
+func TestLoadRootCAs(t *testing.T) {
+	ca := newTestCA(t)
+	path := ca.writePEM(t)
+	for _, replace := range []bool{true, false} {
+		pool, err := loadRootCAs(path, replace)
+		if err != nil {
+			t.Fatalf("replace=%v: %v", replace, err)
+		}
+		if _, err := ca.cert.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+			t.Errorf("replace=%v: the pool does not trust the CA: %v", replace, err)
+		}
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0600)
+	if _, err := loadRootCAs(empty, true); err == nil {
+		t.Error("loaded a file without certificates")
+	}
+	if _, err := loadRootCAs(filepath.Join(t.TempDir(), "missing.pem"), true); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
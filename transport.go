@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// Transport hands a constructed message to whatever carries it onwards.
+type Transport interface {
+	Deliver(ctx context.Context, message *Email, msg []byte) (*deliveryResult, error)
+}
+
+// transport is selected by MAILER_TRANSPORT.
+var transport Transport = smtpTransport{}
+
+// newTransport returns the transport c selects.
+func newTransport(c *Config) Transport {
+	if c.Transport == "mailgun" {
+		return newMailgunTransport(c.MailgunAPIBase, c.MailgunDomain, c.MailgunAPIKey)
+	}
+	return smtpTransport{}
+}
+
+// smtpTransport delivers over SMTP, either through smarthostAddress or to
+// each recipient domain's MX.
+type smtpTransport struct{}
+
+func (smtpTransport) Deliver(ctx context.Context, e *Email, msg []byte) (*deliveryResult, error) {
+	var err error
+	result := &deliveryResult{}
+	trace := newDeliveryLog()
+	defer func() {
+		log.Printf("Delivery from %s, %s: %s, %s\n", e.From, result, trace, e.logSummary())
+	}()
+	domains, groups := e.envelopeRecipients()
+	if smarthostAddress != "" {
+		var recipients []string
+		for _, domain := range domains {
+			recipients = append(recipients, groups[domain]...)
+		}
+		domains = []string{""}
+		groups = map[string][]string{"": recipients}
+	}
+	for _, domain := range domains {
+		var domainResult *deliveryResult
+		var domainErr error
+		if smarthostAddress != "" {
+			domainResult, domainErr = e.sendVia(ctx, trace, []string{smarthostAddress}, smarthostCredentials, groups[domain], msg)
+		} else {
+			domainResult, domainErr = e.sendToDomain(ctx, trace, domain, groups[domain], msg)
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if domainResult != nil && (domainErr == nil || len(domainResult.Rejected) > 0) {
+			result.merge(domainResult)
+		} else {
+			for _, address := range groups[domain] {
+				result.reject(address, domainErr)
+			}
+		}
+		if domainErr != nil {
+			err = domainErr
+		}
+	}
+	return result, err
+}
+
+// sendToDomain delivers msg to recipients, which all share domain, trying
+// each of the domain's MX servers in turn.
+func (e *Email) sendToDomain(ctx context.Context, trace *deliveryLog, domain string, recipients []string, msg []byte) (*deliveryResult, error) {
+	if ownDomainViaSmarthost && fallbackSmarthost != "" && deliversToOwnDomain(domain) {
+		return e.sendVia(ctx, trace, []string{fallbackSmarthost}, smarthostCredentials, recipients, msg)
+	}
+	var servers = make([]string, 0)
+	mxServers, err := net.DefaultResolver.LookupMX(ctx, domain)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if dnsUnavailable(err) {
+			if fallbackSmarthost != "" {
+				log.Printf("Unable to resolve MX for %s, using fallback smarthost: %s\n", domain, err.Error())
+				return e.sendVia(ctx, trace, []string{fallbackSmarthost}, smarthostCredentials, recipients, msg)
+			}
+			return nil, &dnsUnavailableError{domain: domain, err: err}
+		}
+		return nil, err
+	}
+	if len(mxServers) == 0 {
+		return nil, fmt.Errorf("no MX records for %s", domain)
+	}
+	trace.mx(domain, mxServers)
+	for _, server := range mxServers {
+		servers = append(servers, fmt.Sprintf("%s:25", strings.TrimRight(server.Host, ".")))
+	}
+	return e.sendVia(ctx, trace, servers, nil, recipients, msg)
+}
+
+// sendVia tries servers in order until one accepts msg for recipients.
+func (e *Email) sendVia(ctx context.Context, trace *deliveryLog, servers []string, credentials *smtpCredentials, recipients []string, msg []byte) (*deliveryResult, error) {
+	var result *deliveryResult
+	var err error
+	rcptTo := strings.Join(recipients, ", ")
+	for _, server := range servers {
+		if logDeliveryAttempts {
+			log.Printf("Attempting send to: %s, smtp_from: %s, rcpt_to: %s, %s\n", server, envelopeSender(), rcptTo, e.logSummary())
+		}
+		if debugDumpDir != "" {
+			dumpMessage(server, envelopeSender(), recipients, msg)
+		}
+		result, err = sendMail(
+			ctx,
+			server,
+			credentials,
+			envelope{
+				From:     envelopeSender(),
+				To:       recipients,
+				SMTPUTF8: needsSMTPUTF8(append([]string{e.From, envelopeSender()}, recipients...)...),
+			},
+			msg,
+		)
+		trace.attempt(server, err)
+		if err == nil {
+			result.acceptedVia(server)
+			break
+		} else if ctx.Err() != nil {
+			return result, ctx.Err()
+		} else if logDeliveryAttempts {
+			log.Printf("Received error from %s: %s\n", server, err.Error())
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Attachment is a file uploaded alongside a submission. Its content is
+// spooled to a temp file so large uploads are never held in memory.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Size        int64
+	// Inline parts are shown within the HTML body, which refers to them
+	// as cid:ContentID.
+	Inline    bool
+	ContentID string
+	path      string
+}
+
+var maxAttachmentBytes int64
+var maxUploadBytes int64
+var allowedAttachmentTypes map[string]bool
+var maxAttachments int
+
+// maxMessageBytes caps the size of the built message, which is held in
+// memory while it is sent. Attachments count at their base64 size.
+var maxMessageBytes int64
+
+// maxFieldBytes bounds the plain (non-file) fields of a multipart form.
+const maxFieldBytes = 64 << 10
+
+var errUploadTooLarge = errors.New("upload exceeds size limit")
+var errUploadType = errors.New("attachment content type not allowed")
+var errTooManyAttachments = errors.New("too many attachments")
+
+// messageSizeError reports a built message over maxMessageBytes.
+type messageSizeError struct {
+	size  int
+	limit int64
+}
+
+func (e *messageSizeError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds the %d byte limit", e.size, e.limit)
+}
+
+// readMultipart populates m from a multipart/form-data request, streaming
+// each file part to disk. The returned status is the HTTP code to reply
+// with when err is non-nil.
+func (m *Email) readMultipart(w http.ResponseWriter, r *http.Request) (int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, multipartLimit())
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+
+	var total int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return bodyErrorStatus(r, err), err
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldBytes+1))
+			part.Close()
+			if err != nil {
+				return bodyErrorStatus(r, err), err
+			}
+			if len(value) > maxFieldBytes {
+				return http.StatusRequestEntityTooLarge, errUploadTooLarge
+			}
+			m.setField(part.FormName(), string(value))
+			continue
+		}
+
+		// Checked before spooling so surplus parts are never written out.
+		if len(m.Attachments) >= maxAttachments {
+			part.Close()
+			return http.StatusUnprocessableEntity, errTooManyAttachments
+		}
+		var contentID string
+		inline := part.FormName() == "inline"
+		if inline {
+			if contentID, err = partContentID(part.Header.Get("Content-ID"), part.FileName()); err != nil {
+				part.Close()
+				return http.StatusUnprocessableEntity, err
+			}
+		}
+		attachment, err := spoolAttachment(part, maxUploadBytes-total)
+		part.Close()
+		if attachment != nil {
+			attachment.Inline = inline
+			attachment.ContentID = contentID
+			m.Attachments = append(m.Attachments, attachment)
+			total += attachment.Size
+		}
+		switch err {
+		case nil:
+		case errUploadTooLarge:
+			return http.StatusRequestEntityTooLarge, err
+		case errUploadType:
+			return http.StatusUnsupportedMediaType, err
+		default:
+			return bodyErrorStatus(r, err), err
+		}
+	}
+}
+
+// readForm fills m from an application/x-www-form-urlencoded body, as a
+// plain HTML form posts it. On failure it returns the status to reply with.
+func (m *Email) readForm(r *http.Request) (int, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyErrorStatus(r, err), err
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return http.StatusBadRequest, errors.New("malformed form body")
+	}
+	for name, list := range values {
+		for _, value := range list {
+			if len(value) > maxFieldBytes {
+				return http.StatusRequestEntityTooLarge, errUploadTooLarge
+			}
+			m.setField(name, value)
+		}
+	}
+	return 0, nil
+}
+
+// multipartLimit bounds a whole multipart request: the uploads plus room
+// for the plain fields.
+func multipartLimit() int64 {
+	return maxUploadBytes + maxFieldBytes*3
+}
+
+func (m *Email) setField(name string, value string) {
+	if collectFields() {
+		if m.Fields == nil {
+			m.Fields = make(map[string]string)
+		}
+		m.Fields[name] = value
+	}
+	switch strings.ToLower(name) {
+	case "from":
+		m.From = value
+	case "name":
+		m.Name = value
+	case "to":
+		m.To = value
+	case "cc":
+		for _, address := range strings.Split(value, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				m.Cc = append(m.Cc, address)
+			}
+		}
+	case "replyto":
+		m.ReplyTo = value
+	case "subject":
+		m.Subject = value
+	case "body":
+		m.Body = value
+	case "html":
+		m.HTML = value
+	}
+}
+
+// spoolAttachment copies a single file part to a temp file, failing once it
+// exceeds either the per-file limit or the remaining total budget.
+func spoolAttachment(part *multipart.Part, remaining int64) (*Attachment, error) {
+	contentType := part.Header.Get("Content-Type")
+	if !attachmentTypeAllowed(contentType) {
+		return nil, errUploadType
+	}
+
+	limit := maxAttachmentBytes
+	if remaining < limit {
+		limit = remaining
+	}
+
+	file, err := os.CreateTemp("", "mailer-upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	attachment := &Attachment{
+		Filename:    filepath.Base(part.FileName()),
+		ContentType: contentType,
+		path:        file.Name(),
+	}
+	attachment.Size, err = io.Copy(file, io.LimitReader(part, limit+1))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			err = errUploadTooLarge
+		}
+		return attachment, err
+	}
+	if attachment.Size > limit {
+		return attachment, errUploadTooLarge
+	}
+	return attachment, nil
+}
+
+// contentDisposition builds the Content-Disposition of an attachment part.
+// A non-ASCII filename is sent RFC 2231 encoded as filename*, alongside an
+// ASCII filename for clients that do not understand it.
+func contentDisposition(disposition string, filename string) string {
+	encoded := mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, filename)
+	if fallback == filename {
+		return encoded
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": fallback}) +
+		strings.TrimPrefix(encoded, disposition)
+}
+
+// cleanup removes any spooled attachment files.
+func (m *Email) cleanup() {
+	for _, attachment := range m.Attachments {
+		if attachment.path != "" {
+			os.Remove(attachment.path)
+		}
+	}
+}
+
+func attachmentTypeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return allowedAttachmentTypes[mediaType]
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// postMultipart submits a form with the given number of small text/plain
+// attachments to /send.
+func postMultipart(t *testing.T, attachments int) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("from", "visitor@example.org")
+	form.WriteField("body", "hello")
+	for i := 0; i < attachments; i++ {
+		header := make(map[string][]string)
+		header["Content-Disposition"] = []string{fmt.Sprintf(`form-data; name="attachment"; filename="note-%d.txt"`, i)}
+		header["Content-Type"] = []string{"text/plain"}
+		part, err := form.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte("attached"))
+	}
+	form.Close()
+	r := httptest.NewRequest("POST", "/send", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	(&SendHandler{}).ServeHTTP(w, r)
+	return w
+}
+
+func TestSendLimitsAttachmentCount(t *testing.T) {
+	fake := setupSendHandler(t)
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+	maxAttachments, maxAttachmentBytes, maxUploadBytes = 3, 1<<10, 1<<20
+	allowedAttachmentTypes = map[string]bool{"text/plain": true}
+	defer func() {
+		maxAttachments, maxAttachmentBytes, maxUploadBytes = 0, 0, 0
+		allowedAttachmentTypes = nil
+	}()
+
+	w := postMultipart(t, maxAttachments+1)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("%d attachments answered %d, want 422", maxAttachments+1, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), errTooManyAttachments.Error()) {
+		t.Errorf("response %q does not name the problem", w.Body.String())
+	}
+	if files, _ := os.ReadDir(spool); len(files) != 0 {
+		t.Errorf("left %d spooled files behind after refusing the upload", len(files))
+	}
+
+	if w := postMultipart(t, maxAttachments); w.Code != http.StatusAccepted {
+		t.Fatalf("%d attachments answered %d, want 202", maxAttachments, w.Code)
+	}
+	waitFor(t, func() bool { return fake.count() == 1 })
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"notes.txt", "attachment; filename=notes.txt"},
+		{"my notes.txt", `attachment; filename="my notes.txt"`},
+		{"résumé.pdf", "attachment; filename=r_sum_.pdf; filename*=utf-8''r%C3%A9sum%C3%A9.pdf"},
+		{"履歴書.pdf", "attachment; filename=___.pdf; filename*=utf-8''%E5%B1%A5%E6%AD%B4%E6%9B%B8.pdf"},
+	}
+	for _, test := range tests {
+		got := contentDisposition("attachment", test.filename)
+		if got != test.want {
+			t.Errorf("contentDisposition(%q) = %q, want %q", test.filename, got, test.want)
+			continue
+		}
+		_, params, err := mime.ParseMediaType(got)
+		if err != nil {
+			t.Errorf("%q does not parse: %v", got, err)
+		} else if params["filename"] != test.filename {
+			t.Errorf("%q parses to filename %q, want %q", got, params["filename"], test.filename)
+		}
+	}
+}
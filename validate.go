@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxSubjectBytes keeps a client-supplied subject within a single header
+// line (RFC 5322 section 2.1.1).
+const maxSubjectBytes = 998
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validate checks every client-supplied field, normalizing the ones that
+// pass, and returns all the problems found rather than only the first.
+func (m *Email) validate() []fieldError {
+	var errs []fieldError
+	add := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fieldError{Field: field, Message: err.Error()})
+		}
+	}
+
+	add("from", m.validateFrom())
+	add("name", m.validateName())
+	if !allowInvalidUTF8 && !utf8.ValidString(m.Subject) {
+		add("subject", errors.New("subject must be valid UTF-8"))
+	} else if len(m.Subject) > maxSubjectBytes {
+		add("subject", errors.New("subject is too long"))
+	}
+	if !allowInvalidUTF8 && !utf8.ValidString(m.Body) {
+		add("body", errors.New("body must be valid UTF-8"))
+	} else if strings.TrimSpace(m.Body) == "" {
+		add("body", errors.New("body is required"))
+	}
+	if !allowInvalidUTF8 && !utf8.ValidString(m.HTML) {
+		add("html", errors.New("html must be valid UTF-8"))
+	} else {
+		add("html", m.validateInline())
+	}
+	add("cc", m.validateCc())
+	add("reply_to", m.validateReplyTo())
+	return errs
+}
+
+func (m *Email) validateFrom() error {
+	if strings.TrimSpace(m.From) == "" {
+		return errors.New("from is required")
+	}
+	if _, err := mail.ParseAddress(m.From); err != nil {
+		return errors.New("from must be an email address")
+	}
+	from, needsUTF8, err := normalizeSubmitter(m.From)
+	if err != nil {
+		return err
+	}
+	if needsUTF8 && !smtpUTF8Enabled {
+		return errors.New("addresses with non-ASCII local parts are not supported")
+	}
+	m.From = from
+	return nil
+}
+
+// validateName rejects display names that could break the From header.
+func (m *Email) validateName() error {
+	m.Name = strings.TrimSpace(m.Name)
+	for _, r := range m.Name {
+		if unicode.IsControl(r) {
+			return errors.New("name must not contain control characters")
+		}
+	}
+	if len(m.Name) > maxSubjectBytes {
+		return errors.New("name is too long")
+	}
+	return nil
+}
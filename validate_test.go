@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateRejectsInvalidUTF8(t *testing.T) {
+	defer func() { allowInvalidUTF8 = false }()
+	newMessage := func() *Email {
+		return &Email{From: "visitor@example.org", Subject: "caf\xe9", Body: "hello \xff there"}
+	}
+
+	fields := make(map[string]bool)
+	for _, fieldErr := range newMessage().validate() {
+		fields[fieldErr.Field] = true
+	}
+	for _, field := range []string{"subject", "body"} {
+		if !fields[field] {
+			t.Errorf("invalid UTF-8 in %s was not reported", field)
+		}
+	}
+
+	allowInvalidUTF8 = true
+	if errs := newMessage().validate(); len(errs) != 0 {
+		t.Errorf("MAILER_ALLOW_INVALID_UTF8 still rejected: %v", errs)
+	}
+}
+
+func TestSendRejectsInvalidUTF8Form(t *testing.T) {
+	fake := setupSendHandler(t)
+	form := url.Values{"from": {"visitor@example.org"}, "body": {"hello \xff there"}}
+
+	w := postSend("application/x-www-form-urlencoded", form.Encode())
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("answered %d, want 422", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "valid UTF-8") {
+		t.Errorf("response %q does not name the problem", w.Body.String())
+	}
+	if fake.count() != 0 {
+		t.Error("the submission was delivered")
+	}
+}
+
+func TestSendReportsEveryInvalidField(t *testing.T) {
+	fake := setupSendHandler(t)
+	payload, _ := json.Marshal(map[string]string{
+		"from":    "not an address",
+		"name":    "Visitor\x07",
+		"subject": strings.Repeat("s", maxSubjectBytes+1),
+		"body":    "   ",
+	})
+
+	w := postSend("application/json", string(payload))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("answered %d, want 422", w.Code)
+	}
+	var response errorEnvelope
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response %q is not an error envelope: %v", w.Body.String(), err)
+	}
+	want := map[string]string{
+		"from":    "from must be an email address",
+		"name":    "name must not contain control characters",
+		"subject": "subject is too long",
+		"body":    "body is required",
+	}
+	got := make(map[string]string)
+	for _, fieldErr := range response.Error.Fields {
+		got[fieldErr.Field] = fieldErr.Message
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fields = %v, want %v", got, want)
+	}
+	for _, message := range want {
+		if !strings.Contains(response.Error.Message, message) {
+			t.Errorf("message %q leaves out %q", response.Error.Message, message)
+		}
+	}
+	if fake.count() != 0 {
+		t.Error("the submission was delivered")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// successWebhook, when set, is sent a deliveryEvent for every message
+// accepted for at least one recipient. It runs apart from delivery, which
+// it never holds up or fails.
+var successWebhook string
+
+// webhookTimeout bounds each post, within httpClient's own timeout.
+var webhookTimeout = 10 * time.Second
+
+// webhookAttempts is how many times an event is posted before it is
+// dropped, waiting twice as long after each failure.
+const webhookAttempts = 3
+
+const deliveryEventSchema = "mailer.delivered/v1"
+
+// deliveryEvent is the webhook payload. Schema names its version, so
+// receivers can tell when fields change.
+type deliveryEvent struct {
+	Schema      string               `json:"schema"`
+	MessageID   string               `json:"message_id"`
+	From        string               `json:"from"`
+	Subject     string               `json:"subject"`
+	Recipients  []deliveredRecipient `json:"recipients"`
+	DeliveredAt time.Time            `json:"delivered_at"`
+}
+
+// deliveredRecipient names a recipient and the server that accepted the
+// message for it.
+type deliveredRecipient struct {
+	Address string `json:"address"`
+	Host    string `json:"host"`
+}
+
+// notifyDelivered posts a deliveryEvent for result in the background.
+func notifyDelivered(message *Email, result *deliveryResult) {
+	event := deliveryEvent{
+		Schema:      deliveryEventSchema,
+		MessageID:   message.MessageID,
+		From:        message.From,
+		Subject:     message.Subject,
+		DeliveredAt: time.Now().UTC(),
+	}
+	for _, address := range result.Accepted {
+		event.Recipients = append(event.Recipients, deliveredRecipient{Address: address, Host: result.acceptedBy[address]})
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Unable to encode delivery event: %s\n", err.Error())
+		return
+	}
+	go postWebhook(successWebhook, payload)
+}
+
+func postWebhook(url string, payload []byte) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postWebhookOnce(url, payload)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Giving up on webhook %s after %d attempts: %s\n", url, attempt, err.Error())
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebhookOnce(url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}